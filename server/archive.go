@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// archiveName is the download archive ytdlp-nfo reads from its working dir.
+const archiveName = ".ytdlp-archive.txt"
+
+// ArchiveEntry is one line of the download archive: "<extractor> <id>".
+type ArchiveEntry struct {
+	Extractor string `json:"extractor"`
+	ID        string `json:"id"`
+	JobID     string `json:"jobId,omitempty"`
+}
+
+func (e ArchiveEntry) String() string {
+	return e.Extractor + " " + e.ID
+}
+
+// parseArchive returns the well-formed entries of an archive, in order and
+// without duplicates.
+func parseArchive(data []byte) []ArchiveEntry {
+	var entries []ArchiveEntry
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		e := ArchiveEntry{Extractor: strings.ToLower(fields[0]), ID: fields[1]}
+		if !seen[e.String()] {
+			seen[e.String()] = true
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func formatArchive(entries []ArchiveEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.WriteString(e.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (m *DownloadManager) archivePath() string {
+	return filepath.Join(m.downloadDir, archiveName)
+}
+
+// readArchive returns the entries of the shared archive.
+func (m *DownloadManager) readArchive() ([]ArchiveEntry, error) {
+	f, err := os.Open(m.archivePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := lockFile(f, false); err != nil {
+		return nil, err
+	}
+	defer unlockFile(f)
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return parseArchive(data), nil
+}
+
+// updateArchive rewrites the shared archive in place under an exclusive
+// lock, so running ytdlp-nfo processes never append to a stale copy.
+func (m *DownloadManager) updateArchive(fn func([]ArchiveEntry) []ArchiveEntry) error {
+	m.archiveMu.Lock()
+	defer m.archiveMu.Unlock()
+
+	f, err := os.OpenFile(m.archivePath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f, true); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	out := formatArchive(fn(parseArchive(data)))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Write(out); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// removeArchiveEntries drops the given entries and returns how many were present.
+func (m *DownloadManager) removeArchiveEntries(remove []ArchiveEntry) (int, error) {
+	drop := make(map[string]bool, len(remove))
+	for _, e := range remove {
+		drop[e.String()] = true
+	}
+	removed := 0
+	err := m.updateArchive(func(entries []ArchiveEntry) []ArchiveEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if drop[e.String()] {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		return kept
+	})
+	return removed, err
+}
+
+// addArchiveEntries appends entries that are not yet in the archive and
+// returns how many were added.
+func (m *DownloadManager) addArchiveEntries(add []ArchiveEntry) (int, error) {
+	added := 0
+	err := m.updateArchive(func(entries []ArchiveEntry) []ArchiveEntry {
+		seen := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			seen[e.String()] = true
+		}
+		for _, e := range add {
+			if !seen[e.String()] {
+				seen[e.String()] = true
+				entries = append(entries, e)
+				added++
+			}
+		}
+		return entries
+	})
+	return added, err
+}
+
+// linkArchive points the job's archive at the shared one, or leaves the job
+// with a private archive when it should bypass it.
+func (m *DownloadManager) linkArchive(job *Job, jobDir string) {
+	link := filepath.Join(jobDir, archiveName)
+	if job.Options.BypassArchive {
+		if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(link)
+		}
+		return
+	}
+	os.Symlink(m.archivePath(), link)
+}
+
+// recordArchiveEntries remembers which archive entries belong to the job so
+// they can be removed later. A job that bypassed the archive has its
+// private entries merged into the shared archive.
+func (m *DownloadManager) recordArchiveEntries(job *Job, jobDir string) {
+	job.mu.Lock()
+	bypass := job.Options.BypassArchive
+	job.mu.Unlock()
+
+	var entries []ArchiveEntry
+	if bypass {
+		data, err := os.ReadFile(filepath.Join(jobDir, archiveName))
+		if err != nil {
+			return
+		}
+		entries = parseArchive(data)
+		if _, err := m.addArchiveEntries(entries); err != nil {
+			job.addWarning(fmt.Sprintf("could not update download archive: %v", err))
+		}
+	} else {
+		ids := nfoUniqueIDs(jobDir)
+		all, err := m.readArchive()
+		if err != nil {
+			return
+		}
+		for _, e := range all {
+			if ids[e.ID] {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for _, e := range entries {
+		line := e.String()
+		found := false
+		for _, have := range job.ArchiveEntries {
+			if have == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			job.ArchiveEntries = append(job.ArchiveEntries, line)
+		}
+	}
+}
+
+// nfoUniqueIDs returns every uniqueid found in the NFOs under dir.
+func nfoUniqueIDs(dir string) map[string]bool {
+	ids := make(map[string]bool)
+	files, _ := collectFiles(dir)
+	for _, f := range files {
+		if mediaType(f) != MediaNFO {
+			continue
+		}
+		doc, err := readNFO(filepath.Join(dir, f))
+		if err != nil {
+			continue
+		}
+		for _, u := range doc.UniqueIDs {
+			if v := strings.TrimSpace(u.Value); v != "" {
+				ids[v] = true
+			}
+		}
+	}
+	return ids
+}
+
+// archiveOwners maps archive lines to the job that recorded them.
+func (m *DownloadManager) archiveOwners() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	owners := make(map[string]string)
+	for _, j := range m.jobs {
+		j.mu.Lock()
+		for _, line := range j.ArchiveEntries {
+			owners[line] = j.ID
+		}
+		j.mu.Unlock()
+	}
+	return owners
+}
+
+func handleArchiveList(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := mgr.readArchive()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+		owners := mgr.archiveOwners()
+		result := []ArchiveEntry{}
+		for _, e := range entries {
+			if q != "" && !strings.Contains(strings.ToLower(e.String()), q) {
+				continue
+			}
+			e.JobID = owners[e.String()]
+			result = append(result, e)
+		}
+		// Newest entries are appended last
+		slices.Reverse(result)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func handleArchiveDelete(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := ArchiveEntry{Extractor: strings.ToLower(r.PathValue("extractor")), ID: r.PathValue("id")}
+		n, err := mgr.removeArchiveEntries([]ArchiveEntry{e})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if n == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "entry not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
+
+func handleJobArchiveDelete(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := visibleJob(mgr, r, r.PathValue("id"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		job.mu.Lock()
+		lines := append([]string(nil), job.ArchiveEntries...)
+		job.mu.Unlock()
+		remove := parseArchive([]byte(strings.Join(lines, "\n")))
+		n, err := mgr.removeArchiveEntries(remove)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+	}
+}
+
+func handleArchiveExport(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := mgr.readArchive()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="ytdlp-archive.txt"`)
+		w.Write(formatArchive(entries))
+	}
+}
+
+// maxArchiveImport bounds the size of an imported archive.
+const maxArchiveImport = 32 << 20
+
+// handleArchiveImport merges the posted archive into the shared one, or
+// replaces it with ?replace=true. Archives over maxArchiveImport are
+// rejected rather than cut short, which would drop their last entries.
+func handleArchiveImport(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxArchiveImport))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("archive larger than %d MB", maxArchiveImport>>20)})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		entries := parseArchive(data)
+		if r.URL.Query().Get("replace") == "true" {
+			err = mgr.updateArchive(func([]ArchiveEntry) []ArchiveEntry { return entries })
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"imported": len(entries)})
+			return
+		}
+		n, err := mgr.addArchiveEntries(entries)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"imported": n})
+	}
+}
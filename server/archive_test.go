@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestArchiveImportRejectsOversizedBody(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	if _, err := m.addArchiveEntries([]ArchiveEntry{{Extractor: "youtube", ID: "abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(m.archivePath())
+
+	line := []byte("youtube 0123456789\n")
+	body := bytes.Repeat(line, maxArchiveImport/len(line)+1)
+	for _, query := range []string{"", "?replace=true"} {
+		req := httptest.NewRequest("POST", "/api/archive/import"+query, bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		handleArchiveImport(m)(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("import%s of %d bytes got %d", query, len(body), rec.Code)
+		}
+	}
+	if after, _ := os.ReadFile(m.archivePath()); !bytes.Equal(after, before) {
+		t.Errorf("archive changed by a rejected import:\n%s", after)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestArchiveUpdateKeepsConcurrentAppends appends to the archive the way
+// yt-dlp does, under flock, while the server rewrites it.
+func TestArchiveUpdateKeepsConcurrentAppends(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range n {
+			f, err := os.OpenFile(m.archivePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := lockFile(f, true); err != nil {
+				errs <- err
+			}
+			fmt.Fprintf(f, "youtube appended%d\n", i)
+			unlockFile(f)
+			f.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range n {
+			if _, err := m.addArchiveEntries([]ArchiveEntry{{Extractor: "vimeo", ID: fmt.Sprint("imported", i)}}); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	entries, err := m.readArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		got[e.String()] = true
+	}
+	for i := range n {
+		for _, want := range []string{fmt.Sprintf("youtube appended%d", i), fmt.Sprintf("vimeo imported%d", i)} {
+			if !got[want] {
+				t.Errorf("archive lost %q", want)
+			}
+		}
+	}
+}
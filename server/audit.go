@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one mutating request: who made it, from where, what
+// it did and which jobs it touched.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	User    string    `json:"user,omitempty"`
+	Via     string    `json:"via,omitempty"` // session, token, cert or basic
+	TokenID string    `json:"tokenId,omitempty"`
+	IP      string    `json:"ip"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+	JobIDs  []string  `json:"jobIds,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// auditActions names the recorded routes. Other mutating routes are
+// recorded under their pattern.
+var auditActions = map[string]string{
+	"POST /api/download":                   "job.submit",
+	"POST /api/download/bulk":              "job.bulk_submit",
+	"POST /api/jobs/{id}/retry":            "job.retry",
+	"DELETE /api/jobs/{id}":                "job.delete",
+	"DELETE /api/jobs":                     "job.delete_all",
+	"DELETE /api/jobs/{id}/archive":        "archive.forget_job",
+	"POST /api/archive/import":             "archive.import",
+	"DELETE /api/archive/{extractor}/{id}": "archive.delete",
+	"POST /api/login":                      "auth.login",
+	"POST /api/logout":                     "auth.logout",
+	"GET /api/oidc/callback":               "auth.sso_login",
+	"POST /api/users":                      "user.create",
+	"PATCH /api/users/{name}":              "user.update",
+	"DELETE /api/users/{name}":             "user.delete",
+	"POST /api/tokens":                     "token.create",
+	"DELETE /api/tokens/{id}":              "token.revoke",
+	"POST /api/cookies":                    "cookies.upload",
+	"DELETE /api/cookies/{name}":           "cookies.delete",
+	"POST /api/library/rescan":             "library.rescan",
+}
+
+// maxAuditQuery bounds the entries returned by one query.
+const maxAuditQuery = 1000
+
+// auditLog appends entries to audit.jsonl in DATA_DIR. When the file
+// grows past maxSize it is rotated to audit.jsonl.1, shifting older files
+// up to keep rotated files. Without DATA_DIR the latest maxAuditQuery
+// entries are kept in memory.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	size    int64
+	entries []AuditEntry
+}
+
+func newAuditLog(dataDir string, maxSize int64, keep int) (*auditLog, error) {
+	a := &auditLog{maxSize: maxSize, keep: keep}
+	if dataDir == "" {
+		return a, nil
+	}
+	a.path = filepath.Join(dataDir, "audit.jsonl")
+	info, err := os.Stat(a.path)
+	if err == nil {
+		a.size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record appends an entry.
+func (a *auditLog) Record(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		a.entries = append(a.entries, e)
+		if len(a.entries) > maxAuditQuery {
+			a.entries = append(a.entries[:0], a.entries[len(a.entries)-maxAuditQuery:]...)
+		}
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("audit: failed to rotate log: %v", err)
+		}
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("audit: failed to write log: %v", err)
+		return
+	}
+	defer f.Close()
+	n, err := f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("audit: failed to write log: %v", err)
+	}
+}
+
+// rotate moves the current file aside. Must be called with a.mu held.
+func (a *auditLog) rotate() error {
+	if err := rotateLog(a.path, a.keep); err != nil {
+		return err
+	}
+	a.size = 0
+	return nil
+}
+
+// rotateLog renames path to path.1, shifting older files up to keep of
+// them. With keep at zero the file is removed instead.
+func rotateLog(path string, keep int) error {
+	if keep <= 0 {
+		return os.Remove(path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	return os.Rename(path, path+".1")
+}
+
+// AuditFilter selects entries in a query. Empty fields match everything.
+type AuditFilter struct {
+	User   string
+	Action string
+	JobID  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f *AuditFilter) match(e *AuditEntry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.JobID == "" || slices.Contains(e.JobIDs, f.JobID)) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns matching entries, newest first, searching rotated files
+// as well. The files are opened under the lock and read after releasing
+// it, so a slow query never holds up Record; open files stay readable
+// when a rotation renames or removes them meanwhile.
+func (a *auditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	if f.Limit <= 0 || f.Limit > maxAuditQuery {
+		f.Limit = maxAuditQuery
+	}
+	list := []AuditEntry{}
+	a.mu.Lock()
+	if a.path == "" {
+		defer a.mu.Unlock()
+		for i := len(a.entries) - 1; i >= 0 && len(list) < f.Limit; i-- {
+			if f.match(&a.entries[i]) {
+				list = append(list, a.entries[i])
+			}
+		}
+		return list, nil
+	}
+
+	// Entries appended to the current file after this point are left out
+	current := a.size
+	var files []*os.File
+	for i := 0; i <= a.keep; i++ {
+		path := a.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", a.path, i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			a.mu.Unlock()
+			closeAll(files)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	a.mu.Unlock()
+	defer closeAll(files)
+
+	for i, file := range files {
+		var r io.Reader = file
+		if i == 0 && file.Name() == a.path {
+			r = io.LimitReader(file, current)
+		}
+		matches, err := readAuditFile(r, &f, f.Limit-len(list))
+		if err != nil {
+			return nil, err
+		}
+		for j := len(matches) - 1; j >= 0; j-- {
+			list = append(list, matches[j])
+		}
+		if len(list) >= f.Limit {
+			break
+		}
+	}
+	return list, nil
+}
+
+func closeAll(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// readAuditFile returns the newest limit matching entries of one file,
+// oldest first.
+func readAuditFile(r io.Reader, f *AuditFilter, limit int) ([]AuditEntry, error) {
+	var matches []AuditEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && f.match(&e) {
+			matches = append(matches, e)
+			if len(matches) >= 2*limit {
+				matches = append(matches[:0], matches[len(matches)-limit:]...)
+			}
+		}
+	}
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	return matches, scanner.Err()
+}
+
+// auditRecord collects what a handler did during one request.
+type auditRecord struct {
+	user   string
+	jobIDs []string
+	detail string
+}
+
+type auditKey struct{}
+
+func auditFrom(r *http.Request) *auditRecord {
+	rec, _ := r.Context().Value(auditKey{}).(*auditRecord)
+	return rec
+}
+
+// auditJobs adds the IDs of jobs a request touched to its audit entry.
+func auditJobs(r *http.Request, ids ...string) {
+	if rec := auditFrom(r); rec != nil {
+		rec.jobIDs = append(rec.jobIDs, ids...)
+	}
+}
+
+// auditNote sets the detail of a request's audit entry.
+func auditNote(r *http.Request, detail string) {
+	if rec := auditFrom(r); rec != nil {
+		rec.detail = detail
+	}
+}
+
+// auditUser names the user of a request made before logging in.
+func auditUser(r *http.Request, username string) {
+	if rec := auditFrom(r); rec != nil {
+		rec.user = username
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditMiddleware records every state-changing API request, and single
+// sign-on logins. It runs inside authMiddleware so the principal is known.
+func auditMiddleware(next http.Handler, audit *auditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sso := r.Method == http.MethodGet && r.URL.Path == "/api/oidc/callback"
+		if safeMethod(r.Method) && !sso {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &auditRecord{}
+		sw := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, rec))
+		next.ServeHTTP(sw, r)
+		// The mux sets the pattern on the request it routed
+		if r.Pattern == "" {
+			return
+		}
+
+		e := AuditEntry{
+			Time:   time.Now().UTC(),
+			Action: auditActions[r.Pattern],
+			IP:     clientIP(r),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Status: sw.status,
+			JobIDs: rec.jobIDs,
+			Detail: rec.detail,
+		}
+		if e.Action == "" {
+			e.Action = r.Pattern
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if p := principalFrom(r); p != anonymousAdmin {
+			e.User, e.Via, e.TokenID = p.Username, p.via, p.tokenID
+		}
+		if rec.user != "" {
+			e.User = rec.user
+		}
+		audit.Record(e)
+	})
+}
+
+func handleAudit(audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := AuditFilter{User: q.Get("user"), Action: q.Get("action"), JobID: q.Get("job")}
+		for _, p := range []struct {
+			name string
+			t    *time.Time
+		}{{"since", &f.Since}, {"until", &f.Until}} {
+			v := q.Get(p.name)
+			if v == "" {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				*p.t = t
+			} else if d, err := parseAge(v); err == nil {
+				*p.t = time.Now().Add(-d)
+			} else {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid " + p.name + ": use RFC 3339 or an age like 7d"})
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				return
+			}
+			f.Limit = n
+		}
+		entries, err := audit.Query(f)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
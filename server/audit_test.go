@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditRecordsMutations(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	users.Create("alice", "alice-password", RoleMember)
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	audit, err := newAuditLog(t.TempDir(), 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, _ := tokens.Create("alice", "script", ScopeSubmit, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", handleLogin(auth))
+	mux.HandleFunc("POST /api/download", handleSubmit(m))
+	mux.HandleFunc("GET /api/jobs", handleListJobs(m))
+	mux.HandleFunc("DELETE /api/jobs", handleDeleteAllJobs(m))
+	mux.HandleFunc("GET /api/audit", requireAdmin(handleAudit(audit)))
+	srv := httptest.NewServer(authMiddleware(auditMiddleware(mux, audit), auth))
+	defer srv.Close()
+
+	resp, _ := http.Post(srv.URL+"/api/login", "application/json", strings.NewReader(`{"username":"alice","password":"wrong"}`))
+	resp.Body.Close()
+	alice := login(t, srv, "alice", "alice-password")
+
+	req, _ := http.NewRequest("POST", srv.URL+"/api/download", strings.NewReader(`{"url":"https://example.com/a"}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job jobSummary
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	waitStatus(t, mustJob(t, m, job.ID), StatusCompleted)
+
+	call(t, srv, "GET", "/api/jobs", alice)
+	call(t, srv, "DELETE", "/api/jobs", alice)
+
+	admin := login(t, srv, "admin", "admin-password")
+	query := func(qs string) []AuditEntry {
+		t.Helper()
+		var entries []AuditEntry
+		resp := call(t, srv, "GET", "/api/audit"+qs, admin)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /api/audit%s: status %d", qs, resp.StatusCode)
+		}
+		json.NewDecoder(resp.Body).Decode(&entries)
+		return entries
+	}
+
+	entries := query("?user=alice")
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, fmt.Sprintf("%s:%d", e.Action, e.Status))
+	}
+	want := "job.delete_all:200 job.submit:201 auth.login:200 auth.login:401"
+	if got := strings.Join(actions, " "); got != want {
+		t.Errorf("alice's actions = %s, want %s", got, want)
+	}
+
+	submit := query("?action=job.submit")
+	if len(submit) != 1 {
+		t.Fatalf("submissions = %+v", submit)
+	}
+	if e := submit[0]; e.Via != "token" || e.TokenID == "" || e.IP != "127.0.0.1" || e.Detail != "https://example.com/a" {
+		t.Errorf("submission entry = %+v", e)
+	}
+	if byJob := query("?job=" + job.ID); len(byJob) != 2 {
+		t.Errorf("entries for job %s = %+v, want submit and delete", job.ID, byJob)
+	}
+	if got := query("?user=alice&limit=1"); len(got) != 1 || got[0].Action != "job.delete_all" {
+		t.Errorf("limit 1 = %+v", got)
+	}
+	if got := query("?since=" + time.Now().Add(time.Hour).Format(time.RFC3339)); len(got) != 0 {
+		t.Errorf("future since = %+v", got)
+	}
+	if resp := call(t, srv, "GET", "/api/audit", alice); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member read the audit log: %d", resp.StatusCode)
+	}
+}
+
+func TestAuditRetryOutcome(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/fails", fakeAttempt{Exit: 1})
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1}, fake)
+	failed, _ := m.StartDownload("https://example.com/fails", DefaultOptions(), "")
+	done, _ := m.StartDownload("https://example.com/works", DefaultOptions(), "")
+	waitStatus(t, failed, StatusFailed)
+	waitStatus(t, done, StatusCompleted)
+	audit, _ := newAuditLog("", 0, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/jobs/{id}/retry", handleRetryJob(m))
+	srv := httptest.NewServer(auditMiddleware(mux, audit))
+	defer srv.Close()
+
+	call(t, srv, "POST", "/api/jobs/"+done.ID+"/retry", nil)
+	call(t, srv, "POST", "/api/jobs/"+failed.ID+"/retry", nil)
+
+	entries, _ := audit.Query(AuditFilter{Action: "job.retry"})
+	if len(entries) != 2 {
+		t.Fatalf("retry entries = %+v", entries)
+	}
+	if e := entries[1]; e.Status != http.StatusBadRequest || len(e.JobIDs) != 0 || !strings.Contains(e.Detail, "rejected") {
+		t.Errorf("rejected retry entry = %+v", e)
+	}
+	if e := entries[0]; e.Status != http.StatusOK || len(e.JobIDs) != 1 || e.JobIDs[0] != failed.ID {
+		t.Errorf("retry entry = %+v", e)
+	}
+}
+
+func mustJob(t *testing.T, m *DownloadManager, id string) *Job {
+	t.Helper()
+	job, ok := m.GetJob(id)
+	if !ok {
+		t.Fatalf("job %s not found", id)
+	}
+	return job
+}
+
+func TestAuditRotation(t *testing.T) {
+	dataDir := t.TempDir()
+	audit, _ := newAuditLog(dataDir, 1024, 2)
+	for i := 0; i < 60; i++ {
+		audit.Record(AuditEntry{Time: time.Now(), Action: "job.retry", JobIDs: []string{fmt.Sprint(i)}})
+	}
+
+	for _, name := range []string{"audit.jsonl", "audit.jsonl.1", "audit.jsonl.2"} {
+		info, err := os.Stat(filepath.Join(dataDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, over the limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "audit.jsonl.3")); !os.IsNotExist(err) {
+		t.Error("more rotated files kept than configured")
+	}
+
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) >= 60 {
+		t.Fatalf("query returned %d entries", len(entries))
+	}
+	// Newest first, and contiguous across the rotated files
+	for i, e := range entries {
+		if want := fmt.Sprint(59 - i); e.JobIDs[0] != want {
+			t.Fatalf("entry %d is job %s, want %s", i, e.JobIDs[0], want)
+		}
+	}
+
+	// A limit keeps the newest matches only
+	limited, _ := audit.Query(AuditFilter{Limit: 3})
+	if len(limited) != 3 || limited[0].JobIDs[0] != "59" || limited[2].JobIDs[0] != "57" {
+		t.Errorf("limited query = %+v", limited)
+	}
+
+	reopened, _ := newAuditLog(dataDir, 1024, 2)
+	reopened.Record(AuditEntry{Time: time.Now(), Action: "job.delete", JobIDs: []string{"new"}})
+	if got, _ := reopened.Query(AuditFilter{Limit: 1}); len(got) != 1 || got[0].JobIDs[0] != "new" {
+		t.Errorf("after reopening, newest = %+v", got)
+	}
+}
+
+func TestRetentionAuditRotation(t *testing.T) {
+	dataDir := t.TempDir()
+	a := newRetentionAudit(dataDir, 1024, 1)
+	for i := 0; i < 40; i++ {
+		a.add(RetentionAuditEntry{Time: time.Now(), JobID: fmt.Sprint(i), Path: "/media/video.mkv", Reason: "older than 30d"})
+	}
+	for _, name := range []string{"retention-audit.jsonl", "retention-audit.jsonl.1"} {
+		info, err := os.Stat(filepath.Join(dataDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, over the limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "retention-audit.jsonl.2")); !os.IsNotExist(err) {
+		t.Error("more rotated files kept than configured")
+	}
+	if list := a.list(); len(list) != 40 || list[0].JobID != "39" {
+		t.Errorf("in-memory entries = %d, newest %+v", len(list), list[0])
+	}
+}
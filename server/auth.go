@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookie holds the login session of the web UI.
+const sessionCookie = "ytdlp_session"
+
+// sessionMaxAge bounds a session however actively it is used.
+const sessionMaxAge = 7 * 24 * time.Hour
+
+// csrfHeader carries the session's CSRF token on state-changing requests.
+const csrfHeader = "X-CSRF-Token"
+
+// Principal is the user a request acts as.
+type Principal struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Scope    string `json:"scope,omitempty"` // API token scope, empty for logins
+
+	csrf    string // CSRF token of the session, if the request used one
+	session string // ID of the session, if the request used one
+	via     string // how the request authenticated: session, token, cert or basic
+	tokenID string // ID of the API token, if one was used
+}
+
+func (p *Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+// CanAccess reports whether p may see and manage job: admins see every
+// job, members only their own.
+func (p *Principal) CanAccess(job *Job) bool {
+	return p.IsAdmin() || job.Owner == p.Username
+}
+
+// Owner is the owner filter for job listings, empty for admins.
+func (p *Principal) Owner() string {
+	if p.IsAdmin() {
+		return ""
+	}
+	return p.Username
+}
+
+type principalKey struct{}
+
+// anonymousAdmin acts for every request while no accounts exist.
+var anonymousAdmin = &Principal{Role: RoleAdmin}
+
+// principalFrom returns the principal the auth middleware attached to r.
+func principalFrom(r *http.Request) *Principal {
+	if p, ok := r.Context().Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return anonymousAdmin
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type session struct {
+	username string
+	csrf     string
+	created  time.Time
+	expires  time.Time
+}
+
+// sessionStore keeps login sessions in memory; a restart logs everyone
+// out. Sessions expire after ttl without use and after sessionMaxAge in
+// any case.
+type sessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*session
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{ttl: ttl, sessions: make(map[string]*session)}
+}
+
+// Create starts a session and returns its ID.
+func (s *sessionStore) Create(username string) (string, session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", session{}, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", session{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for sid, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, sid)
+		}
+	}
+	sess := &session{username: username, csrf: csrf, created: now, expires: now.Add(s.ttl)}
+	s.sessions[id] = sess
+	return id, *sess, nil
+}
+
+// Lookup returns a valid session and extends it.
+func (s *sessionStore) Lookup(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return session{}, false
+	}
+	now := time.Now()
+	if now.After(sess.expires) {
+		delete(s.sessions, id)
+		return session{}, false
+	}
+	sess.expires = now.Add(s.ttl)
+	if limit := sess.created.Add(sessionMaxAge); sess.expires.After(limit) {
+		sess.expires = limit
+	}
+	return *sess, true
+}
+
+func (s *sessionStore) Revoke(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// RevokeUser ends every session of a user except the one with ID except.
+func (s *sessionStore) RevokeUser(username, except string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.username == username && id != except {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter throttles a username from one client address after
+// maxAttempts failed logins within the lockout window, and the address
+// after four times as many, so one client cannot try many accounts either.
+// Failures never lock an account for every client, which would let anyone
+// keep its owner out.
+type loginLimiter struct {
+	mu          sync.Mutex
+	maxAttempts int
+	lockout     time.Duration
+	failures    map[string]*loginFailures
+}
+
+func newLoginLimiter(maxAttempts int, lockout time.Duration) *loginLimiter {
+	return &loginLimiter{maxAttempts: maxAttempts, lockout: lockout, failures: make(map[string]*loginFailures)}
+}
+
+func loginKeys(ip, username string) []string {
+	return []string{"user:" + username + "@" + ip, "ip:" + ip}
+}
+
+func (l *loginLimiter) limit(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return l.maxAttempts * 4
+	}
+	return l.maxAttempts
+}
+
+// Locked returns how long the client, or the user from this client,
+// remains locked out.
+func (l *loginLimiter) Locked(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range loginKeys(ip, username) {
+		if f, ok := l.failures[key]; ok && f.lockedUntil.After(now) {
+			wait = max(wait, f.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failed login.
+func (l *loginLimiter) Fail(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, f := range l.failures {
+		if now.Sub(f.first) > l.lockout && now.After(f.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+	for _, key := range loginKeys(ip, username) {
+		f, ok := l.failures[key]
+		if !ok {
+			f = &loginFailures{first: now}
+			l.failures[key] = f
+		}
+		f.count++
+		if f.count >= l.limit(key) && !f.lockedUntil.After(now) {
+			f.lockedUntil = now.Add(l.lockout)
+			log.Printf("auth: too many failed logins for %s, locked for %s", key, l.lockout)
+		}
+	}
+}
+
+// Succeed clears the failures of a user from a client after a successful
+// login.
+func (l *loginLimiter) Succeed(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, loginKeys(ip, username)[0])
+}
+
+// AuthConfig tunes sessions and login throttling.
+type AuthConfig struct {
+	SessionTTL  time.Duration // idle timeout of a login session
+	MaxAttempts int           // failed logins before a user is locked out of a client
+	Lockout     time.Duration // how long a lockout lasts
+	OIDC        *OIDCConfig   // single sign-on, nil when disabled
+}
+
+// authenticator resolves the principal of a request. Authentication is
+// off until the first account exists or single sign-on is configured.
+type authenticator struct {
+	users    *userStore
+	tokens   *tokenStore
+	sessions *sessionStore
+	limiter  *loginLimiter
+	oidc     *oidcProvider
+
+	basicMu    sync.Mutex
+	basicCache map[[32]byte]basicEntry // by hash of username and password
+}
+
+func newAuthenticator(users *userStore, tokens *tokenStore, cfg AuthConfig) *authenticator {
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 24 * time.Hour
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Lockout <= 0 {
+		cfg.Lockout = 15 * time.Minute
+	}
+	a := &authenticator{
+		users:    users,
+		tokens:   tokens,
+		sessions: newSessionStore(cfg.SessionTTL),
+		limiter:  newLoginLimiter(cfg.MaxAttempts, cfg.Lockout),
+
+		basicCache: make(map[[32]byte]basicEntry),
+	}
+	if cfg.OIDC != nil {
+		a.oidc = newOIDCProvider(*cfg.OIDC)
+	}
+	return a
+}
+
+// enabled reports whether requests must authenticate.
+func (a *authenticator) enabled() bool {
+	return a.oidc != nil || !a.users.Empty()
+}
+
+// lockedOutError rejects a login attempt during a lockout.
+type lockedOutError struct {
+	retryAfter time.Duration
+}
+
+func (e *lockedOutError) Error() string {
+	return "too many failed logins, try again later"
+}
+
+var errBadCredentials = errors.New("invalid username or password")
+
+// errLegacyBearer rejects the shared PASSWORD sent as a Bearer token,
+// which older versions accepted. It gets its own message so upgraded
+// scripts fail with a hint rather than a bare 401.
+var errLegacyBearer = errors.New("bearer credentials must be an API token (" + apiTokenPrefix + "...), create one with POST /api/tokens; the shared password is no longer accepted")
+
+// clientIP returns the address a request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkPassword verifies credentials, subject to the login limiter.
+func (a *authenticator) checkPassword(r *http.Request, username, password string) (User, error) {
+	ip := clientIP(r)
+	if wait := a.limiter.Locked(ip, username); wait > 0 {
+		return User{}, &lockedOutError{retryAfter: wait}
+	}
+	u, ok := a.users.Authenticate(username, password)
+	if !ok {
+		a.limiter.Fail(ip, username)
+		return User{}, errBadCredentials
+	}
+	a.limiter.Succeed(ip, username)
+	return u, nil
+}
+
+// basicCacheTTL is how long a verified basic auth password is remembered,
+// so scripts do not pay for bcrypt on every request.
+const basicCacheTTL = 5 * time.Minute
+
+// maxBasicCache bounds the remembered passwords; the cache is emptied when
+// it is full.
+const maxBasicCache = 1000
+
+type basicEntry struct {
+	passwordHash string // the account's hash when verified; a change invalidates the entry
+	expires      time.Time
+}
+
+// checkBasic verifies basic auth credentials, skipping bcrypt for ones
+// verified recently against the same password hash.
+func (a *authenticator) checkBasic(r *http.Request, username, password string) (User, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if u, ok := a.users.Get(username); ok && u.PasswordHash != "" {
+		a.basicMu.Lock()
+		e, hit := a.basicCache[key]
+		a.basicMu.Unlock()
+		if hit && e.passwordHash == u.PasswordHash && time.Now().Before(e.expires) {
+			return u, nil
+		}
+	}
+	u, err := a.checkPassword(r, username, password)
+	if err != nil {
+		return User{}, err
+	}
+	a.basicMu.Lock()
+	if len(a.basicCache) >= maxBasicCache {
+		clear(a.basicCache)
+	}
+	a.basicCache[key] = basicEntry{passwordHash: u.PasswordHash, expires: time.Now().Add(basicCacheTTL)}
+	a.basicMu.Unlock()
+	return u, nil
+}
+
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// userPrincipal acts as an existing user. Roles are read on every
+// request so changes apply immediately.
+func (a *authenticator) userPrincipal(username, scope string) (*Principal, error) {
+	u, ok := a.users.Get(username)
+	if !ok {
+		return nil, errBadCredentials
+	}
+	return &Principal{Username: u.Username, Role: u.Role, Scope: scope}, nil
+}
+
+// principal authenticates r by API token, session cookie or HTTP basic
+// auth.
+func (a *authenticator) principal(r *http.Request) (*Principal, error) {
+	if !a.enabled() {
+		return anonymousAdmin, nil
+	}
+	if token := bearerToken(r); token != "" {
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			return nil, errLegacyBearer
+		}
+		t, ok := a.tokens.Lookup(token)
+		if !ok {
+			return nil, errBadCredentials
+		}
+		p, err := a.userPrincipal(t.Owner, t.Scope)
+		if err != nil {
+			return nil, err
+		}
+		p.via, p.tokenID = "token", t.ID
+		return p, nil
+	}
+	// A verified client certificate names the user in its common name
+	if name := clientCertUser(r); name != "" {
+		p, err := a.userPrincipal(name, "")
+		if err != nil {
+			return nil, err
+		}
+		p.via = "cert"
+		return p, nil
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sess, ok := a.sessions.Lookup(c.Value)
+		if !ok {
+			return nil, errBadCredentials
+		}
+		p, err := a.userPrincipal(sess.username, "")
+		if err != nil {
+			return nil, err
+		}
+		p.csrf, p.session, p.via = sess.csrf, c.Value, "session"
+		return p, nil
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		u, err := a.checkBasic(r, name, password)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{Username: u.Username, Role: u.Role, via: "basic"}, nil
+	}
+	return nil, errBadCredentials
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+}
+
+func writeLockedOut(w http.ResponseWriter, err *lockedOutError) {
+	writeTooManyRequests(w, err.retryAfter, err.Error())
+}
+
+// safeMethod reports whether a request cannot change state.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// publicPath reports whether r is part of logging in.
+func publicPath(r *http.Request) bool {
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/login", "POST /api/login", "GET /api/oidc/login", "GET /api/oidc/callback":
+		return true
+	}
+	return false
+}
+
+func authMiddleware(next http.Handler, auth *authenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || publicPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := auth.principal(r)
+		var locked *lockedOutError
+		if errors.As(err, &locked) {
+			writeLockedOut(w, locked)
+			return
+		} else if errors.Is(err, errLegacyBearer) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeUnauthorized(w)
+			return
+		}
+		// Cookies are sent by the browser on cross-site requests too, so
+		// changes made with a session must prove they come from the UI
+		if p.csrf != "" && !safeMethod(r.Method) &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(p.csrf)) != 1 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid CSRF token"})
+			return
+		}
+		// Browsers present client certificates and remembered basic auth
+		// credentials on cross-site requests too
+		if (p.via == "cert" || p.via == "basic") && !safeMethod(r.Method) && crossSiteRequest(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "cross-site request rejected"})
+			return
+		}
+		if !scopeAllows(p.Scope, r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "token scope does not allow this request"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// requireAdmin rejects requests from members.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r).IsAdmin() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// secureRequest reports whether the client connected over HTTPS, directly
+// or through a reverse proxy.
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setSessionCookie hands a new session to the browser.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Principal
+	AuthEnabled bool   `json:"authEnabled"`
+	CSRFToken   string `json:"csrfToken,omitempty"`
+}
+
+// handleLogin starts a session and sets it as an HttpOnly cookie. The
+// CSRF token for the session is returned in the body.
+func handleLogin(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req loginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		auditUser(r, req.Username)
+		u, err := auth.checkPassword(r, req.Username, req.Password)
+		var locked *lockedOutError
+		if errors.As(err, &locked) {
+			writeLockedOut(w, locked)
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		id, sess, err := auth.sessions.Create(u.Username)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		setSessionCookie(w, r, id)
+		writeJSON(w, http.StatusOK, authResponse{
+			Principal:   Principal{Username: u.Username, Role: u.Role},
+			AuthEnabled: true,
+			CSRFToken:   sess.csrf,
+		})
+	}
+}
+
+func handleLogout(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			auth.sessions.Revoke(c.Value)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   secureRequest(r),
+			SameSite: http.SameSiteStrictMode,
+		})
+		writeJSON(w, http.StatusOK, map[string]string{"status": "logged out"})
+	}
+}
+
+// handleAuth reports who the request is authenticated as, along with the
+// CSRF token of its session.
+func handleAuth(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r)
+		writeJSON(w, http.StatusOK, authResponse{
+			Principal:   *p,
+			AuthEnabled: auth.enabled(),
+			CSRFToken:   p.csrf,
+		})
+	}
+}
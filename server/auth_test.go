@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCookieAndCSRF(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	srv := newAuthServer(t, m)
+
+	sess := login(t, srv, "admin", "admin-password")
+	if !sess.cookie.HttpOnly || sess.cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie = %+v, want HttpOnly and SameSite=Strict", sess.cookie)
+	}
+	if resp := call(t, srv, "GET", "/api/jobs", sess); resp.StatusCode != http.StatusOK {
+		t.Errorf("session request got %d", resp.StatusCode)
+	}
+
+	// A cross-site form post carries the cookie but not the CSRF header
+	req, _ := http.NewRequest("DELETE", srv.URL+"/api/jobs", nil)
+	req.AddCookie(sess.cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request without CSRF token got %d", resp.StatusCode)
+	}
+	if resp := call(t, srv, "DELETE", "/api/jobs", sess); resp.StatusCode != http.StatusOK {
+		t.Errorf("request with CSRF token got %d", resp.StatusCode)
+	}
+
+	// The old session token no longer works as a bearer token
+	req, _ = http.NewRequest("GET", srv.URL+"/api/jobs", nil)
+	req.Header.Set("Authorization", "Bearer "+sess.cookie.Value)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("session ID as bearer token got %d", resp.StatusCode)
+	}
+
+	call(t, srv, "POST", "/api/logout", sess)
+	if resp := call(t, srv, "GET", "/api/jobs", sess); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request after logout got %d", resp.StatusCode)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	s := newSessionStore(time.Hour)
+	id, _, _ := s.Create("alice")
+	if _, ok := s.Lookup(id); !ok {
+		t.Fatal("new session not found")
+	}
+	s.sessions[id].expires = time.Now().Add(-time.Second)
+	if _, ok := s.Lookup(id); ok {
+		t.Error("expired session accepted")
+	}
+
+	id, _, _ = s.Create("alice")
+	s.sessions[id].created = time.Now().Add(-sessionMaxAge)
+	s.Lookup(id)
+	if _, ok := s.Lookup(id); ok {
+		t.Error("session outlived its maximum age")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	srv := newAuthServer(t, m)
+
+	post := func(user, password string) *http.Response {
+		body := strings.NewReader(`{"username":"` + user + `","password":"` + password + `"}`)
+		resp, err := http.Post(srv.URL+"/api/login", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 5; i++ {
+		if resp := post("alice", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := post("alice", "alice-password")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("login during lockout got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Basic auth is throttled by the same limiter
+	req, _ := http.NewRequest("GET", srv.URL+"/api/jobs", nil)
+	req.SetBasicAuth("alice", "alice-password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("basic auth during lockout got %d", resp.StatusCode)
+	}
+
+	// Other users are unaffected until the client itself is locked out
+	login(t, srv, "bob", "bob-password")
+}
+
+func TestLoginLimiterLocksClient(t *testing.T) {
+	l := newLoginLimiter(2, time.Minute)
+	for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		l.Fail("10.0.0.1", user)
+	}
+	if l.Locked("10.0.0.1", "unused") == 0 {
+		t.Error("client trying many accounts not locked out")
+	}
+	if l.Locked("10.0.0.2", "unused") != 0 {
+		t.Error("other client locked out")
+	}
+
+	// Failures from one client do not lock the account for others
+	l.Fail("10.0.0.3", "admin")
+	l.Fail("10.0.0.3", "admin")
+	if l.Locked("10.0.0.3", "admin") == 0 {
+		t.Error("client guessing admin's password not throttled")
+	}
+	if l.Locked("10.0.0.4", "admin") != 0 {
+		t.Error("admin locked out of every client")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/echo", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /api/echo", func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	defer srv.Close()
+
+	do := func(method, password string, header http.Header) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/api/echo", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.SetBasicAuth("admin", password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := do("POST", "admin-password", nil); got != http.StatusOK {
+		t.Fatalf("basic auth got %d", got)
+	}
+	if len(auth.basicCache) != 1 {
+		t.Errorf("verified password not remembered: %d entries", len(auth.basicCache))
+	}
+	if got := do("POST", "admin-password", http.Header{"Sec-Fetch-Site": {"cross-site"}}); got != http.StatusForbidden {
+		t.Errorf("cross-site basic auth request got %d", got)
+	}
+	if got := do("POST", "admin-password", http.Header{"Origin": {"https://evil.example"}}); got != http.StatusForbidden {
+		t.Errorf("basic auth request from another origin got %d", got)
+	}
+
+	// A password change invalidates the remembered one
+	newPassword := "changed-password"
+	if _, err := users.Update("admin", &newPassword, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := do("GET", "admin-password", nil); got != http.StatusUnauthorized {
+		t.Errorf("old password accepted after a change: %d", got)
+	}
+	if got := do("GET", newPassword, nil); got != http.StatusOK {
+		t.Errorf("new password got %d", got)
+	}
+}
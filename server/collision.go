@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CollisionPolicy decides what happens when a completed download would
+// land on a file that already exists in the library.
+type CollisionPolicy string
+
+const (
+	CollisionOverwrite  CollisionPolicy = "overwrite"
+	CollisionSkip       CollisionPolicy = "skip"
+	CollisionRename     CollisionPolicy = "rename"
+	CollisionKeepLarger CollisionPolicy = "keep-larger"
+	CollisionFail       CollisionPolicy = "fail"
+)
+
+func parseCollisionPolicy(s string) (CollisionPolicy, error) {
+	switch p := CollisionPolicy(s); p {
+	case CollisionOverwrite, CollisionSkip, CollisionRename, CollisionKeepLarger, CollisionFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown collision policy %q", s)
+}
+
+// FileConflict records a file that already existed at its destination.
+type FileConflict struct {
+	Path      string `json:"path"`
+	Action    string `json:"action"` // "overwritten", "skipped", "renamed", "failed"
+	RenamedTo string `json:"renamedTo,omitempty"`
+}
+
+func (c FileConflict) String() string {
+	switch c.Action {
+	case "renamed":
+		return fmt.Sprintf("%s already exists, saved as %s", c.Path, c.RenamedTo)
+	case "skipped":
+		return fmt.Sprintf("%s already exists, kept the existing file", c.Path)
+	case "overwritten":
+		return fmt.Sprintf("%s already exists, replaced it", c.Path)
+	}
+	return fmt.Sprintf("%s already exists", c.Path)
+}
+
+// fileMover moves files into a root directory, merging directories and
+// resolving file collisions according to policy. Final paths of every
+// file it places are collected in produced.
+type fileMover struct {
+	policy    CollisionPolicy
+	root      string
+	conflicts []FileConflict
+	produced  []string
+}
+
+// rename moves src to dst and records the files that end up under dst.
+func (mv *fileMover) rename(src, dst string) error {
+	var files []string
+	if info, err := os.Stat(src); err == nil && info.IsDir() {
+		rels, err := collectFiles(src)
+		if err != nil {
+			return err
+		}
+		for _, rel := range rels {
+			files = append(files, filepath.Join(dst, rel))
+		}
+	} else {
+		files = []string{dst}
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	mv.produced = append(mv.produced, files...)
+	return nil
+}
+
+func (mv *fileMover) record(dst, action, renamedTo string) {
+	c := FileConflict{Path: mv.rel(dst), Action: action}
+	if renamedTo != "" {
+		c.RenamedTo = mv.rel(renamedTo)
+	}
+	mv.conflicts = append(mv.conflicts, c)
+}
+
+func (mv *fileMover) rel(path string) string {
+	if mv.root != "" {
+		if rel, err := filepath.Rel(mv.root, path); err == nil {
+			return rel
+		}
+	}
+	return path
+}
+
+// move moves src to dst, recursively merging if both are directories.
+func (mv *fileMover) move(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dstInfo, dstErr := os.Stat(dst)
+	if dstErr != nil {
+		return mv.rename(src, dst)
+	}
+
+	if srcInfo.IsDir() && dstInfo.IsDir() {
+		// Both are directories — merge children individually
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := mv.move(
+				filepath.Join(src, entry.Name()),
+				filepath.Join(dst, entry.Name()),
+			); err != nil {
+				return err
+			}
+		}
+		return os.Remove(src)
+	}
+
+	policy := mv.policy
+	if policy == CollisionKeepLarger {
+		policy = CollisionSkip
+		if !srcInfo.IsDir() && !dstInfo.IsDir() && srcInfo.Size() > dstInfo.Size() {
+			policy = CollisionOverwrite
+		}
+	}
+
+	switch policy {
+	case CollisionSkip:
+		mv.record(dst, "skipped", "")
+		return os.RemoveAll(src)
+	case CollisionRename:
+		alt := freeName(dst)
+		mv.record(dst, "renamed", alt)
+		return mv.rename(src, alt)
+	case CollisionFail:
+		mv.record(dst, "failed", "")
+		return fmt.Errorf("%s already exists", mv.rel(dst))
+	}
+	mv.record(dst, "overwritten", "")
+	os.RemoveAll(dst)
+	return mv.rename(src, dst)
+}
+
+// collision returns the first existing path that moving src to dst would
+// land on, or "" when the move merges cleanly.
+func collision(src, dst string) (string, error) {
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return "", nil
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !srcInfo.IsDir() || !dstInfo.IsDir() {
+		return dst, nil
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if path, err := collision(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); path != "" || err != nil {
+			return path, err
+		}
+	}
+	return "", nil
+}
+
+// checkFail looks for collisions before anything is moved when the policy
+// is fail, so that a job is either delivered completely or not at all.
+func (mv *fileMover) checkFail(pairs [][2]string) error {
+	if mv.policy != CollisionFail {
+		return nil
+	}
+	for _, p := range pairs {
+		path, err := collision(p[0], p[1])
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			mv.record(path, "failed", "")
+			return fmt.Errorf("%s already exists", mv.rel(path))
+		}
+	}
+	return nil
+}
+
+// sidecarSuffixes are name endings kept together with the extension when
+// picking a free name, so "Video-thumb.jpg" becomes "Video (1)-thumb.jpg".
+var sidecarSuffixes = []string{"-thumb", "-poster", "-fanart"}
+
+// splitName splits a file name into a stem and the suffix that must stay
+// attached to it, including subtitle language tags such as ".en.srt".
+func splitName(name string) (string, string) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if subtitleExts[strings.ToLower(ext)] {
+		if lang := filepath.Ext(stem); lang != "" && len(lang) <= 7 {
+			stem = strings.TrimSuffix(stem, lang)
+			ext = lang + ext
+		}
+	}
+	for _, s := range sidecarSuffixes {
+		if strings.HasSuffix(stem, s) {
+			return strings.TrimSuffix(stem, s), s + ext
+		}
+	}
+	return stem, ext
+}
+
+// freeName returns the first "name (n).ext" variant of path that does not exist.
+func freeName(path string) string {
+	dir := filepath.Dir(path)
+	stem, suffix := splitName(filepath.Base(path))
+	for n := 1; ; n++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, n, suffix))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
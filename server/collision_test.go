@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMoverPolicies(t *testing.T) {
+	tests := []struct {
+		policy   CollisionPolicy
+		src, dst string // contents of the incoming and the existing file
+		want     string // content at the destination afterwards
+		action   string
+		renamed  bool
+		wantErr  bool
+	}{
+		{policy: CollisionOverwrite, src: "new", dst: "old", want: "new", action: "overwritten"},
+		{policy: CollisionSkip, src: "new", dst: "old", want: "old", action: "skipped"},
+		{policy: CollisionRename, src: "new", dst: "old", want: "old", action: "renamed", renamed: true},
+		{policy: CollisionKeepLarger, src: "newer", dst: "old", want: "newer", action: "overwritten"},
+		{policy: CollisionKeepLarger, src: "n", dst: "old", want: "old", action: "skipped"},
+		{policy: CollisionFail, src: "new", dst: "old", want: "old", action: "failed", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.src, func(t *testing.T) {
+			srcDir, root := t.TempDir(), t.TempDir()
+			src := filepath.Join(srcDir, "Video.mkv")
+			dst := filepath.Join(root, "Video.mkv")
+			os.WriteFile(src, []byte(tt.src), 0644)
+			os.WriteFile(dst, []byte(tt.dst), 0644)
+
+			mv := &fileMover{policy: tt.policy, root: root}
+			err := mv.move(src, dst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("move error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got, _ := os.ReadFile(dst); string(got) != tt.want {
+				t.Errorf("destination holds %q, want %q", got, tt.want)
+			}
+			if len(mv.conflicts) != 1 || mv.conflicts[0].Action != tt.action {
+				t.Fatalf("conflicts = %+v, want one %s", mv.conflicts, tt.action)
+			}
+			if tt.renamed {
+				if mv.conflicts[0].RenamedTo != "Video (1).mkv" {
+					t.Errorf("renamed to %q", mv.conflicts[0].RenamedTo)
+				}
+				if got, _ := os.ReadFile(filepath.Join(root, "Video (1).mkv")); string(got) != tt.src {
+					t.Errorf("renamed file holds %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFileMoverMergesDirectories(t *testing.T) {
+	srcDir, root := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "Channel"), 0755)
+	os.MkdirAll(filepath.Join(root, "Channel"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "Channel", "New.mkv"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(root, "Channel", "Old.mkv"), []byte("old"), 0644)
+
+	mv := &fileMover{policy: CollisionOverwrite, root: root}
+	if err := mv.move(filepath.Join(srcDir, "Channel"), filepath.Join(root, "Channel")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"New.mkv", "Old.mkv"} {
+		if _, err := os.Stat(filepath.Join(root, "Channel", name)); err != nil {
+			t.Errorf("%s missing after merge: %v", name, err)
+		}
+	}
+	if len(mv.conflicts) != 0 {
+		t.Errorf("unexpected conflicts %+v", mv.conflicts)
+	}
+	if len(mv.produced) != 1 || mv.produced[0] != filepath.Join(root, "Channel", "New.mkv") {
+		t.Errorf("produced = %v", mv.produced)
+	}
+}
+
+func TestFreeNameKeepsSidecarSuffixes(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"Video.mkv":       "Video (1).mkv",
+		"Video.en.srt":    "Video (1).en.srt",
+		"Video-thumb.jpg": "Video (1)-thumb.jpg",
+	}
+	for name, want := range tests {
+		if got := filepath.Base(freeName(filepath.Join(dir, name))); got != want {
+			t.Errorf("freeName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestFailPolicyMovesNothing(t *testing.T) {
+	outputDir := t.TempDir()
+	os.MkdirAll(filepath.Join(outputDir, "Channel"), 0755)
+	os.WriteFile(filepath.Join(outputDir, "Channel", "B.mkv"), []byte("old"), 0644)
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{
+		"Channel/A.mkv": "new",
+		"Channel/B.mkv": "new",
+		"Other/C.mkv":   "new",
+	}})
+	m, _ := newTestManager(t, ManagerConfig{OutputDir: outputDir, Collision: CollisionFail}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusFailed)
+
+	for _, rel := range []string{"Channel/A.mkv", "Other/C.mkv"} {
+		if _, err := os.Stat(filepath.Join(outputDir, rel)); !os.IsNotExist(err) {
+			t.Errorf("%s delivered although the job failed on a collision", rel)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(outputDir, "Channel", "B.mkv")); string(got) != "old" {
+		t.Errorf("existing file replaced: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(m.downloadDir, job.ID, "Channel", "A.mkv")); err != nil {
+		t.Errorf("downloaded files not kept in the job dir: %v", err)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.Conflicts) != 1 || job.Conflicts[0].Path != filepath.Join("Channel", "B.mkv") || len(job.Files) != 0 {
+		t.Errorf("conflicts = %+v, files = %+v", job.Conflicts, job.Files)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieExpiryWarning is how long before expiry a profile starts warning.
+const cookieExpiryWarning = 7 * 24 * time.Hour
+
+// CookieNone disables automatic cookie selection for a job.
+const CookieNone = "none"
+
+// cookieProfile is a Netscape cookie file uploaded for one or more sites.
+// Content is only ever held in memory and in the encrypted store.
+type cookieProfile struct {
+	Name      string    `json:"name"`
+	Hosts     []string  `json:"hosts"`
+	Content   string    `json:"content"`
+	Cookies   int       `json:"cookies"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CookieInfo is the public view of a cookie profile, without the cookies.
+type CookieInfo struct {
+	Name         string     `json:"name"`
+	Hosts        []string   `json:"hosts"`
+	Cookies      int        `json:"cookies"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Expired      bool       `json:"expired,omitempty"`
+	ExpiringSoon bool       `json:"expiringSoon,omitempty"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+func (p *cookieProfile) info(now time.Time) CookieInfo {
+	info := CookieInfo{Name: p.Name, Hosts: p.Hosts, Cookies: p.Cookies, UpdatedAt: p.UpdatedAt}
+	if !p.ExpiresAt.IsZero() {
+		exp := p.ExpiresAt
+		info.ExpiresAt = &exp
+		info.Expired = now.After(exp)
+		info.ExpiringSoon = !info.Expired && exp.Sub(now) < cookieExpiryWarning
+	}
+	return info
+}
+
+// parseNetscapeCookies validates a Netscape cookie file and returns the
+// number of cookies, the domains they belong to and the earliest expiry of
+// the persistent ones.
+func parseNetscapeCookies(content string) (int, []string, time.Time, error) {
+	count := 0
+	domains := make(map[string]bool)
+	var earliest time.Time
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return 0, nil, time.Time{}, fmt.Errorf("line %d: expected 7 tab-separated fields", n)
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return 0, nil, time.Time{}, fmt.Errorf("line %d: invalid expiry", n)
+		}
+		if expiry > 0 {
+			if t := time.Unix(expiry, 0).UTC(); earliest.IsZero() || t.Before(earliest) {
+				earliest = t
+			}
+		}
+		if d := strings.ToLower(strings.TrimPrefix(fields[0], ".")); d != "" {
+			domains[d] = true
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, time.Time{}, err
+	}
+	if count == 0 {
+		return 0, nil, time.Time{}, fmt.Errorf("no cookies found")
+	}
+	hosts := make([]string, 0, len(domains))
+	for d := range domains {
+		hosts = append(hosts, d)
+	}
+	sort.Strings(hosts)
+	return count, hosts, earliest, nil
+}
+
+// cookieStore keeps cookie profiles encrypted with AES-GCM in
+// cookies.enc under DATA_DIR. Without DATA_DIR profiles live in memory.
+type cookieStore struct {
+	mu       sync.RWMutex
+	path     string
+	aead     cipher.AEAD
+	profiles map[string]*cookieProfile
+}
+
+// cookieKey derives the store key from COOKIE_KEY, which may be a base64
+// encoded 32-byte key or a passphrase. Without one, a random key is kept
+// in cookies.key next to the store, which only guards against reading
+// cookies.enc on its own.
+func cookieKey(secret, dataDir string) ([]byte, error) {
+	if secret != "" {
+		if key, err := base64.StdEncoding.DecodeString(secret); err == nil && len(key) == 32 {
+			return key, nil
+		}
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:], nil
+	}
+
+	key := make([]byte, 32)
+	if dataDir == "" {
+		_, err := rand.Read(key)
+		return key, err
+	}
+	keyPath := filepath.Join(dataDir, "cookies.key")
+	log.Printf("cookies: COOKIE_KEY is not set, keeping the key in %s; anyone who can read DATA_DIR can decrypt cookie profiles", keyPath)
+	if data, err := os.ReadFile(keyPath); err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s is not a valid key", keyPath)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newCookieStore(dataDir, secret string) (*cookieStore, error) {
+	key, err := cookieKey(secret, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &cookieStore{aead: aead, profiles: make(map[string]*cookieProfile)}
+	if dataDir == "" {
+		return s, nil
+	}
+
+	s.path = filepath.Join(dataDir, "cookies.enc")
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("%s is corrupt", s.path)
+	}
+	plain, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: wrong COOKIE_KEY?", s.path)
+	}
+	var profiles []*cookieProfile
+	if err := json.Unmarshal(plain, &profiles); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", s.path, err)
+	}
+	for _, p := range profiles {
+		s.profiles[p.Name] = p
+	}
+	return s, nil
+}
+
+// save encrypts all profiles to disk. Must be called with s.mu held.
+func (s *cookieStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	profiles := make([]*cookieProfile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		profiles = append(profiles, p)
+	}
+	plain, err := json.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plain, nil)
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Put stores a profile, replacing any existing one with the same name.
+// Without explicit hosts, the domains found in the file are used.
+func (s *cookieStore) Put(name, content string, hosts []string) (CookieInfo, error) {
+	count, domains, expires, err := parseNetscapeCookies(content)
+	if err != nil {
+		return CookieInfo{}, err
+	}
+	if len(hosts) == 0 {
+		hosts = domains
+	}
+	for i, h := range hosts {
+		hosts[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(h), "."))
+	}
+	p := &cookieProfile{
+		Name:      name,
+		Hosts:     hosts,
+		Content:   content,
+		Cookies:   count,
+		ExpiresAt: expires,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.profiles[name]
+	s.profiles[name] = p
+	if err := s.save(); err != nil {
+		if prev != nil {
+			s.profiles[name] = prev
+		} else {
+			delete(s.profiles, name)
+		}
+		return CookieInfo{}, err
+	}
+	return p.info(time.Now()), nil
+}
+
+// Delete removes a profile and reports whether it existed.
+func (s *cookieStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[name]; !ok {
+		return false, nil
+	}
+	delete(s.profiles, name)
+	return true, s.save()
+}
+
+// List returns every profile without its cookies, sorted by name.
+func (s *cookieStore) List() []CookieInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	list := make([]CookieInfo, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		list = append(list, p.info(now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func cookieNames(list []CookieInfo) []string {
+	names := make([]string, len(list))
+	for i, c := range list {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func (s *cookieStore) Has(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.profiles[name]
+	return ok
+}
+
+// Select returns the profile for a job: the requested one, or the profile
+// with the most specific host matching rawURL.
+func (s *cookieStore) Select(requested, rawURL string) (*cookieProfile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if requested == CookieNone {
+		return nil, false
+	}
+	if requested != "" {
+		p, ok := s.profiles[requested]
+		return p, ok
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, false
+	}
+	host := strings.ToLower(u.Hostname())
+	var best *cookieProfile
+	bestLen := 0
+	for _, p := range s.profiles {
+		for _, h := range p.Hosts {
+			if (host == h || strings.HasSuffix(host, "."+h)) && len(h) > bestLen {
+				best, bestLen = p, len(h)
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// prepareCookies writes the job's cookie profile, if any, to a private
+// file in jobDir and returns the downloader arguments that use it. The
+// returned cleanup removes the file.
+func (m *DownloadManager) prepareCookies(job *Job, jobDir string) ([]string, func(), error) {
+	noop := func() {}
+	p, ok := m.cookies.Select(job.Options.CookieProfile, job.URL)
+	if !ok {
+		if job.Options.CookieProfile != "" && job.Options.CookieProfile != CookieNone {
+			return nil, noop, fmt.Errorf("cookie profile %q no longer exists", job.Options.CookieProfile)
+		}
+		return nil, noop, nil
+	}
+
+	info := p.info(time.Now())
+	switch {
+	case info.Expired:
+		job.addWarning(fmt.Sprintf("cookie profile %q expired on %s", p.Name, info.ExpiresAt.Format("2006-01-02")))
+	case info.ExpiringSoon:
+		job.addWarning(fmt.Sprintf("cookie profile %q expires on %s", p.Name, info.ExpiresAt.Format("2006-01-02")))
+	}
+
+	path := filepath.Join(jobDir, ".cookies.txt")
+	if err := os.WriteFile(path, []byte(p.Content), 0600); err != nil {
+		return nil, noop, fmt.Errorf("write cookies: %v", err)
+	}
+	job.appendLine(fmt.Sprintf("Using cookie profile %q", p.Name))
+	return []string{"--cookies", path}, func() { os.Remove(path) }, nil
+}
+
+type cookieUploadRequest struct {
+	Name    string   `json:"name"`
+	Content string   `json:"content"`
+	Hosts   []string `json:"hosts"`
+}
+
+// handleCookieUpload accepts a JSON body with the cookie file in content,
+// or the raw cookie file with the profile name in ?name=.
+func handleCookieUpload(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		var req cookieUploadRequest
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.Unmarshal(body, &req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+				return
+			}
+		} else {
+			req.Name = r.URL.Query().Get("name")
+			req.Content = string(body)
+			if hosts := r.URL.Query().Get("hosts"); hosts != "" {
+				req.Hosts = strings.Split(hosts, ",")
+			}
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || req.Name == CookieNone || strings.ContainsAny(req.Name, "/\\") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "a valid profile name is required"})
+			return
+		}
+		info, err := mgr.cookies.Put(req.Name, req.Content, req.Hosts)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func handleListCookies(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, mgr.cookies.List())
+	}
+}
+
+func handleDeleteCookies(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, err := mgr.cookies.Delete(r.PathValue("name"))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "cookie profile not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cookieFile(domain string, expires time.Time) string {
+	return fmt.Sprintf("# Netscape HTTP Cookie File\n%s\tTRUE\t/\tTRUE\t%d\tSID\tsecret-value\n", domain, expires.Unix())
+}
+
+func TestCookieStoreEncryptedRoundTrip(t *testing.T) {
+	dataDir := t.TempDir()
+	s, err := newCookieStore(dataDir, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("yt", cookieFile(".youtube.com", time.Now().Add(90*24*time.Hour)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, "cookies.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-value") {
+		t.Error("cookies stored in plain text")
+	}
+
+	reopened, err := newCookieStore(dataDir, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := reopened.Select("yt", ""); !ok || !strings.Contains(p.Content, "secret-value") {
+		t.Errorf("profile not restored: %+v", p)
+	}
+	if _, err := newCookieStore(dataDir, "other"); err == nil {
+		t.Error("store opened with the wrong key")
+	}
+}
+
+func TestCookieSelectionByHost(t *testing.T) {
+	s, _ := newCookieStore("", "")
+	exp := time.Now().Add(90 * 24 * time.Hour)
+	s.Put("google", cookieFile(".google.com", exp), nil)
+	s.Put("music", cookieFile(".music.youtube.com", exp), nil)
+	s.Put("yt", cookieFile(".youtube.com", exp), nil)
+
+	tests := map[string]string{
+		"https://www.youtube.com/watch?v=a":   "yt",
+		"https://music.youtube.com/watch?v=a": "music",
+		"https://notyoutube.com/a":            "",
+		"https://vimeo.com/1":                 "",
+	}
+	for rawURL, want := range tests {
+		p, ok := s.Select("", rawURL)
+		got := ""
+		if ok {
+			got = p.Name
+		}
+		if got != want {
+			t.Errorf("Select(%s) = %q, want %q", rawURL, got, want)
+		}
+	}
+	if _, ok := s.Select(CookieNone, "https://www.youtube.com/watch?v=a"); ok {
+		t.Error(`"none" still selected a profile`)
+	}
+}
+
+func TestParseNetscapeCookiesRejectsInvalid(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"# only comments\n",
+		"youtube.com\tTRUE\t/\tTRUE\n",
+		"youtube.com\tTRUE\t/\tTRUE\tsoon\tSID\tx\n",
+	} {
+		if _, _, _, err := parseNetscapeCookies(content); err == nil {
+			t.Errorf("accepted %q", content)
+		}
+	}
+}
+
+func TestCookieListHidesContent(t *testing.T) {
+	s, _ := newCookieStore("", "")
+	s.Put("yt", cookieFile(".youtube.com", time.Now().Add(2*24*time.Hour)), nil)
+	list := s.List()
+	if len(list) != 1 || !list[0].ExpiringSoon || list[0].Cookies != 1 {
+		t.Fatalf("List = %+v", list)
+	}
+	if strings.Contains(fmt.Sprintf("%+v", list), "secret-value") {
+		t.Error("List exposes cookie values")
+	}
+}
+
+func TestDownloadUsesCookieProfile(t *testing.T) {
+	fake := newFakeExecutor()
+	store, _ := newCookieStore("", "")
+	store.Put("yt", cookieFile(".youtube.com", time.Now().Add(24*time.Hour)), nil)
+	m, _ := newTestManager(t, ManagerConfig{Cookies: store}, fake)
+
+	job, _ := m.StartDownload("https://www.youtube.com/watch?v=a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+
+	fake.mu.Lock()
+	spec := fake.specs[0]
+	fake.mu.Unlock()
+	if len(spec.Args) < 2 || spec.Args[0] != "--cookies" {
+		t.Fatalf("args = %q, want --cookies first", spec.Args)
+	}
+	if _, err := os.Stat(spec.Args[1]); !os.IsNotExist(err) {
+		t.Errorf("cookie file left behind: %v", err)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.Warnings) == 0 || !strings.Contains(job.Warnings[0], "expires") {
+		t.Errorf("no expiry warning: %v", job.Warnings)
+	}
+	if strings.Contains(strings.Join(job.Output, "\n"), "secret-value") {
+		t.Error("cookie values written to the job output")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSize parses a byte size such as "500MB" or "5GB" (1024-based).
+func parseSize(raw string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	units := []struct {
+		suffix string
+		mult   uint64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	mult := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// diskUsageFunc reports the free and total bytes of the filesystem
+// holding path.
+type diskUsageFunc func(path string) (free, total uint64, err error)
+
+// DiskStat describes the filesystem holding one library root.
+type DiskStat struct {
+	Path  string `json:"path"`
+	Free  uint64 `json:"free"`
+	Total uint64 `json:"total"`
+	Low   bool   `json:"low"`
+	Error string `json:"error,omitempty"`
+}
+
+// diskStats reports free space for the download dir and every library root.
+func (m *DownloadManager) diskStats() []DiskStat {
+	seen := make(map[string]bool)
+	var stats []DiskStat
+	for _, root := range m.libraryRoots() {
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		st := DiskStat{Path: root}
+		free, total, err := m.diskUsage(root)
+		if err != nil {
+			st.Error = err.Error()
+		} else {
+			st.Free, st.Total = free, total
+			st.Low = m.minFreeSpace > 0 && free < m.minFreeSpace
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// lowOnSpace reports whether any root is below the free space threshold.
+func (m *DownloadManager) lowOnSpace() bool {
+	if m.minFreeSpace == 0 {
+		return false
+	}
+	for _, st := range m.diskStats() {
+		if st.Low {
+			return true
+		}
+	}
+	return false
+}
+
+// diskCheckCache is how long a free space check before starting a job is
+// trusted, so a burst of submissions costs a single statfs.
+const diskCheckCache = 5 * time.Second
+
+// canStart reports whether another job may take a concurrency slot.
+// Must be called with m.mu held.
+func (m *DownloadManager) canStart() bool {
+	return m.running < m.maxConcurrent && m.spaceToStart()
+}
+
+// spaceToStart reports whether free space allows starting a job, pausing
+// the queue when a root has run low since monitorDisk last looked.
+// Must be called with m.mu held.
+func (m *DownloadManager) spaceToStart() bool {
+	if m.minFreeSpace == 0 {
+		return true
+	}
+	if m.diskPaused {
+		return false
+	}
+	if time.Since(m.diskCheckedAt) < diskCheckCache {
+		return true
+	}
+	m.diskCheckedAt = time.Now()
+	if m.lowOnSpace() {
+		m.diskPaused = true
+		log.Printf("disk: free space below %d bytes, pausing queue", m.minFreeSpace)
+		return false
+	}
+	return true
+}
+
+// pauseForDisk stops the queue and sends running downloads back to it so
+// they do not burn through their retries on a full disk.
+// Must be called with m.mu held.
+func (m *DownloadManager) pauseForDisk() {
+	if !m.diskPaused {
+		m.diskPaused = true
+		log.Printf("disk: free space below %d bytes, pausing queue", m.minFreeSpace)
+	}
+	for _, job := range m.jobs {
+		job.mu.Lock()
+		if job.downloading && job.cancel != nil && !job.requeue {
+			job.requeue = true
+			job.cancel()
+		}
+		job.mu.Unlock()
+	}
+}
+
+// requeueFront puts an interrupted job back at the head of the queue.
+func (m *DownloadManager) requeueFront(job *Job, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.mu.Lock()
+	job.requeue = false
+	job.Progress = 0
+	job.mu.Unlock()
+	job.broadcastStatus(StatusQueued)
+	job.appendLine("--- Paused: " + reason + ", job re-queued ---")
+	m.queue = append([]string{job.ID}, m.queue...)
+	m.scheduleSave()
+}
+
+// monitorDisk periodically checks free space, pausing the queue when it
+// runs low and resuming once it recovers.
+func (m *DownloadManager) monitorDisk(interval time.Duration) {
+	defer m.shutdownWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		low := m.lowOnSpace()
+		m.mu.Lock()
+		m.diskCheckedAt = time.Now()
+		switch {
+		case low:
+			m.pauseForDisk()
+		case m.diskPaused:
+			m.diskPaused = false
+			log.Printf("disk: free space recovered, resuming queue")
+			m.drainQueue()
+		}
+		m.mu.Unlock()
+	}
+}
+
+type diskResponse struct {
+	Paused       bool       `json:"paused"`
+	MinFreeSpace uint64     `json:"minFreeSpace"`
+	Disks        []DiskStat `json:"disks"`
+}
+
+func handleDisk(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mgr.mu.RLock()
+		paused := mgr.diskPaused
+		mgr.mu.RUnlock()
+		writeJSON(w, http.StatusOK, diskResponse{
+			Paused:       paused,
+			MinFreeSpace: mgr.minFreeSpace,
+			Disks:        mgr.diskStats(),
+		})
+	}
+}
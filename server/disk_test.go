@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskGuardPausesAndResumes(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(50)
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	defer close(hold)
+	fake.script("https://example.com/a",
+		fakeAttempt{Hold: hold},
+		fakeAttempt{Files: map[string]string{"video.mkv": "video"}})
+	m, _ := newTestManager(t, ManagerConfig{
+		MinFreeSpace: 100,
+		DiskCheck:    10 * time.Millisecond,
+		DiskUsage: func(string) (uint64, uint64, error) {
+			return free.Load(), 1000, nil
+		},
+	}, fake)
+	paused := func() bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.diskPaused
+	}
+
+	// Low before the job starts: it waits in the queue
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	if jobStatus(job) != StatusQueued || !paused() {
+		t.Fatalf("job %s on a full disk, paused %v", jobStatus(job), paused())
+	}
+
+	free.Store(500)
+	waitStatus(t, job, StatusRunning)
+	if paused() {
+		t.Error("queue still paused after space recovered")
+	}
+
+	// Low while downloading: the job goes back to the queue
+	free.Store(50)
+	waitFor(t, "job to be re-queued", func() bool {
+		return strings.Contains(jobOutput(job), "Paused: low disk space")
+	})
+	if fake.Calls("https://example.com/a") != 1 {
+		t.Errorf("job restarted on a full disk")
+	}
+
+	free.Store(500)
+	waitStatus(t, job, StatusCompleted)
+	job.mu.Lock()
+	retries := job.RetryCount
+	job.mu.Unlock()
+	if retries != 0 {
+		t.Errorf("pause counted as %d retries", retries)
+	}
+}
+
+func TestCanStartChecksSpaceAtMostOncePerWindow(t *testing.T) {
+	var calls atomic.Int32
+	var free atomic.Uint64
+	free.Store(500)
+	m, _ := newTestManager(t, ManagerConfig{
+		MaxConcurrent: 30,
+		MinFreeSpace:  100,
+		DiskCheck:     time.Hour,
+		DiskUsage: func(string) (uint64, uint64, error) {
+			calls.Add(1)
+			return free.Load(), 1000, nil
+		},
+	}, newFakeExecutor())
+
+	urls := make([]string, 20)
+	for i := range urls {
+		urls[i] = "https://example.com/" + string(rune('a'+i))
+	}
+	before := calls.Load()
+	m.StartBulkDownload(urls, DefaultOptions(), "")
+	if n := calls.Load() - before; n > int32(len(m.libraryRoots())) {
+		t.Errorf("bulk submission checked free space %d times", n)
+	}
+
+	// Once the cached result expires, a start sees the full disk
+	free.Store(50)
+	m.mu.Lock()
+	m.diskCheckedAt = time.Time{}
+	m.mu.Unlock()
+	job, _ := m.StartDownload("https://example.com/late", DefaultOptions(), "")
+	if jobStatus(job) != StatusQueued {
+		t.Errorf("job %s on a full disk", jobStatus(job))
+	}
+}
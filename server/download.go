@@ -3,11 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -18,9 +18,22 @@ import (
 )
 
 type DownloadOptions struct {
-	Format    string `json:"format"`    // "mkv" or "mp4"
-	AllAudio  bool   `json:"allAudio"`  // download all audio tracks
-	Subtitles bool   `json:"subtitles"` // download all subtitles
+	Format      string `json:"format"`                // "mkv" or "mp4"
+	AllAudio    bool   `json:"allAudio"`              // download all audio tracks
+	Subtitles   bool   `json:"subtitles"`             // download all subtitles
+	Preset      string `json:"preset,omitempty"`      // preset the options were taken from
+	Destination string `json:"destination,omitempty"` // named library root, empty for the default
+	Template    string `json:"template,omitempty"`    // relative path template for produced files
+	// BypassArchive downloads even if the URL is in the download archive.
+	BypassArchive bool `json:"bypassArchive,omitempty"`
+	// Extras names the configured extra argument sets used for this job.
+	Extras []string `json:"extras,omitempty"`
+	// CookieProfile picks a stored cookie profile; empty selects one by
+	// URL host and "none" disables cookies.
+	CookieProfile string `json:"cookieProfile,omitempty"`
+	// Proxy picks a configured proxy; empty selects one by URL host and
+	// "none" connects directly.
+	Proxy string `json:"proxy,omitempty"`
 }
 
 func DefaultOptions() DownloadOptions {
@@ -53,19 +66,32 @@ type SSEEvent struct {
 type Job struct {
 	ID         string          `json:"id"`
 	URL        string          `json:"url"`
+	Owner      string          `json:"owner,omitempty"` // submitting user, empty without accounts
 	Status     JobStatus       `json:"status"`
 	CreatedAt  time.Time       `json:"createdAt"`
 	DoneAt     *time.Time      `json:"doneAt,omitempty"`
 	Error      string          `json:"error,omitempty"`
+	ErrorKind  string          `json:"errorKind,omitempty"`
 	Progress   float64         `json:"progress"`
 	RetryCount int             `json:"retryCount"`
 	MaxRetries int             `json:"maxRetries"`
 	Options    DownloadOptions `json:"options"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	Conflicts  []FileConflict  `json:"conflicts,omitempty"`
+	Files      []ProducedFile  `json:"files,omitempty"`
+	NFOIssues  []NFOIssue      `json:"nfoIssues,omitempty"`
+	// Notifications lists media server refreshes requested for this job.
+	Notifications []NotifyResult `json:"notifications,omitempty"`
+	// ArchiveEntries are the download archive lines recorded for this job.
+	ArchiveEntries []string `json:"archiveEntries,omitempty"`
 
 	mu          sync.Mutex
 	Output      []string `json:"-"`
 	subscribers []chan SSEEvent
 	cancel      context.CancelFunc
+	downloading bool   // ytdlp-nfo is running, as opposed to hooks or moves
+	requeue     bool   // interrupted for low disk space, go back to the queue
+	heldFor     string // unavailable proxy the queued job is waiting for
 }
 
 var progressRegex = regexp.MustCompile(`\[download\]\s+([\d.]+)%`)
@@ -124,6 +150,14 @@ func (j *Job) appendLine(line string) {
 	j.broadcast(SSEEvent{Type: "message", Data: line})
 }
 
+// addWarning records a non-fatal problem on the job and echoes it to the output.
+func (j *Job) addWarning(msg string) {
+	j.mu.Lock()
+	j.Warnings = append(j.Warnings, msg)
+	j.mu.Unlock()
+	j.appendLine("Warning: " + msg)
+}
+
 func (j *Job) closeSubscribers() {
 	j.mu.Lock()
 	defer j.mu.Unlock()
@@ -140,69 +174,194 @@ func (j *Job) broadcastStatus(s JobStatus) {
 	j.mu.Unlock()
 }
 
+// ManagerConfig holds the settings a DownloadManager is created with.
+type ManagerConfig struct {
+	DownloadDir   string
+	OutputDir     string
+	DataDir       string
+	MaxConcurrent int
+	MaxRetries    int
+	Destinations  map[string]string // destination name -> absolute root
+	Presets       []Preset
+	Collision     CollisionPolicy
+	LibraryRescan time.Duration
+	NFOValidation string // "off", "warn" or "strict"
+	NFORepair     bool
+	Notify        NotifyConfig
+	Hooks         HookConfig
+	MinFreeSpace  uint64        // pause the queue below this many free bytes, 0 disables
+	DiskCheck     time.Duration // how often free space is checked
+	DiskUsage     diskUsageFunc // reports free space, statfs when nil
+	Retention     []RetentionRule
+	RetentionRun  time.Duration // how often the retention janitor runs
+	AuditMaxSize  int64         // rotate retention-audit.jsonl past this size, 0 never
+	AuditKeep     int           // rotated retention audit files to keep
+	JobPrune      JobPruneConfig
+	Watchdog      WatchdogConfig
+	Executor      Executor // runs download attempts, Binary when nil
+	Binary        string   // downloader executable, "ytdlp-nfo" when empty
+	Extras        []Extra
+	Cookies       *cookieStore // in-memory store when nil
+	Proxies       ProxyConfig
+	URLPolicy     *URLPolicy // accepts every URL when nil
+	// MaxQueuedPerUser limits each owner's unfinished jobs, 0 for no limit.
+	MaxQueuedPerUser int
+	QuotaExempt      func(owner string) bool // e.g. admins
+	RetryBackoff     time.Duration           // delay before the first retry, tripled for each further one
+}
+
 type DownloadManager struct {
-	mu            sync.RWMutex
-	jobs          map[string]*Job
-	nextID        int
-	downloadDir   string
-	outputDir     string
-	dataDir       string
-	maxConcurrent int
-	maxRetries    int
-	running       int
-	queue         []string
-	shutdownCtx   context.Context
-	shutdownWg    sync.WaitGroup
-	saveDebounce  *time.Timer
-	saveMu        sync.Mutex
-}
-
-func NewDownloadManager(ctx context.Context, dir string, maxConcurrent int, maxRetries int, dataDir string, outputDir string) *DownloadManager {
+	mu               sync.RWMutex
+	jobs             map[string]*Job
+	nextID           int
+	downloadDir      string
+	outputDir        string
+	dataDir          string
+	maxConcurrent    int
+	maxRetries       int
+	destinations     map[string]string
+	presets          []Preset
+	collisionPolicy  CollisionPolicy
+	library          *libraryIndex
+	nfoValidation    string
+	nfoRepair        bool
+	notifier         *notifyBatcher
+	hooks            HookConfig
+	minFreeSpace     uint64
+	diskPaused       bool
+	diskCheckedAt    time.Time
+	diskUsage        diskUsageFunc
+	retentionRules   []RetentionRule
+	retentionLog     *retentionAudit
+	jobPrune         JobPruneConfig
+	watchdog         WatchdogConfig
+	executor         Executor
+	binary           string
+	extras           []Extra
+	cookies          *cookieStore
+	proxies          *proxyPool
+	urlPolicy        *URLPolicy
+	maxQueuedPerUser int
+	quotaExempt      func(owner string) bool
+	retryBackoff     time.Duration
+	running          int
+	queue            []string
+	shutdownCtx      context.Context
+	shutdownWg       sync.WaitGroup
+	saveDebounce     *time.Timer
+	saveMu           sync.Mutex
+	archiveMu        sync.Mutex
+}
+
+func NewDownloadManager(ctx context.Context, cfg ManagerConfig) *DownloadManager {
 	m := &DownloadManager{
-		jobs:          make(map[string]*Job),
-		downloadDir:   dir,
-		outputDir:     outputDir,
-		dataDir:       dataDir,
-		maxConcurrent: maxConcurrent,
-		maxRetries:    maxRetries,
-		shutdownCtx:   ctx,
+		jobs:             make(map[string]*Job),
+		downloadDir:      cfg.DownloadDir,
+		outputDir:        cfg.OutputDir,
+		dataDir:          cfg.DataDir,
+		maxConcurrent:    cfg.MaxConcurrent,
+		maxRetries:       cfg.MaxRetries,
+		destinations:     cfg.Destinations,
+		presets:          cfg.Presets,
+		collisionPolicy:  cfg.Collision,
+		nfoValidation:    cfg.NFOValidation,
+		nfoRepair:        cfg.NFORepair,
+		hooks:            cfg.Hooks,
+		minFreeSpace:     cfg.MinFreeSpace,
+		retentionRules:   cfg.Retention,
+		retentionLog:     newRetentionAudit(cfg.DataDir, cfg.AuditMaxSize, cfg.AuditKeep),
+		jobPrune:         cfg.JobPrune,
+		watchdog:         cfg.Watchdog,
+		executor:         cfg.Executor,
+		diskUsage:        cfg.DiskUsage,
+		binary:           cfg.Binary,
+		extras:           cfg.Extras,
+		cookies:          cfg.Cookies,
+		proxies:          newProxyPool(cfg.Proxies),
+		urlPolicy:        cfg.URLPolicy,
+		maxQueuedPerUser: cfg.MaxQueuedPerUser,
+		quotaExempt:      cfg.QuotaExempt,
+		retryBackoff:     cfg.RetryBackoff,
+		shutdownCtx:      ctx,
+	}
+	if m.binary == "" {
+		m.binary = "ytdlp-nfo"
+	}
+	if m.cookies == nil {
+		m.cookies, _ = newCookieStore("", "")
+	}
+	if m.executor == nil {
+		m.executor = commandExecutor{Path: m.binary}
+	}
+	if m.diskUsage == nil {
+		m.diskUsage = diskUsage
+	}
+	if m.retryBackoff <= 0 {
+		m.retryBackoff = 10 * time.Second
+	}
+	if cfg.Proxies.Interval <= 0 {
+		cfg.Proxies.Interval = time.Minute
+	}
+
+	if len(cfg.Notify.Notifiers) > 0 {
+		m.notifier = newNotifyBatcher(ctx, cfg.Notify, m.scheduleSave)
 	}
 
 	m.loadState()
+	m.startJobPruner()
+	m.startLibraryIndex(cfg.LibraryRescan)
+	if m.minFreeSpace > 0 {
+		m.shutdownWg.Add(1)
+		go m.monitorDisk(cfg.DiskCheck)
+	}
+	m.startRetentionJanitor(cfg.RetentionRun)
+	m.startProxyMonitor(cfg.Proxies.Interval)
 	m.drainQueue()
 
 	return m
 }
 
-func (m *DownloadManager) StartDownload(url string, opts DownloadOptions) (*Job, error) {
+// StartDownload submits a single URL on behalf of owner.
+func (m *DownloadManager) StartDownload(url string, opts DownloadOptions, owner string) (*Job, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if m.shutdownCtx.Err() != nil {
 		return nil, fmt.Errorf("server is shutting down")
 	}
+	// The URL is passed on the command line, where a leading dash would
+	// turn it into a flag
+	if strings.HasPrefix(url, "-") {
+		return nil, fmt.Errorf("invalid URL")
+	}
 
+	// Only the owner's own jobs count as duplicates, so a submission does
+	// not reveal what other users are downloading
 	for _, j := range m.jobs {
 		j.mu.Lock()
 		s := j.Status
 		j.mu.Unlock()
-		if j.URL == url && s != StatusCompleted {
+		if j.URL == url && j.Owner == owner && s != StatusCompleted {
 			return nil, fmt.Errorf("a download already exists for this URL")
 		}
 	}
+	if m.quotaLeft(owner) == 0 {
+		return nil, &quotaError{limit: m.maxQueuedPerUser}
+	}
 
 	m.nextID++
 	id := fmt.Sprintf("%d", m.nextID)
 	job := &Job{
 		ID:         id,
 		URL:        url,
+		Owner:      owner,
 		CreatedAt:  time.Now(),
 		MaxRetries: m.maxRetries,
 		Options:    opts,
 	}
 	m.jobs[id] = job
 
-	if m.running < m.maxConcurrent {
+	if m.canStart() && !m.proxyHeld(job) {
 		job.Status = StatusPending
 		m.running++
 		m.scheduleSave()
@@ -218,28 +377,31 @@ func (m *DownloadManager) StartDownload(url string, opts DownloadOptions) (*Job,
 }
 
 type BulkResult struct {
-	URL   string
-	Job   *Job
-	Error string
-	IsDup bool
+	URL           string
+	Job           *Job
+	Error         string
+	IsDup         bool
+	QuotaExceeded bool
 }
 
-func (m *DownloadManager) StartBulkDownload(urls []string, opts DownloadOptions) []BulkResult {
+func (m *DownloadManager) StartBulkDownload(urls []string, opts DownloadOptions, owner string) []BulkResult {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Build set of active (non-completed) URLs for O(1) duplicate checking
+	// Build set of the owner's active (non-completed) URLs for O(1)
+	// duplicate checking
 	activeURLs := make(map[string]bool)
 	for _, j := range m.jobs {
 		j.mu.Lock()
 		s := j.Status
 		j.mu.Unlock()
-		if s != StatusCompleted {
+		if s != StatusCompleted && j.Owner == owner {
 			activeURLs[j.URL] = true
 		}
 	}
 
 	shutdownErr := m.shutdownCtx.Err()
+	quotaLeft := m.quotaLeft(owner)
 
 	var results []BulkResult
 	for _, raw := range urls {
@@ -257,19 +419,31 @@ func (m *DownloadManager) StartBulkDownload(urls []string, opts DownloadOptions)
 			results = append(results, BulkResult{URL: url, Error: "server is shutting down"})
 			continue
 		}
+		if strings.HasPrefix(url, "-") {
+			results = append(results, BulkResult{URL: url, Error: "invalid URL"})
+			continue
+		}
+		if quotaLeft == 0 {
+			err := &quotaError{limit: m.maxQueuedPerUser}
+			results = append(results, BulkResult{URL: url, Error: err.Error(), QuotaExceeded: true})
+			continue
+		} else if quotaLeft > 0 {
+			quotaLeft--
+		}
 
 		m.nextID++
 		id := fmt.Sprintf("%d", m.nextID)
 		job := &Job{
 			ID:         id,
 			URL:        url,
+			Owner:      owner,
 			CreatedAt:  time.Now(),
 			MaxRetries: m.maxRetries,
 			Options:    opts,
 		}
 		m.jobs[id] = job
 
-		if m.running < m.maxConcurrent {
+		if m.canStart() && !m.proxyHeld(job) {
 			job.Status = StatusPending
 			m.running++
 			m.shutdownWg.Add(1)
@@ -294,12 +468,16 @@ func (m *DownloadManager) GetJob(id string) (*Job, bool) {
 	return job, ok
 }
 
-func (m *DownloadManager) ListJobs() []*Job {
+// ListJobs returns the jobs of owner, or every job when owner is empty,
+// newest first.
+func (m *DownloadManager) ListJobs(owner string) []*Job {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	jobs := make([]*Job, 0, len(m.jobs))
 	for _, j := range m.jobs {
-		jobs = append(jobs, j)
+		if owner == "" || j.Owner == owner {
+			jobs = append(jobs, j)
+		}
 	}
 	sort.Slice(jobs, func(i, j int) bool {
 		return jobs[j].CreatedAt.Before(jobs[i].CreatedAt)
@@ -307,8 +485,9 @@ func (m *DownloadManager) ListJobs() []*Job {
 	return jobs
 }
 
-// RetryJob resets a failed job and relaunches download.
-func (m *DownloadManager) RetryJob(id string) (*Job, error) {
+// RetryJob resets a failed job and relaunches download. With bypassArchive
+// set, the download archive is ignored for the new attempt.
+func (m *DownloadManager) RetryJob(id string, bypassArchive bool) (*Job, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -316,37 +495,57 @@ func (m *DownloadManager) RetryJob(id string) (*Job, error) {
 	if !ok {
 		return nil, fmt.Errorf("job not found")
 	}
+	// Failed jobs do not count towards the quota, so a retry is checked
+	// like a new submission
+	quotaLeft := m.quotaLeft(job.Owner)
 
 	job.mu.Lock()
 	if job.Status != StatusFailed {
 		job.mu.Unlock()
 		return nil, fmt.Errorf("job is not failed")
 	}
+	if quotaLeft == 0 {
+		job.mu.Unlock()
+		return nil, &quotaError{limit: m.maxQueuedPerUser}
+	}
 	job.Error = ""
+	job.ErrorKind = ""
 	job.DoneAt = nil
 	job.Progress = 0
 	job.RetryCount = 0
 	job.Output = nil
+	job.Warnings = nil
+	job.Conflicts = nil
+	job.NFOIssues = nil
+	if bypassArchive {
+		job.Options.BypassArchive = true
+	}
+	job.mu.Unlock()
 
-	if m.running < m.maxConcurrent {
+	// Like a new submission, a retry waits for its proxy in the queue
+	start := m.canStart() && !m.proxyHeld(job)
+	job.mu.Lock()
+	if start {
 		job.Status = StatusPending
 		m.running++
-		job.mu.Unlock()
-		m.scheduleSave()
-		m.shutdownWg.Add(1)
-		go m.runDownload(job)
 	} else {
 		job.Status = StatusQueued
 		m.queue = append(m.queue, id)
-		job.mu.Unlock()
-		m.scheduleSave()
+	}
+	job.mu.Unlock()
+	m.scheduleSave()
+	if start {
+		m.shutdownWg.Add(1)
+		go m.runDownload(job)
 	}
 
 	return job, nil
 }
 
-// DeleteJob removes a single job, cancelling it if running.
-func (m *DownloadManager) DeleteJob(id string) error {
+// DeleteJob removes a single job, cancelling it if running. With
+// deleteFiles set, the files it produced are removed from the library too,
+// except those another job's manifest still lists.
+func (m *DownloadManager) DeleteJob(id string, deleteFiles bool) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -354,10 +553,39 @@ func (m *DownloadManager) DeleteJob(id string) error {
 	if !ok {
 		return fmt.Errorf("job not found")
 	}
+	m.removeJob(job)
+
+	if deleteFiles {
+		job.mu.Lock()
+		files := job.Files
+		job.mu.Unlock()
+		shared := m.trackedPaths()
+		owned := make([]ProducedFile, 0, len(files))
+		for _, f := range files {
+			if shared[f.Path] {
+				log.Printf("delete job %s: keeping %s, another job lists it", id, f.Path)
+				continue
+			}
+			owned = append(owned, f)
+		}
+		for _, err := range m.removeProducedFiles(owned) {
+			log.Printf("delete job %s: %v", id, err)
+		}
+		if m.library != nil {
+			m.library.Refresh()
+		}
+	}
 
+	m.scheduleSave()
+	return nil
+}
+
+// removeJob dequeues or cancels a job, cleans up its download directory
+// and drops it. Must be called with m.mu held.
+func (m *DownloadManager) removeJob(job *Job) {
 	// Remove from queue if queued
 	for i, qid := range m.queue {
-		if qid == id {
+		if qid == job.ID {
 			m.queue = append(m.queue[:i], m.queue[i+1:]...)
 			break
 		}
@@ -371,20 +599,33 @@ func (m *DownloadManager) DeleteJob(id string) error {
 	job.mu.Unlock()
 
 	// Clean up job download directory
-	os.RemoveAll(filepath.Join(m.downloadDir, id))
+	os.RemoveAll(filepath.Join(m.downloadDir, job.ID))
 
 	job.closeSubscribers()
-	delete(m.jobs, id)
-	m.scheduleSave()
-	return nil
+	delete(m.jobs, job.ID)
 }
 
-// DeleteAllJobs removes all jobs, cancelling any that are running.
-func (m *DownloadManager) DeleteAllJobs() {
+// DeleteAllJobs removes all jobs, cancelling any that are running. With
+// owner set, only that user's jobs are removed. It returns the IDs of the
+// removed jobs.
+func (m *DownloadManager) DeleteAllJobs(owner string) []string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	var ids []string
+	if owner != "" {
+		for _, job := range m.jobs {
+			if job.Owner == owner {
+				ids = append(ids, job.ID)
+				m.removeJob(job)
+			}
+		}
+		m.scheduleSave()
+		return ids
+	}
+
 	for _, job := range m.jobs {
+		ids = append(ids, job.ID)
 		job.mu.Lock()
 		if job.cancel != nil {
 			job.cancel()
@@ -398,6 +639,7 @@ func (m *DownloadManager) DeleteAllJobs() {
 	m.queue = nil
 	m.running = 0
 	m.scheduleSave()
+	return ids
 }
 
 // startNextQueued decrements running count and starts the next queued job.
@@ -410,19 +652,7 @@ func (m *DownloadManager) startNextQueued() {
 	if m.shutdownCtx.Err() != nil {
 		return
 	}
-
-	for len(m.queue) > 0 {
-		id := m.queue[0]
-		m.queue = m.queue[1:]
-		job, ok := m.jobs[id]
-		if !ok {
-			continue
-		}
-		m.running++
-		m.shutdownWg.Add(1)
-		go m.runDownload(job)
-		return
-	}
+	m.drainQueue()
 }
 
 // jobExists checks if a job still exists in the manager (not deleted).
@@ -467,20 +697,32 @@ func (m *DownloadManager) runDownload(job *Job) {
 		}
 
 		if err == nil {
-			var moveErr error
-			if m.outputDir != "" {
-				moveErr = m.moveNewFiles(job, jobDir)
-			} else {
-				moveErr = flattenJobDir(jobDir, m.downloadDir)
+			m.recordArchiveEntries(job, jobDir)
+
+			var finishErr error
+			if err := m.checkNFOs(job, jobDir); err != nil {
+				finishErr = fmt.Errorf("NFO validation failed: %v", err)
+			} else if err := m.runHook(job, HookPostDownload, jobDir); err != nil {
+				// Files are still in the job dir, so a restart can pick the job up again
+				if m.shutdownCtx.Err() != nil {
+					return
+				}
+				finishErr = fmt.Errorf("post-download hook failed: %v", err)
+			} else if err := m.deliverFiles(job, jobDir); err != nil {
+				finishErr = fmt.Errorf("file move failed: %v", err)
+			} else if err := m.runHook(job, HookPostMove, jobDir); err != nil {
+				// Only reached with HOOK_FAILURE=fail: the files are in the
+				// library already, so the job cannot be run again
+				finishErr = fmt.Errorf("post-move hook failed: %v", err)
 			}
 
 			now := time.Now()
-			if moveErr != nil {
-				log.Printf("move failed for job %s: %v", job.ID, moveErr)
-				job.appendLine(fmt.Sprintf("Move failed: %v", moveErr))
+			if finishErr != nil {
+				log.Printf("job %s: %v", job.ID, finishErr)
+				job.appendLine(finishErr.Error())
 				job.mu.Lock()
 				job.Status = StatusFailed
-				job.Error = fmt.Sprintf("download succeeded but file move failed: %v", moveErr)
+				job.Error = "download succeeded but " + finishErr.Error()
 				job.DoneAt = &now
 				job.mu.Unlock()
 			} else {
@@ -488,7 +730,11 @@ func (m *DownloadManager) runDownload(job *Job) {
 				job.Status = StatusCompleted
 				job.DoneAt = &now
 				job.Progress = 100
+				files := job.Files
 				job.mu.Unlock()
+				if m.notifier != nil {
+					m.notifier.Add(job, files)
+				}
 			}
 			job.closeSubscribers()
 			m.scheduleSave()
@@ -500,6 +746,27 @@ func (m *DownloadManager) runDownload(job *Job) {
 			return
 		}
 
+		// A full disk is not the download's fault: keep the partial files so
+		// it can resume, and wait for space instead of burning retries
+		job.mu.Lock()
+		requeue := job.requeue
+		job.mu.Unlock()
+		reason := "low disk space"
+		if !requeue && errors.Is(err, errProxyUnavailable) {
+			reason = err.Error()
+			requeue = true
+		}
+		if !requeue && m.lowOnSpace() {
+			m.mu.Lock()
+			m.pauseForDisk()
+			m.mu.Unlock()
+			requeue = true
+		}
+		if requeue {
+			m.requeueFront(job, reason)
+			return
+		}
+
 		job.mu.Lock()
 		job.RetryCount++
 		attempt := job.RetryCount
@@ -511,6 +778,7 @@ func (m *DownloadManager) runDownload(job *Job) {
 			job.mu.Lock()
 			job.Status = StatusFailed
 			job.Error = err.Error()
+			job.ErrorKind = errorKind(err)
 			job.DoneAt = &now
 			job.mu.Unlock()
 			job.closeSubscribers()
@@ -519,8 +787,8 @@ func (m *DownloadManager) runDownload(job *Job) {
 			return
 		}
 
-		// Exponential backoff: 10s * 3^(attempt-1) => 10s, 30s, 90s
-		backoff := 10 * time.Second
+		// Exponential backoff: retryBackoff * 3^(attempt-1) => 10s, 30s, 90s by default
+		backoff := m.retryBackoff
 		for i := 1; i < attempt; i++ {
 			backoff *= 3
 		}
@@ -537,7 +805,7 @@ func (m *DownloadManager) runDownload(job *Job) {
 
 		m.scheduleSave()
 
-		job.appendLine(fmt.Sprintf("--- Retry %d/%d in %s ---", attempt, maxRetries, backoff))
+		job.appendLine(fmt.Sprintf("--- Retry %d/%d in %s (%s) ---", attempt, maxRetries, backoff, errorKind(err)))
 
 		timer := time.NewTimer(backoff)
 		select {
@@ -553,7 +821,7 @@ func (m *DownloadManager) runDownload(job *Job) {
 
 		// Re-acquire a concurrency slot before retrying
 		m.mu.Lock()
-		if m.running < m.maxConcurrent {
+		if m.canStart() {
 			m.running++
 			holdsSlot = true
 			m.mu.Unlock()
@@ -602,53 +870,160 @@ func (m *DownloadManager) executeDownload(job *Job, jobDir string) error {
 	ctx, cancel := context.WithCancel(m.shutdownCtx)
 	job.mu.Lock()
 	job.cancel = cancel
+	job.downloading = true
 	job.mu.Unlock()
+	defer func() {
+		job.mu.Lock()
+		job.downloading = false
+		job.mu.Unlock()
+	}()
 
 	// Symlink the shared archive into the job directory so ytdlp-nfo's
 	// hardcoded relative "download_archive": ".ytdlp-archive.txt" resolves correctly.
-	archiveTarget := filepath.Join(m.downloadDir, ".ytdlp-archive.txt")
-	archiveLink := filepath.Join(jobDir, ".ytdlp-archive.txt")
-	os.Symlink(archiveTarget, archiveLink)
-	cmd := exec.CommandContext(ctx, "ytdlp-nfo", job.URL)
-	cmd.Dir = jobDir
-	cmd.Env = append(os.Environ(),
-		"PYTHONUNBUFFERED=1",
-		"YTDLP_NFO_FORMAT="+job.Options.Format,
-		"YTDLP_NFO_ALL_AUDIO="+boolStr(job.Options.AllAudio),
-		"YTDLP_NFO_SUBTITLES="+boolStr(job.Options.Subtitles),
-	)
-
-	stdout, err := cmd.StdoutPipe()
+	m.linkArchive(job, jobDir)
+	spec := ExecSpec{
+		URL: job.URL,
+		Dir: jobDir,
+		Env: []string{
+			"PYTHONUNBUFFERED=1",
+			"YTDLP_NFO_FORMAT=" + job.Options.Format,
+			"YTDLP_NFO_ALL_AUDIO=" + boolStr(job.Options.AllAudio),
+			"YTDLP_NFO_SUBTITLES=" + boolStr(job.Options.Subtitles),
+		},
+	}
+	defer cancel()
+	proxyArgs, err := m.prepareProxy(job)
 	if err != nil {
-		cancel()
-		return fmt.Errorf("failed to create pipe: %v", err)
+		return err
 	}
-	cmd.Stderr = cmd.Stdout
-
-	if err := cmd.Start(); err != nil {
-		cancel()
-		return fmt.Errorf("failed to start: %v", err)
+	cookieArgs, removeCookies, err := m.prepareCookies(job, jobDir)
+	if err != nil {
+		return err
 	}
+	defer removeCookies()
+	args, env := m.extraArgs(job.Options.Extras)
+	spec.Args = append(append(proxyArgs, cookieArgs...), args...)
+	spec.Env = append(spec.Env, env...)
+
+	clock := &activityClock{}
+	clock.touch()
+	killed := m.watchDownload(ctx, cancel, clock)
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := m.executor.Run(ctx, spec, pw)
+		pw.Close()
+		done <- err
+	}()
 
-	scanner := bufio.NewScanner(stdout)
+	scanner := bufio.NewScanner(pr)
 	scanner.Split(scanCRLF)
 	for scanner.Scan() {
+		clock.touch()
 		if trimmed := strings.TrimSpace(scanner.Text()); trimmed != "" {
 			job.appendLine(trimmed)
 		}
 	}
-
-	return cmd.Wait()
+	// Drain anything left so the executor is never blocked on a write
+	io.Copy(io.Discard, pr)
+
+	err = <-done
+	cancel()
+	if reason := <-killed; reason != nil {
+		job.appendLine("--- Killed: " + reason.Error() + " ---")
+		return reason
+	}
+	return err
 }
 
-// moveNewFiles moves completed files from a job's directory to outputDir.
-// Uses a staging directory for atomicity so media servers never see partial files.
-func (m *DownloadManager) moveNewFiles(job *Job, jobDir string) error {
-	if m.outputDir == "" {
+// checkNFOs validates the NFOs in jobDir and records the findings on the
+// job. It only returns an error in strict mode.
+func (m *DownloadManager) checkNFOs(job *Job, jobDir string) error {
+	if m.nfoValidation == NFOValidationOff {
 		return nil
 	}
+	issues, err := validateNFOs(jobDir, m.nfoRepair)
+	if err != nil {
+		return err
+	}
+
+	job.mu.Lock()
+	job.NFOIssues = issues
+	job.mu.Unlock()
+
+	unrepaired := 0
+	for _, issue := range issues {
+		if !issue.Repaired {
+			unrepaired++
+		}
+		job.addWarning(issue.String())
+	}
+	if unrepaired > 0 && m.nfoValidation == NFOValidationStrict {
+		return fmt.Errorf("%d unresolved problem(s)", unrepaired)
+	}
+	return nil
+}
+
+// targetRoot returns the directory a job's files are delivered to: its
+// named destination, else outputDir, else downloadDir.
+func (m *DownloadManager) targetRoot(opts DownloadOptions) (string, error) {
+	if opts.Destination != "" {
+		root, ok := m.destinations[opts.Destination]
+		if !ok {
+			return "", fmt.Errorf("unknown destination %q", opts.Destination)
+		}
+		return root, nil
+	}
+	if m.outputDir != "" {
+		return m.outputDir, nil
+	}
+	return m.downloadDir, nil
+}
 
-	if err := os.MkdirAll(m.outputDir, 0755); err != nil {
+// deliverFiles applies the job's path template and moves its files into
+// the target root. Collisions with existing files are recorded on the job.
+func (m *DownloadManager) deliverFiles(job *Job, jobDir string) error {
+	job.mu.Lock()
+	opts := job.Options
+	job.mu.Unlock()
+
+	root, err := m.targetRoot(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Template != "" {
+		if err := applyTemplate(jobDir, opts.Template); err != nil {
+			return fmt.Errorf("apply template: %v", err)
+		}
+	}
+
+	mv := &fileMover{policy: m.collisionPolicy, root: root}
+	if root == m.downloadDir {
+		err = flattenJobDir(jobDir, m.downloadDir, mv)
+	} else {
+		err = m.moveNewFiles(job, jobDir, root, mv)
+	}
+
+	job.recordFiles(mv.produced)
+	if m.library != nil {
+		m.library.Refresh()
+	}
+	job.mu.Lock()
+	job.Conflicts = append(job.Conflicts, mv.conflicts...)
+	job.mu.Unlock()
+	for _, c := range mv.conflicts {
+		job.addWarning(c.String())
+	}
+
+	return err
+}
+
+// moveNewFiles moves completed files from a job's directory to root.
+// Uses a staging directory for atomicity so media servers never see partial files.
+func (m *DownloadManager) moveNewFiles(job *Job, jobDir, root string, mv *fileMover) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
 		return fmt.Errorf("create output dir: %v", err)
 	}
 
@@ -660,8 +1035,8 @@ func (m *DownloadManager) moveNewFiles(job *Job, jobDir string) error {
 		return nil
 	}
 
-	// Stage inside outputDir so final rename is same-filesystem and atomic
-	stagingDir := filepath.Join(m.outputDir, fmt.Sprintf(".moving-%s", job.ID))
+	// Stage inside root so final rename is same-filesystem and atomic
+	stagingDir := filepath.Join(root, fmt.Sprintf(".moving-%s", job.ID))
 	if err := os.MkdirAll(stagingDir, 0755); err != nil {
 		return fmt.Errorf("create staging dir: %v", err)
 	}
@@ -685,11 +1060,16 @@ func (m *DownloadManager) moveNewFiles(job *Job, jobDir string) error {
 	if err != nil {
 		return fmt.Errorf("read staging dir: %v", err)
 	}
+	var pairs [][2]string
 	for _, entry := range entries {
-		src := filepath.Join(stagingDir, entry.Name())
-		dst := filepath.Join(m.outputDir, entry.Name())
-		if err := mergeMove(src, dst); err != nil {
-			return fmt.Errorf("move %s to output: %v", entry.Name(), err)
+		pairs = append(pairs, [2]string{filepath.Join(stagingDir, entry.Name()), filepath.Join(root, entry.Name())})
+	}
+	if err := mv.checkFail(pairs); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := mv.move(p[0], p[1]); err != nil {
+			return fmt.Errorf("move %s to output: %v", filepath.Base(p[0]), err)
 		}
 	}
 
@@ -734,50 +1114,26 @@ func collectFiles(dir string) ([]string, error) {
 }
 
 // flattenJobDir moves top-level entries from jobDir to parentDir and removes jobDir.
-func flattenJobDir(jobDir, parentDir string) error {
+func flattenJobDir(jobDir, parentDir string, mv *fileMover) error {
 	entries, err := os.ReadDir(jobDir)
 	if err != nil {
 		return err
 	}
+	var pairs [][2]string
 	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), ".") {
-			continue
-		}
-		src := filepath.Join(jobDir, entry.Name())
-		dst := filepath.Join(parentDir, entry.Name())
-		if err := mergeMove(src, dst); err != nil {
-			return fmt.Errorf("move %s: %v", entry.Name(), err)
+		if !strings.HasPrefix(entry.Name(), ".") {
+			pairs = append(pairs, [2]string{filepath.Join(jobDir, entry.Name()), filepath.Join(parentDir, entry.Name())})
 		}
 	}
-	return os.RemoveAll(jobDir)
-}
-
-// mergeMove moves src to dst, recursively merging if both are directories.
-// For files or new directories, it replaces the destination.
-func mergeMove(src, dst string) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
+	if err := mv.checkFail(pairs); err != nil {
 		return err
 	}
-	dstInfo, dstErr := os.Stat(dst)
-	if srcInfo.IsDir() && dstErr == nil && dstInfo.IsDir() {
-		// Both are directories — merge children individually
-		entries, err := os.ReadDir(src)
-		if err != nil {
-			return err
+	for _, p := range pairs {
+		if err := mv.move(p[0], p[1]); err != nil {
+			return fmt.Errorf("move %s: %v", filepath.Base(p[0]), err)
 		}
-		for _, entry := range entries {
-			if err := mergeMove(
-				filepath.Join(src, entry.Name()),
-				filepath.Join(dst, entry.Name()),
-			); err != nil {
-				return err
-			}
-		}
-		return os.Remove(src)
 	}
-	os.RemoveAll(dst)
-	return os.Rename(src, dst)
+	return os.RemoveAll(jobDir)
 }
 
 // copyFile copies a single file from src to dst, preserving permissions.
@@ -808,6 +1164,9 @@ func copyFile(src, dst string) error {
 // Shutdown waits for all running downloads to finish and saves final state.
 func (m *DownloadManager) Shutdown() {
 	m.shutdownWg.Wait()
+	if m.notifier != nil {
+		m.notifier.Flush()
+	}
 	m.saveMu.Lock()
 	if m.saveDebounce != nil {
 		m.saveDebounce.Stop()
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQueueRespectsMaxConcurrent(t *testing.T) {
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{"a.mkv": "a"}, Hold: hold})
+	m, _ := newTestManager(t, ManagerConfig{MaxConcurrent: 1}, fake)
+
+	a, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	b, _ := m.StartDownload("https://example.com/b", DefaultOptions(), "")
+	waitStatus(t, a, StatusRunning)
+	if got := jobStatus(b); got != StatusQueued {
+		t.Fatalf("second job is %s, want queued", got)
+	}
+
+	close(hold)
+	waitStatus(t, a, StatusCompleted)
+	waitStatus(t, b, StatusCompleted)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.running != 0 || len(m.queue) != 0 {
+		t.Errorf("running=%d queue=%v after all jobs finished", m.running, m.queue)
+	}
+}
+
+func TestDuplicateURLRejected(t *testing.T) {
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	defer close(hold)
+	fake.script("https://example.com/a", fakeAttempt{Hold: hold})
+	m, _ := newTestManager(t, ManagerConfig{}, fake)
+
+	if _, err := m.StartDownload("https://example.com/a", DefaultOptions(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.StartDownload("https://example.com/a", DefaultOptions(), "alice"); err == nil {
+		t.Error("second submission of an active URL succeeded")
+	}
+	if r := m.StartBulkDownload([]string{"https://example.com/a"}, DefaultOptions(), "alice"); !r[0].IsDup {
+		t.Error("bulk submission of an active URL not reported as duplicate")
+	}
+
+	// Another user's jobs are neither visible nor duplicates
+	if _, err := m.StartDownload("https://example.com/a", DefaultOptions(), "bob"); err != nil {
+		t.Errorf("bob blocked by alice's job: %v", err)
+	}
+	if r := m.StartBulkDownload([]string{"https://example.com/a"}, DefaultOptions(), "carol"); r[0].IsDup {
+		t.Error("carol's bulk submission reported as duplicate of another user's job")
+	}
+}
+
+func TestRetryThenSucceed(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a",
+		fakeAttempt{Lines: []string{"ERROR: network"}, Exit: 1},
+		fakeAttempt{Files: map[string]string{"a.mkv": "a"}},
+	)
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 3}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+
+	if n := fake.Calls("https://example.com/a"); n != 2 {
+		t.Errorf("executor ran %d times, want 2", n)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.RetryCount != 1 {
+		t.Errorf("RetryCount = %d, want 1", job.RetryCount)
+	}
+	if job.Progress != 100 {
+		t.Errorf("Progress = %v, want 100", job.Progress)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{"a.mkv.part": "x"}, Exit: 1})
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 2}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusFailed)
+
+	if n := fake.Calls("https://example.com/a"); n != 2 {
+		t.Errorf("executor ran %d times, want 2", n)
+	}
+	job.mu.Lock()
+	errMsg, kind := job.Error, job.ErrorKind
+	job.mu.Unlock()
+	if errMsg != "exit status 1" || kind != ErrorKindDownload {
+		t.Errorf("error = %q (%s), want exit status 1 (download)", errMsg, kind)
+	}
+	if _, err := os.Stat(filepath.Join(m.downloadDir, job.ID)); !os.IsNotExist(err) {
+		t.Error("job dir left behind after final failure")
+	}
+}
+
+func TestNoFilesProducedFails(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Lines: []string{"ERROR: geo restricted"}})
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusFailed)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if !strings.Contains(job.Error, "produced no files") {
+		t.Errorf("error = %q", job.Error)
+	}
+}
+
+func TestManualRetry(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a",
+		fakeAttempt{Exit: 1},
+		fakeAttempt{Files: map[string]string{"a.mkv": "a"}},
+	)
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusFailed)
+
+	if _, err := m.RetryJob(job.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, job, StatusCompleted)
+	if _, err := m.RetryJob(job.ID, false); err == nil {
+		t.Error("retrying a completed job succeeded")
+	}
+}
+
+func TestProgressAndOutput(t *testing.T) {
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	fake.script("https://example.com/a", fakeAttempt{
+		Lines: []string{"[youtube] a: Downloading webpage", "[download]  42.5% of 10.00MiB"},
+		Files: map[string]string{"a.mkv": "a"},
+		Hold:  hold,
+	})
+	m, _ := newTestManager(t, ManagerConfig{}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitFor(t, "progress", func() bool {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		return job.Progress == 42.5
+	})
+	close(hold)
+	waitStatus(t, job, StatusCompleted)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.Output) < 2 || job.Output[0] != "[youtube] a: Downloading webpage" {
+		t.Errorf("output = %q", job.Output)
+	}
+}
+
+func TestDeleteRunningJobStartsNext(t *testing.T) {
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	defer close(hold)
+	fake.script("https://example.com/a", fakeAttempt{Hold: hold})
+	m, _ := newTestManager(t, ManagerConfig{MaxConcurrent: 1}, fake)
+
+	a, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	b, _ := m.StartDownload("https://example.com/b", DefaultOptions(), "")
+	waitStatus(t, a, StatusRunning)
+
+	if err := m.DeleteJob(a.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, b, StatusCompleted)
+	if _, ok := m.GetJob(a.ID); ok {
+		t.Error("deleted job still listed")
+	}
+}
+
+func TestDeleteJobKeepsSharedFiles(t *testing.T) {
+	downloadDir := t.TempDir()
+	m, _ := newTestManager(t, ManagerConfig{DownloadDir: downloadDir}, newFakeExecutor())
+
+	shared := filepath.Join(downloadDir, "shared", "video.mkv")
+	own := filepath.Join(downloadDir, "own", "video.nfo")
+	for _, p := range []string{shared, own} {
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, []byte("x"), 0o644)
+	}
+	a, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	b, _ := m.StartDownload("https://example.com/b", DefaultOptions(), "")
+	waitStatus(t, a, StatusCompleted)
+	waitStatus(t, b, StatusCompleted)
+	a.mu.Lock()
+	a.Files = []ProducedFile{{Path: shared}, {Path: own}}
+	a.mu.Unlock()
+	b.mu.Lock()
+	b.Files = []ProducedFile{{Path: shared}}
+	b.mu.Unlock()
+
+	if err := m.DeleteJob(a.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(own); !os.IsNotExist(err) {
+		t.Error("file only the deleted job listed was kept")
+	}
+	if _, err := os.Stat(shared); err != nil {
+		t.Errorf("file another job lists was removed: %v", err)
+	}
+}
+
+func TestShutdownRequeuesActiveJobs(t *testing.T) {
+	dataDir := t.TempDir()
+	downloadDir := t.TempDir()
+	cfg := ManagerConfig{DataDir: dataDir, DownloadDir: downloadDir, MaxConcurrent: 1}
+
+	fake := newFakeExecutor()
+	hold := make(chan struct{})
+	defer close(hold)
+	fake.script("https://example.com/a", fakeAttempt{Hold: hold})
+	fake.script("https://example.com/b", fakeAttempt{Hold: hold})
+	m, stop := newTestManager(t, cfg, fake)
+
+	done, _ := m.StartDownload("https://example.com/done", DefaultOptions(), "")
+	waitStatus(t, done, StatusCompleted)
+	a, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	b, _ := m.StartDownload("https://example.com/b", DefaultOptions(), "")
+	waitStatus(t, a, StatusRunning)
+	stop()
+
+	restarted, _ := newTestManager(t, cfg, newFakeExecutor())
+	for _, id := range []string{a.ID, b.ID} {
+		job, ok := restarted.GetJob(id)
+		if !ok {
+			t.Fatalf("job %s not restored", id)
+		}
+		waitStatus(t, job, StatusCompleted)
+	}
+	if job, ok := restarted.GetJob(done.ID); !ok || jobStatus(job) != StatusCompleted {
+		t.Error("completed job not restored as completed")
+	}
+
+	next, _ := restarted.StartDownload("https://example.com/c", DefaultOptions(), "")
+	if next.ID != "4" {
+		t.Errorf("new job got id %s, want 4", next.ID)
+	}
+}
+
+func TestMoveToOutputDir(t *testing.T) {
+	outputDir := t.TempDir()
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{
+		"Channel/Video.mkv": "video",
+		"Channel/Video.nfo": "<episodedetails/>",
+		".hidden":           "x",
+	}})
+	m, _ := newTestManager(t, ManagerConfig{OutputDir: outputDir}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+
+	for _, rel := range []string{"Channel/Video.mkv", "Channel/Video.nfo"} {
+		if _, err := os.Stat(filepath.Join(outputDir, rel)); err != nil {
+			t.Errorf("%s not moved: %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, ".hidden")); !os.IsNotExist(err) {
+		t.Error("hidden file moved to the output dir")
+	}
+	if _, err := os.Stat(filepath.Join(m.downloadDir, job.ID)); !os.IsNotExist(err) {
+		t.Error("job dir not removed after move")
+	}
+	entries, _ := os.ReadDir(outputDir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".moving-") {
+			t.Errorf("staging dir %s left behind", e.Name())
+		}
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.Files) != 2 {
+		t.Errorf("recorded %d files, want 2", len(job.Files))
+	}
+}
+
+func TestFlattenIntoDownloadDir(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{"Channel/Video.mkv": "video"}})
+	m, _ := newTestManager(t, ManagerConfig{}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+
+	if _, err := os.Stat(filepath.Join(m.downloadDir, "Channel", "Video.mkv")); err != nil {
+		t.Errorf("file not flattened into the download dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.downloadDir, job.ID)); !os.IsNotExist(err) {
+		t.Error("job dir not removed")
+	}
+}
+
+func TestNFOValidation(t *testing.T) {
+	const validNFO = `<episodedetails><title>Video</title><plot>About</plot><aired>2024-03-01</aired><uniqueid type="youtube">abc</uniqueid></episodedetails>`
+	tests := []struct {
+		name       string
+		nfo        string // empty for a video without an NFO
+		validation string
+		repair     bool
+		want       JobStatus
+		problem    string // expected in the job's warnings, empty for none
+	}{
+		{"valid strict", validNFO, NFOValidationStrict, false, StatusCompleted, ""},
+		{"missing warn", "", NFOValidationWarn, false, StatusCompleted, "Video.mkv: missing NFO"},
+		{"missing strict", "", NFOValidationStrict, false, StatusFailed, "Video.mkv: missing NFO"},
+		{"missing repaired", "", NFOValidationStrict, true, StatusCompleted, "Video.mkv: missing NFO (repaired)"},
+		{"malformed warn", "<episodedetails><title>", NFOValidationWarn, false, StatusCompleted, "Video.nfo: malformed XML"},
+		{"malformed strict", "<episodedetails><title>", NFOValidationStrict, false, StatusFailed, "Video.nfo: malformed XML"},
+		{"malformed not repaired", "<episodedetails><title>", NFOValidationStrict, true, StatusFailed, "Video.nfo: malformed XML"},
+		{"missing fields", "<episodedetails/>", NFOValidationWarn, false, StatusCompleted, "Video.nfo: missing title"},
+		{"off", "<episodedetails><title>", NFOValidationOff, false, StatusCompleted, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"Video.mkv": "video", "Video.jpg": "thumb"}
+			if tt.nfo != "" {
+				files["Video.nfo"] = tt.nfo
+			}
+			fake := newFakeExecutor()
+			fake.script("https://example.com/a", fakeAttempt{Files: files})
+			m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1, NFOValidation: tt.validation, NFORepair: tt.repair}, fake)
+
+			job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+			waitStatus(t, job, tt.want)
+
+			job.mu.Lock()
+			defer job.mu.Unlock()
+			warnings := strings.Join(job.Warnings, "\n")
+			if tt.problem == "" && warnings != "" {
+				t.Errorf("unexpected warnings:\n%s", warnings)
+			}
+			if tt.problem != "" && !strings.Contains(warnings, tt.problem) {
+				t.Errorf("warnings missing %q:\n%s", tt.problem, warnings)
+			}
+			if tt.want == StatusFailed && !strings.Contains(job.Error, "NFO validation failed") {
+				t.Errorf("error = %q", job.Error)
+			}
+			if tt.repair && tt.want == StatusCompleted {
+				if _, err := readNFO(filepath.Join(m.downloadDir, "Video.nfo")); err != nil {
+					t.Errorf("repaired NFO not delivered: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// ExecSpec describes a single download attempt.
+type ExecSpec struct {
+	URL  string
+	Args []string // extra arguments passed after the URL
+	Dir  string   // job directory, the working directory of the attempt
+	Env  []string // variables added on top of the server's environment
+}
+
+// Executor runs download attempts. Run writes the combined output to out
+// and blocks until the attempt has finished; cancelling ctx must stop it.
+type Executor interface {
+	Run(ctx context.Context, spec ExecSpec, out io.Writer) error
+}
+
+// commandExecutor runs ytdlp-nfo as a subprocess.
+type commandExecutor struct {
+	Path string
+}
+
+func (e commandExecutor) Run(ctx context.Context, spec ExecSpec, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, e.Path, append([]string{spec.URL}, spec.Args...)...)
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	// A non-file writer makes exec copy output in a goroutine, and
+	// WaitDelay bounds that copy when a killed process leaves children
+	// holding the pipe open.
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = 10 * time.Second
+	return cmd.Run()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAttempt scripts one run of the fake executor.
+type fakeAttempt struct {
+	Lines []string          // output lines, written in order
+	Files map[string]string // relative path -> content, created in the job dir
+	Exit  int               // non-zero fails the attempt with this exit code
+	Hold  chan struct{}     // if set, block until closed or cancelled
+}
+
+// fakeExecutor plays back scripted attempts per URL. Once a URL's script
+// is exhausted its last attempt repeats; URLs without a script succeed
+// with a single video.
+type fakeExecutor struct {
+	mu      sync.Mutex
+	scripts map[string][]fakeAttempt
+	calls   map[string]int
+	specs   []ExecSpec
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{scripts: make(map[string][]fakeAttempt), calls: make(map[string]int)}
+}
+
+func (f *fakeExecutor) script(url string, attempts ...fakeAttempt) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts[url] = attempts
+}
+
+func (f *fakeExecutor) Calls(url string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[url]
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, spec ExecSpec, out io.Writer) error {
+	f.mu.Lock()
+	n := f.calls[spec.URL]
+	f.calls[spec.URL]++
+	f.specs = append(f.specs, spec)
+	attempt := fakeAttempt{Files: map[string]string{"video.mkv": "video"}}
+	if script := f.scripts[spec.URL]; len(script) > 0 {
+		attempt = script[min(n, len(script)-1)]
+	}
+	f.mu.Unlock()
+
+	for _, line := range attempt.Lines {
+		fmt.Fprintln(out, line)
+	}
+	for rel, content := range attempt.Files {
+		path := filepath.Join(spec.Dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if attempt.Hold != nil {
+		select {
+		case <-attempt.Hold:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if attempt.Exit != 0 {
+		return fmt.Errorf("exit status %d", attempt.Exit)
+	}
+	return nil
+}
+
+// newTestManager starts a manager backed by fake with test-friendly
+// defaults. It is shut down when the test ends unless stop is called first.
+func newTestManager(t *testing.T, cfg ManagerConfig, fake *fakeExecutor) (m *DownloadManager, stop func()) {
+	t.Helper()
+	if cfg.DownloadDir == "" {
+		cfg.DownloadDir = t.TempDir()
+	}
+	if cfg.MaxConcurrent == 0 {
+		cfg.MaxConcurrent = 1
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.NFOValidation == "" {
+		cfg.NFOValidation = NFOValidationOff
+	}
+	cfg.RetryBackoff = 10 * time.Millisecond
+	cfg.Executor = fake
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m = NewDownloadManager(ctx, cfg)
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			m.Shutdown()
+		})
+	}
+	t.Cleanup(stop)
+	return m, stop
+}
+
+func jobStatus(j *Job) JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitStatus(t *testing.T, j *Job, want JobStatus) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("job %s to be %s", j.ID, want), func() bool {
+		return jobStatus(j) == want
+	})
+}
+
+func TestFakeExecutorPassesOptions(t *testing.T) {
+	fake := newFakeExecutor()
+	m, _ := newTestManager(t, ManagerConfig{}, fake)
+
+	job, err := m.StartDownload("https://example.com/a", DownloadOptions{Format: "mp4", Subtitles: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, job, StatusCompleted)
+
+	fake.mu.Lock()
+	spec := fake.specs[0]
+	fake.mu.Unlock()
+	env := strings.Join(spec.Env, " ")
+	for _, want := range []string{"YTDLP_NFO_FORMAT=mp4", "YTDLP_NFO_ALL_AUDIO=false", "YTDLP_NFO_SUBTITLES=true"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("env %q missing %s", env, want)
+		}
+	}
+	if spec.Dir != filepath.Join(m.downloadDir, job.ID) {
+		t.Errorf("ran in %s, want the job dir", spec.Dir)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Extra is a named, server-defined set of additional downloader arguments
+// and environment variables. Requests and presets can only select extras
+// by name, so API users never pass raw flags.
+type Extra struct {
+	Name    string            `json:"name"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Default bool              `json:"default,omitempty"` // applied to every job
+}
+
+// loadExtras reads the extras file at path. A missing file is not an error.
+func loadExtras(path string) ([]Extra, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var extras []Extra
+	if err := json.Unmarshal(data, &extras); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range extras {
+		if e.Name == "" {
+			return nil, fmt.Errorf("extra without a name")
+		}
+		if seen[e.Name] {
+			return nil, fmt.Errorf("duplicate extra %q", e.Name)
+		}
+		seen[e.Name] = true
+		for k := range e.Env {
+			if k == "" || strings.ContainsAny(k, "= ") {
+				return nil, fmt.Errorf("extra %q: invalid env name %q", e.Name, k)
+			}
+		}
+	}
+	return extras, nil
+}
+
+// extraNames returns the names of the extras that can be selected per job.
+func extraNames(extras []Extra) []string {
+	names := []string{}
+	for _, e := range extras {
+		if !e.Default {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// validateExtras checks that every name refers to a configured extra.
+func validateExtras(names []string, extras []Extra) error {
+	for _, name := range names {
+		found := false
+		for _, e := range extras {
+			if e.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown extra %q", name)
+		}
+	}
+	return nil
+}
+
+// extraArgs returns the arguments and environment of the default extras
+// followed by the selected ones, in configuration order.
+func (m *DownloadManager) extraArgs(selected []string) ([]string, []string) {
+	want := make(map[string]bool, len(selected))
+	for _, name := range selected {
+		want[name] = true
+	}
+	var args, env []string
+	for _, e := range m.extras {
+		if !e.Default && !want[e.Name] {
+			continue
+		}
+		args = append(args, e.Args...)
+		keys := make([]string, 0, len(e.Env))
+		for k := range e.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			env = append(env, k+"="+e.Env[k])
+		}
+	}
+	return args, env
+}
+
+// extraInfo describes an extra without revealing its environment values,
+// which may hold credentials.
+type extraInfo struct {
+	Name    string   `json:"name"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Default bool     `json:"default,omitempty"`
+}
+
+// describeExtras lists the extras. Arguments such as --password can be
+// secret too, so they and the environment names are only included when
+// full is set.
+func describeExtras(extras []Extra, full bool) []extraInfo {
+	infos := []extraInfo{}
+	for _, e := range extras {
+		info := extraInfo{Name: e.Name, Default: e.Default}
+		if !full {
+			infos = append(infos, info)
+			continue
+		}
+		info.Args = e.Args
+		for k := range e.Env {
+			info.Env = append(info.Env, k)
+		}
+		sort.Strings(info.Env)
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtrasOnlyFromAllowlist(t *testing.T) {
+	fake := newFakeExecutor()
+	m, _ := newTestManager(t, ManagerConfig{
+		Extras: []Extra{
+			{Name: "retries", Args: []string{"--retries", "20"}, Default: true},
+			{Name: "sponsorblock", Args: []string{"--sponsorblock-remove", "all"}},
+			{Name: "proxy", Env: map[string]string{"HTTPS_PROXY": "http://proxy:3128"}},
+		},
+	}, fake)
+
+	if _, err := parseOptions(m, optionsRequest{Extras: []string{"--exec"}}); err == nil {
+		t.Error("unknown extra accepted")
+	}
+	if _, err := m.StartDownload("--exec=rm -rf /", DefaultOptions(), ""); err == nil {
+		t.Error("URL starting with a dash accepted")
+	}
+
+	opts, err := parseOptions(m, optionsRequest{Extras: []string{"sponsorblock", "proxy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := m.StartDownload("https://example.com/a", opts, "")
+	waitStatus(t, job, StatusCompleted)
+
+	fake.mu.Lock()
+	spec := fake.specs[0]
+	fake.mu.Unlock()
+	if want := []string{"--retries", "20", "--sponsorblock-remove", "all"}; !reflect.DeepEqual(spec.Args, want) {
+		t.Errorf("args = %q, want %q", spec.Args, want)
+	}
+	if last := spec.Env[len(spec.Env)-1]; last != "HTTPS_PROXY=http://proxy:3128" {
+		t.Errorf("extra env not passed, last entry %q", last)
+	}
+}
+
+func TestDescribeExtrasHidesEnvValues(t *testing.T) {
+	extras := []Extra{{Name: "cookies", Args: []string{"--video-password", "hunter2"}, Env: map[string]string{"TOKEN": "secret"}}}
+	infos := describeExtras(extras, true)
+	if len(infos) != 1 || !reflect.DeepEqual(infos[0].Env, []string{"TOKEN"}) || len(infos[0].Args) != 2 {
+		t.Errorf("describeExtras for admins = %+v", infos)
+	}
+	infos = describeExtras(extras, false)
+	if len(infos) != 1 || infos[0].Name != "cookies" || infos[0].Args != nil || infos[0].Env != nil {
+		t.Errorf("describeExtras for members = %+v", infos)
+	}
+}
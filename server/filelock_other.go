@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without flock; writes from this process
+// are still serialized by archiveMu.
+func lockFile(f *os.File, exclusive bool) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
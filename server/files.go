@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Media types assigned to produced files.
+const (
+	MediaVideo     = "video"
+	MediaNFO       = "nfo"
+	MediaThumbnail = "thumbnail"
+	MediaSubtitle  = "subtitle"
+	MediaOther     = "other"
+)
+
+var videoExts = map[string]bool{
+	".mkv": true, ".mp4": true, ".webm": true, ".mov": true,
+	".m4v": true, ".avi": true, ".flv": true,
+}
+
+var subtitleExts = map[string]bool{
+	".srt": true, ".vtt": true, ".ass": true, ".ssa": true, ".lrc": true,
+}
+
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".webp": true,
+}
+
+// mediaType classifies a file by its extension.
+func mediaType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case videoExts[ext]:
+		return MediaVideo
+	case ext == ".nfo":
+		return MediaNFO
+	case imageExts[ext]:
+		return MediaThumbnail
+	case subtitleExts[ext]:
+		return MediaSubtitle
+	}
+	return MediaOther
+}
+
+func isVideoFile(path string) bool {
+	return mediaType(path) == MediaVideo
+}
+
+// ProducedFile is a file a job delivered into the library.
+type ProducedFile struct {
+	Path string `json:"path"` // absolute final path
+	Size int64  `json:"size"`
+	Type string `json:"type"`
+}
+
+// recordFiles stats the given final paths and adds them to the job's
+// manifest, replacing earlier entries for the same path.
+func (j *Job) recordFiles(paths []string) {
+	files := make([]ProducedFile, 0, len(paths))
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, ProducedFile{Path: p, Size: info.Size(), Type: mediaType(p)})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, f := range files {
+		replaced := false
+		for i := range j.Files {
+			if j.Files[i].Path == f.Path {
+				j.Files[i] = f
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			j.Files = append(j.Files, f)
+		}
+	}
+}
+
+// libraryRoots returns every directory the manager may deliver files into.
+func (m *DownloadManager) libraryRoots() []string {
+	roots := []string{m.downloadDir}
+	if m.outputDir != "" {
+		roots = append(roots, m.outputDir)
+	}
+	for _, name := range destinationNames(m.destinations) {
+		roots = append(roots, m.destinations[name])
+	}
+	return roots
+}
+
+// rootFor returns the library root containing path, if any.
+func (m *DownloadManager) rootFor(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for _, root := range m.libraryRoots() {
+		if r, err := filepath.Abs(root); err == nil && withinRoot(r, abs) && abs != r {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// openLibraryFile opens path for reading after checking that it, and
+// whatever it links to, lies inside a library root.
+func (m *DownloadManager) openLibraryFile(path string) (*os.File, error) {
+	if _, ok := m.rootFor(path); !ok {
+		return nil, fmt.Errorf("file is outside the library roots")
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range m.libraryRoots() {
+		if r, err := filepath.EvalSymlinks(root); err == nil && withinRoot(r, resolved) {
+			return os.Open(resolved)
+		}
+	}
+	return nil, fmt.Errorf("file is outside the library roots")
+}
+
+// mediaContentTypes covers extensions missing from the mime package defaults.
+var mediaContentTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".m4v":  "video/mp4",
+	".vtt":  "text/vtt",
+	".srt":  "application/x-subrip",
+	".nfo":  "text/xml; charset=utf-8",
+}
+
+// trackedPaths returns the set of file paths listed in any job's manifest.
+// Must be called with m.mu held.
+func (m *DownloadManager) trackedPaths() map[string]bool {
+	paths := make(map[string]bool)
+	for _, j := range m.jobs {
+		j.mu.Lock()
+		for _, f := range j.Files {
+			paths[f.Path] = true
+		}
+		j.mu.Unlock()
+	}
+	return paths
+}
+
+// removeProducedFiles deletes the job's produced files from the library,
+// along with directories left empty by the removal. Files outside the
+// configured roots are never touched.
+func (m *DownloadManager) removeProducedFiles(files []ProducedFile) []error {
+	var errs []error
+	for _, f := range files {
+		root, ok := m.rootFor(f.Path)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s is outside the library roots", f.Path))
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		for dir := filepath.Dir(f.Path); dir != root && withinRoot(root, dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return errs
+}
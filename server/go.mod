@@ -1,3 +1,5 @@
 module github.com/LNA-DEV/ytdlp-nfo-server
 
 go 1.24.7
+
+require golang.org/x/crypto v0.36.0
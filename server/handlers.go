@@ -2,49 +2,130 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// optionsRequest holds the per-request option fields shared by single and
+// bulk submissions. Explicit fields override the selected preset.
+type optionsRequest struct {
+	Format      string `json:"format"`
+	AllAudio    *bool  `json:"allAudio"`
+	Subtitles   *bool  `json:"subtitles"`
+	Preset      string `json:"preset"`
+	Destination string `json:"destination"`
+	Template    string `json:"template"`
+	// BypassArchive ignores the download archive for this job.
+	BypassArchive bool `json:"bypassArchive"`
+	// Extras selects configured extras by name, replacing the preset's.
+	Extras        []string `json:"extras"`
+	CookieProfile string   `json:"cookieProfile"`
+	Proxy         string   `json:"proxy"`
+}
+
 type downloadRequest struct {
-	URL       string `json:"url"`
-	Format    string `json:"format"`
-	AllAudio  *bool  `json:"allAudio"`
-	Subtitles *bool  `json:"subtitles"`
+	URL string `json:"url"`
+	optionsRequest
 }
 
 type jobSummary struct {
 	ID         string          `json:"id"`
 	URL        string          `json:"url"`
+	Owner      string          `json:"owner,omitempty"`
 	Status     JobStatus       `json:"status"`
 	CreatedAt  string          `json:"createdAt"`
 	DoneAt     string          `json:"doneAt,omitempty"`
 	Error      string          `json:"error,omitempty"`
+	ErrorKind  string          `json:"errorKind,omitempty"`
 	Progress   float64         `json:"progress"`
 	RetryCount int             `json:"retryCount"`
 	MaxRetries int             `json:"maxRetries"`
 	Options    DownloadOptions `json:"options"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	FileCount  int             `json:"fileCount,omitempty"`
 }
 
-func parseOptions(format string, allAudio *bool, subtitles *bool) DownloadOptions {
+func parseOptions(mgr *DownloadManager, req optionsRequest) (DownloadOptions, error) {
 	opts := DefaultOptions()
-	if format == "mp4" {
-		opts.Format = "mp4"
+	if req.Preset != "" {
+		p, ok := mgr.findPreset(req.Preset)
+		if !ok {
+			return opts, fmt.Errorf("unknown preset %q", req.Preset)
+		}
+		opts.Preset = p.Name
+		if p.Format != "" {
+			opts.Format = p.Format
+		}
+		if p.AllAudio != nil {
+			opts.AllAudio = *p.AllAudio
+		}
+		if p.Subtitles != nil {
+			opts.Subtitles = *p.Subtitles
+		}
+		opts.Destination = p.Destination
+		opts.Template = p.Template
+		opts.Extras = p.Extras
+		opts.Proxy = p.Proxy
+	}
+
+	if req.Format == "mp4" || req.Format == "mkv" {
+		opts.Format = req.Format
+	}
+	if req.AllAudio != nil {
+		opts.AllAudio = *req.AllAudio
+	}
+	if req.Subtitles != nil {
+		opts.Subtitles = *req.Subtitles
+	}
+	if req.Destination != "" {
+		if _, ok := mgr.destinations[req.Destination]; !ok {
+			return opts, fmt.Errorf("unknown destination %q", req.Destination)
+		}
+		opts.Destination = req.Destination
+	}
+	if req.Template = strings.TrimSpace(req.Template); req.Template != "" {
+		if err := validateTemplate(req.Template); err != nil {
+			return opts, err
+		}
+		opts.Template = req.Template
 	}
-	if allAudio != nil {
-		opts.AllAudio = *allAudio
+	if req.Extras != nil {
+		if err := validateExtras(req.Extras, mgr.extras); err != nil {
+			return opts, err
+		}
+		opts.Extras = req.Extras
+	}
+	if req.CookieProfile != "" {
+		if req.CookieProfile != CookieNone && !mgr.cookies.Has(req.CookieProfile) {
+			return opts, fmt.Errorf("unknown cookie profile %q", req.CookieProfile)
+		}
+		opts.CookieProfile = req.CookieProfile
 	}
-	if subtitles != nil {
-		opts.Subtitles = *subtitles
+	if req.Proxy != "" {
+		if err := validateProxy(req.Proxy, mgr.proxies.proxies); err != nil {
+			return opts, err
+		}
+		opts.Proxy = req.Proxy
 	}
-	return opts
+	opts.BypassArchive = req.BypassArchive
+	return opts, nil
 }
 
 type jobDetail struct {
 	jobSummary
-	Output []string `json:"output"`
+	Output         []string       `json:"output"`
+	Conflicts      []FileConflict `json:"conflicts,omitempty"`
+	NFOIssues      []NFOIssue     `json:"nfoIssues,omitempty"`
+	Notifications  []NotifyResult `json:"notifications,omitempty"`
+	ArchiveEntries []string       `json:"archiveEntries,omitempty"`
 }
 
 func toSummary(j *Job) jobSummary {
@@ -53,13 +134,17 @@ func toSummary(j *Job) jobSummary {
 	s := jobSummary{
 		ID:         j.ID,
 		URL:        j.URL,
+		Owner:      j.Owner,
 		Status:     j.Status,
 		CreatedAt:  j.CreatedAt.Format("2006-01-02T15:04:05Z"),
 		Error:      j.Error,
+		ErrorKind:  j.ErrorKind,
 		Progress:   j.Progress,
 		RetryCount: j.RetryCount,
 		MaxRetries: j.MaxRetries,
 		Options:    j.Options,
+		Warnings:   append([]string(nil), j.Warnings...),
+		FileCount:  len(j.Files),
 	}
 	if j.DoneAt != nil {
 		s.DoneAt = j.DoneAt.Format("2006-01-02T15:04:05Z")
@@ -73,20 +158,31 @@ func toDetail(j *Job) jobDetail {
 	s := jobSummary{
 		ID:         j.ID,
 		URL:        j.URL,
+		Owner:      j.Owner,
 		Status:     j.Status,
 		CreatedAt:  j.CreatedAt.Format("2006-01-02T15:04:05Z"),
 		Error:      j.Error,
+		ErrorKind:  j.ErrorKind,
 		Progress:   j.Progress,
 		RetryCount: j.RetryCount,
 		MaxRetries: j.MaxRetries,
 		Options:    j.Options,
+		Warnings:   append([]string(nil), j.Warnings...),
+		FileCount:  len(j.Files),
 	}
 	if j.DoneAt != nil {
 		s.DoneAt = j.DoneAt.Format("2006-01-02T15:04:05Z")
 	}
 	output := make([]string, len(j.Output))
 	copy(output, j.Output)
-	return jobDetail{jobSummary: s, Output: output}
+	return jobDetail{
+		jobSummary:     s,
+		Output:         output,
+		Conflicts:      append([]FileConflict(nil), j.Conflicts...),
+		NFOIssues:      append([]NFOIssue(nil), j.NFOIssues...),
+		Notifications:  append([]NotifyResult(nil), j.Notifications...),
+		ArchiveEntries: append([]string(nil), j.ArchiveEntries...),
+	}
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -95,21 +191,36 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	json.NewEncoder(w).Encode(v)
 }
 
-func handleAuth() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]bool{"authenticated": true})
+// visibleJob looks up a job the requesting user may access. Other users'
+// jobs are reported as missing.
+func visibleJob(mgr *DownloadManager, r *http.Request, id string) (*Job, bool) {
+	job, ok := mgr.GetJob(id)
+	if !ok || !principalFrom(r).CanAccess(job) {
+		return nil, false
 	}
+	return job, true
+}
+
+type downloaderConfig struct {
+	Binary string      `json:"binary"`
+	Extras []extraInfo `json:"extras"`
 }
 
-func handleVersion() http.HandlerFunc {
+// handleVersion reports the tool versions printed by the downloader along
+// with the configured binary and extras under "config".
+func handleVersion(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		out, err := exec.Command("ytdlp-nfo", "--version").Output()
+		// Only admins acting with their full rights see extra arguments
+		p := principalFrom(r)
+		full := p.IsAdmin() && (p.Scope == "" || p.Scope == ScopeAdmin)
+		config := downloaderConfig{Binary: mgr.binary, Extras: describeExtras(mgr.extras, full)}
+		out, err := exec.Command(mgr.binary, "--version").Output()
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to get version: " + err.Error()})
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "failed to get version: " + err.Error(), "config": config})
 			return
 		}
 		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-		result := make(map[string]string)
+		result := map[string]any{"config": config}
 		for _, line := range lines {
 			parts := strings.Fields(line)
 			if len(parts) >= 2 {
@@ -120,6 +231,30 @@ func handleVersion() http.HandlerFunc {
 	}
 }
 
+type optionsResponse struct {
+	Presets      []Preset `json:"presets"`
+	Destinations []string `json:"destinations"`
+	Extras       []string `json:"extras"`
+	Cookies      []string `json:"cookies"`
+	Proxies      []string `json:"proxies"`
+}
+
+func handleOptions(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presets := mgr.presets
+		if presets == nil {
+			presets = []Preset{}
+		}
+		writeJSON(w, http.StatusOK, optionsResponse{
+			Presets:      presets,
+			Destinations: destinationNames(mgr.destinations),
+			Extras:       extraNames(mgr.extras),
+			Cookies:      cookieNames(mgr.cookies.List()),
+			Proxies:      proxyNames(mgr.proxies.proxies),
+		})
+	}
+}
+
 func handleSubmit(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req downloadRequest
@@ -133,33 +268,47 @@ func handleSubmit(mgr *DownloadManager) http.HandlerFunc {
 			return
 		}
 
-		opts := parseOptions(req.Format, req.AllAudio, req.Subtitles)
-		job, err := mgr.StartDownload(req.URL, opts)
+		opts, err := parseOptions(mgr, req.optionsRequest)
 		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		auditNote(r, req.URL)
+		if err := mgr.urlPolicy.Check(r.Context(), req.URL); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "URL rejected: " + err.Error()})
+			return
+		}
+		job, err := mgr.StartDownload(req.URL, opts, principalFrom(r).Username)
+		var quota *quotaError
+		if errors.As(err, &quota) {
+			writeTooManyRequests(w, quotaRetryAfter, err.Error())
+			return
+		} else if err != nil {
 			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
 			return
 		}
+		auditJobs(r, job.ID)
 		writeJSON(w, http.StatusCreated, toSummary(job))
 	}
 }
 
 type bulkDownloadRequest struct {
-	URLs      []string `json:"urls"`
-	Format    string   `json:"format"`
-	AllAudio  *bool    `json:"allAudio"`
-	Subtitles *bool    `json:"subtitles"`
+	URLs []string `json:"urls"`
+	optionsRequest
 }
 
 type bulkResultItem struct {
-	URL    string     `json:"url"`
-	Status string     `json:"status"`
+	URL    string      `json:"url"`
+	Status string      `json:"status"` // created, duplicate, rejected or error
 	Job    *jobSummary `json:"job,omitempty"`
-	Error  string     `json:"error,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Reason string      `json:"reason,omitempty"` // why a URL was rejected
 }
 
 type bulkDownloadResponse struct {
 	Created    int              `json:"created"`
 	Duplicates int              `json:"duplicates"`
+	Rejected   int              `json:"rejected"`
 	Errors     int              `json:"errors"`
 	Results    []bulkResultItem `json:"results"`
 }
@@ -176,13 +325,38 @@ func handleBulkSubmit(mgr *DownloadManager) http.HandlerFunc {
 			return
 		}
 
-		opts := parseOptions(req.Format, req.AllAudio, req.Subtitles)
-		bulkResults := mgr.StartBulkDownload(req.URLs, opts)
+		opts, err := parseOptions(mgr, req.optionsRequest)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		var urls []string
+		for _, u := range req.URLs {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		rejections := mgr.urlPolicy.CheckAll(r.Context(), urls)
+		var accepted []string
+		for i, u := range urls {
+			if rejections[i] == nil {
+				accepted = append(accepted, u)
+			}
+		}
+		bulkResults := mgr.StartBulkDownload(accepted, opts, principalFrom(r).Username)
 
 		resp := bulkDownloadResponse{
-			Results: make([]bulkResultItem, 0, len(bulkResults)),
+			Results: make([]bulkResultItem, 0, len(urls)),
 		}
-		for _, br := range bulkResults {
+		overQuota := false
+		for i, u := range urls {
+			if rejections[i] != nil {
+				resp.Rejected++
+				resp.Results = append(resp.Results, bulkResultItem{URL: u, Status: "rejected", Reason: rejections[i].Error()})
+				continue
+			}
+			br := bulkResults[0]
+			bulkResults = bulkResults[1:]
 			item := bulkResultItem{URL: br.URL}
 			if br.IsDup {
 				item.Status = "duplicate"
@@ -191,22 +365,30 @@ func handleBulkSubmit(mgr *DownloadManager) http.HandlerFunc {
 				item.Status = "error"
 				item.Error = br.Error
 				resp.Errors++
+				overQuota = overQuota || br.QuotaExceeded
 			} else {
 				item.Status = "created"
 				s := toSummary(br.Job)
 				item.Job = &s
 				resp.Created++
+				auditJobs(r, br.Job.ID)
 			}
 			resp.Results = append(resp.Results, item)
 		}
 
+		auditNote(r, fmt.Sprintf("%d urls: %d created, %d duplicates, %d rejected, %d errors", len(urls), resp.Created, resp.Duplicates, resp.Rejected, resp.Errors))
+		if overQuota && resp.Created == 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(quotaRetryAfter.Seconds())))
+			writeJSON(w, http.StatusTooManyRequests, resp)
+			return
+		}
 		writeJSON(w, http.StatusOK, resp)
 	}
 }
 
 func handleListJobs(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		jobs := mgr.ListJobs()
+		jobs := mgr.ListJobs(principalFrom(r).Owner())
 		summaries := make([]jobSummary, len(jobs))
 		for i, j := range jobs {
 			summaries[i] = toSummary(j)
@@ -218,7 +400,7 @@ func handleListJobs(mgr *DownloadManager) http.HandlerFunc {
 func handleJobStatus(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		job, ok := mgr.GetJob(id)
+		job, ok := visibleJob(mgr, r, id)
 		if !ok {
 			http.NotFound(w, r)
 			return
@@ -230,7 +412,7 @@ func handleJobStatus(mgr *DownloadManager) http.HandlerFunc {
 func handleJobStream(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		job, ok := mgr.GetJob(id)
+		job, ok := visibleJob(mgr, r, id)
 		if !ok {
 			http.NotFound(w, r)
 			return
@@ -298,14 +480,136 @@ func handleJobStream(mgr *DownloadManager) http.HandlerFunc {
 	}
 }
 
+type fileEntry struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Type  string `json:"type"`
+}
+
+func handleJobFiles(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		job, ok := visibleJob(mgr, r, id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		job.mu.Lock()
+		entries := make([]fileEntry, len(job.Files))
+		for i, f := range job.Files {
+			entries[i] = fileEntry{Index: i, Name: filepath.Base(f.Path), Path: f.Path, Size: f.Size, Type: f.Type}
+		}
+		job.mu.Unlock()
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// serveProducedFile streams a job's file with Range support.
+func serveProducedFile(mgr *DownloadManager, w http.ResponseWriter, r *http.Request, f ProducedFile) {
+	file, err := mgr.openLibraryFile(f.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := filepath.Base(f.Path)
+	if ct, ok := mediaContentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		w.Header().Set("Content-Type", ct)
+	}
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+func handleJobFile(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := visibleJob(mgr, r, r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		n, err := strconv.Atoi(r.PathValue("n"))
+		job.mu.Lock()
+		if err != nil || n < 0 || n >= len(job.Files) {
+			job.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		f := job.Files[n]
+		job.mu.Unlock()
+		serveProducedFile(mgr, w, r, f)
+	}
+}
+
+func handleJobThumbnail(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := visibleJob(mgr, r, r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var thumb *ProducedFile
+		job.mu.Lock()
+		for i := range job.Files {
+			if job.Files[i].Type == MediaThumbnail {
+				f := job.Files[i]
+				thumb = &f
+				break
+			}
+		}
+		job.mu.Unlock()
+		if thumb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveProducedFile(mgr, w, r, *thumb)
+	}
+}
+
 func handleRetryJob(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		job, err := mgr.RetryJob(id)
+		bypassArchive := r.URL.Query().Get("bypassArchive") == "true"
+		job, ok := visibleJob(mgr, r, id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		// Where a host resolves to may have changed since submission
+		if err := mgr.urlPolicy.Check(r.Context(), job.URL); err != nil {
+			auditNote(r, "retry of "+id+" rejected: "+err.Error())
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "URL rejected: " + err.Error()})
+			return
+		}
+		job, err := mgr.RetryJob(id, bypassArchive)
 		if err != nil {
+			// Only retries that happened list the job, so a job's audit
+			// trail does not show rejected attempts as retries
+			auditNote(r, "retry of "+id+" rejected: "+err.Error())
+		}
+		var quota *quotaError
+		if errors.As(err, &quota) {
+			writeTooManyRequests(w, quotaRetryAfter, err.Error())
+			return
+		} else if err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return
 		}
+		auditJobs(r, id)
 		writeJSON(w, http.StatusOK, toSummary(job))
 	}
 }
@@ -313,7 +617,13 @@ func handleRetryJob(mgr *DownloadManager) http.HandlerFunc {
 func handleDeleteJob(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		if err := mgr.DeleteJob(id); err != nil {
+		deleteFiles := r.URL.Query().Get("files") == "true"
+		if _, ok := visibleJob(mgr, r, id); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		auditJobs(r, id)
+		if err := mgr.DeleteJob(id, deleteFiles); err != nil {
 			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 			return
 		}
@@ -321,9 +631,42 @@ func handleDeleteJob(mgr *DownloadManager) http.HandlerFunc {
 	}
 }
 
+// handleDeleteAllJobs removes every job the user owns, or every job for
+// admins. With a status or olderThan query parameter it only prunes
+// matching finished records instead, leaving active jobs and produced
+// files alone.
 func handleDeleteAllJobs(mgr *DownloadManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		mgr.DeleteAllJobs()
+		q := r.URL.Query()
+		if q.Has("status") || q.Has("olderThan") {
+			statuses := []JobStatus{StatusCompleted, StatusFailed}
+			if v := q.Get("status"); v != "" {
+				statuses = nil
+				for _, s := range strings.Split(v, ",") {
+					s := JobStatus(strings.TrimSpace(s))
+					if s != StatusCompleted && s != StatusFailed {
+						writeJSON(w, http.StatusBadRequest, map[string]string{"error": "status must be completed or failed"})
+						return
+					}
+					statuses = append(statuses, s)
+				}
+			}
+			var olderThan time.Duration
+			if v := q.Get("olderThan"); v != "" {
+				d, err := parseAge(v)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+					return
+				}
+				olderThan = d
+			}
+			ids, held := mgr.PruneJobs(statuses, olderThan, principalFrom(r).Owner())
+			auditJobs(r, ids...)
+			writeJSON(w, http.StatusOK, map[string]int{"deleted": len(ids), "keptForRetention": len(held)})
+			return
+		}
+
+		auditJobs(r, mgr.DeleteAllJobs(principalFrom(r).Owner())...)
 		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hook stages.
+const (
+	HookPostDownload = "post-download"
+	HookPostMove     = "post-move"
+)
+
+// HookConfig configures the user commands run after each download.
+type HookConfig struct {
+	PostDownload string        // runs in the job dir before files are moved
+	PostMove     string        // runs after files reach the library
+	Timeout      time.Duration // per-invocation limit
+	FailJob      bool          // a failing hook fails the job instead of warning
+}
+
+// hookPayload is written to the hook's stdin as JSON.
+type hookPayload struct {
+	Stage   string          `json:"stage"`
+	JobID   string          `json:"jobId"`
+	URL     string          `json:"url"`
+	Options DownloadOptions `json:"options"`
+	Files   []string        `json:"files"`
+}
+
+// runHook executes the command configured for stage, if any. Output goes
+// to the job log. A failure is returned only when the hook policy says it
+// should fail the job; otherwise it is recorded as a warning.
+func (m *DownloadManager) runHook(job *Job, stage, jobDir string) error {
+	command := m.hooks.PostDownload
+	if stage == HookPostMove {
+		command = m.hooks.PostMove
+	}
+	if command == "" {
+		return nil
+	}
+
+	var files []string
+	if stage == HookPostDownload {
+		rels, err := collectFiles(jobDir)
+		if err != nil {
+			return err
+		}
+		for _, rel := range rels {
+			files = append(files, filepath.Join(jobDir, rel))
+		}
+	} else {
+		job.mu.Lock()
+		for _, f := range job.Files {
+			files = append(files, f.Path)
+		}
+		job.mu.Unlock()
+	}
+
+	job.mu.Lock()
+	payload := hookPayload{Stage: stage, JobID: job.ID, URL: job.URL, Options: job.Options, Files: files}
+	job.mu.Unlock()
+	stdin, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// A playlist's paths can exceed the environment size limit, so the
+	// list is passed as a file. It is hidden, so it is never delivered.
+	listFile, err := writeHookFileList(jobDir, files)
+	if err != nil {
+		return m.hookFailed(job, stage, fmt.Errorf("write file list: %v", err))
+	}
+	defer func() {
+		os.Remove(listFile)
+		if stage == HookPostMove {
+			// The job dir only exists again for the list
+			os.Remove(jobDir)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(m.shutdownCtx, m.hooks.Timeout)
+	defer cancel()
+	job.mu.Lock()
+	job.cancel = cancel
+	job.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.WaitDelay = 5 * time.Second
+	if stage == HookPostDownload {
+		cmd.Dir = jobDir
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"YTDLP_HOOK_STAGE="+stage,
+		"YTDLP_JOB_ID="+payload.JobID,
+		"YTDLP_JOB_URL="+payload.URL,
+		"YTDLP_JOB_FORMAT="+payload.Options.Format,
+		"YTDLP_JOB_ALL_AUDIO="+boolStr(payload.Options.AllAudio),
+		"YTDLP_JOB_SUBTITLES="+boolStr(payload.Options.Subtitles),
+		"YTDLP_JOB_DESTINATION="+payload.Options.Destination,
+		"YTDLP_JOB_FILES_LIST="+listFile,
+	)
+
+	// Output goes through a writer rather than StdoutPipe so Wait stops
+	// reading after WaitDelay even if a child of the hook keeps it open
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		scanner := bufio.NewScanner(pr)
+		scanner.Split(scanCRLF)
+		for scanner.Scan() {
+			if trimmed := strings.TrimSpace(scanner.Text()); trimmed != "" {
+				job.appendLine("[hook] " + trimmed)
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	job.appendLine(fmt.Sprintf("--- Running %s hook ---", stage))
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		<-scanned
+		return m.hookFailed(job, stage, fmt.Errorf("failed to start: %v", err))
+	}
+	err = cmd.Wait()
+	pw.Close()
+	<-scanned
+
+	if m.shutdownCtx.Err() != nil {
+		// Before the move a restart runs the job again; after it the files
+		// are delivered, so only the hook policy decides
+		if stage == HookPostDownload {
+			return fmt.Errorf("%s hook interrupted by shutdown", stage)
+		}
+		return m.hookFailed(job, stage, fmt.Errorf("interrupted by shutdown"))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", m.hooks.Timeout)
+	}
+	if err != nil {
+		return m.hookFailed(job, stage, err)
+	}
+	return nil
+}
+
+// writeHookFileList writes files, one per line, to a hidden file in
+// jobDir and returns its path.
+func writeHookFileList(jobDir string, files []string) (string, error) {
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(jobDir, ".hook-files")
+	var b strings.Builder
+	for _, f := range files {
+		b.WriteString(f)
+		b.WriteByte('\n')
+	}
+	return path, os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func (m *DownloadManager) hookFailed(job *Job, stage string, err error) error {
+	if m.hooks.FailJob {
+		return err
+	}
+	job.addWarning(fmt.Sprintf("%s hook failed: %v", stage, err))
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func jobOutput(j *Job) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return strings.Join(j.Output, "\n")
+}
+
+func TestPostMoveHookInterruptedByShutdown(t *testing.T) {
+	m, stop := newTestManager(t, ManagerConfig{
+		OutputDir: t.TempDir(),
+		Hooks:     HookConfig{PostMove: "sleep 30", Timeout: time.Minute},
+	}, newFakeExecutor())
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitFor(t, "post-move hook to start", func() bool {
+		return strings.Contains(jobOutput(job), "Running post-move hook")
+	})
+	stop()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.Status != StatusCompleted {
+		t.Errorf("delivered job is %s after shutdown: %s", job.Status, job.Error)
+	}
+	if !slices.ContainsFunc(job.Warnings, func(w string) bool { return strings.Contains(w, "interrupted by shutdown") }) {
+		t.Errorf("warnings = %q", job.Warnings)
+	}
+}
+
+func TestHookReceivesFileList(t *testing.T) {
+	outputDir, listCopy := t.TempDir(), filepath.Join(t.TempDir(), "files")
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{
+		"Channel/One.mkv": "video",
+		"Channel/Two.mkv": "video",
+	}})
+	m, _ := newTestManager(t, ManagerConfig{
+		OutputDir: outputDir,
+		Hooks:     HookConfig{PostMove: `cp "$YTDLP_JOB_FILES_LIST" ` + listCopy, Timeout: time.Minute},
+	}, fake)
+
+	job, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+
+	data, err := os.ReadFile(listCopy)
+	if err != nil {
+		t.Fatalf("hook did not get the list: %v\n%s", err, jobOutput(job))
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	slices.Sort(lines)
+	want := []string{filepath.Join(outputDir, "Channel", "One.mkv"), filepath.Join(outputDir, "Channel", "Two.mkv")}
+	if !slices.Equal(lines, want) {
+		t.Errorf("file list = %q, want %q", lines, want)
+	}
+	if _, err := os.Stat(filepath.Join(m.downloadDir, job.ID)); !os.IsNotExist(err) {
+		t.Error("job dir left behind for the file list")
+	}
+}
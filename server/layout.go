@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// builtinRoots are the library browser names of DOWNLOAD_DIR and
+// OUTPUT_DIR, which a destination would be hidden behind.
+var builtinRoots = []string{"Downloads", "Output"}
+
+// parseDestinations parses DESTINATIONS, a comma-separated list of
+// Name=/path entries naming the library roots a job may target.
+func parseDestinations(s string) (map[string]string, error) {
+	dests := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		path = strings.TrimSpace(path)
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid destination %q, expected Name=/path", entry)
+		}
+		if slices.Contains(builtinRoots, name) {
+			return nil, fmt.Errorf("destination name %q is reserved for a built-in library root", name)
+		}
+		if _, dup := dests[name]; dup {
+			return nil, fmt.Errorf("duplicate destination %q", name)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q: %v", name, err)
+		}
+		dests[name] = abs
+	}
+	return dests, nil
+}
+
+// destinationNames returns the configured destination names in sorted order.
+func destinationNames(dests map[string]string) []string {
+	names := make([]string, 0, len(dests))
+	for name := range dests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var templateFieldRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+var templateFields = map[string]func(nfoMetadata) string{
+	"title":       func(m nfoMetadata) string { return m.Title },
+	"uploader":    func(m nfoMetadata) string { return m.Uploader },
+	"upload_date": func(m nfoMetadata) string { return m.UploadDate },
+	"id":          func(m nfoMetadata) string { return m.ID },
+	"year": func(m nfoMetadata) string {
+		if len(m.UploadDate) >= 4 {
+			return m.UploadDate[:4]
+		}
+		return ""
+	},
+}
+
+// validateTemplate checks that tmpl is a relative path template using only
+// known fields and no "." or ".." segments.
+func validateTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+	if strings.HasPrefix(tmpl, "/") || strings.Contains(tmpl, `\`) || filepath.IsAbs(tmpl) {
+		return fmt.Errorf("template must be a relative path")
+	}
+	for _, seg := range strings.Split(tmpl, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("template contains an invalid path segment %q", seg)
+		}
+	}
+	for _, m := range templateFieldRegex.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := templateFields[m[1]]; !ok {
+			return fmt.Errorf("unknown template field {%s}", m[1])
+		}
+	}
+	return nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]`)
+
+// sanitizeSegment makes s safe to use as a single path component.
+func sanitizeSegment(s string) string {
+	s = unsafePathChars.ReplaceAllString(s, "_")
+	s = strings.Trim(s, " .")
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// renderTemplate expands tmpl with meta into a relative path. Field values
+// are sanitized so they can never introduce extra path segments.
+func renderTemplate(tmpl string, meta nfoMetadata) (string, error) {
+	if err := validateTemplate(tmpl); err != nil {
+		return "", err
+	}
+	segs := strings.Split(tmpl, "/")
+	for i, seg := range segs {
+		seg = templateFieldRegex.ReplaceAllStringFunc(seg, func(field string) string {
+			v := templateFields[field[1:len(field)-1]](meta)
+			if v == "" {
+				v = "unknown"
+			}
+			return unsafePathChars.ReplaceAllString(v, "_")
+		})
+		segs[i] = sanitizeSegment(seg)
+	}
+	rel := filepath.Join(segs...)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("template resolves outside the destination: %q", rel)
+	}
+	return rel, nil
+}
+
+// withinRoot reports whether path is root itself or lies beneath it.
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || filepath.IsLocal(rel)
+}
+
+// isSidecarOf reports whether file belongs to the video whose path without
+// extension is stem: its NFO, info JSON, artwork or subtitles. Other files
+// that merely start with the same name, such as "Foo - Part 2.mkv" or
+// "Foo.1080p.nfo" next to "Foo.mkv", do not.
+func isSidecarOf(file, stem string) bool {
+	if filepath.Dir(file) != filepath.Dir(stem) {
+		return false
+	}
+	if strings.EqualFold(file, stem+".info.json") {
+		return true
+	}
+	if s, _ := splitName(filepath.Base(file)); s != filepath.Base(stem) {
+		return false
+	}
+	switch mediaType(file) {
+	case MediaNFO, MediaThumbnail, MediaSubtitle:
+		return true
+	}
+	return false
+}
+
+// applyTemplate renames the videos in jobDir according to tmpl. A video's
+// sidecar files (NFO, thumbnail, subtitles) move with it, anything else
+// keeps its original relative path.
+func applyTemplate(jobDir, tmpl string) error {
+	files, err := collectFiles(jobDir)
+	if err != nil {
+		return err
+	}
+
+	renames := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, f := range files {
+		if !isVideoFile(f) {
+			continue
+		}
+		stem := strings.TrimSuffix(f, filepath.Ext(f))
+
+		meta := nfoMetadata{}
+		if doc, err := readNFO(filepath.Join(jobDir, stem+".nfo")); err == nil {
+			meta = doc.metadata()
+		}
+		if meta.Title == "" {
+			meta.Title = filepath.Base(stem)
+		}
+
+		newStem, err := renderTemplate(tmpl, meta)
+		if err != nil {
+			return err
+		}
+		base := newStem
+		for n := 2; taken[newStem]; n++ {
+			newStem = fmt.Sprintf("%s (%d)", base, n)
+		}
+		taken[newStem] = true
+
+		for _, g := range files {
+			if g == f || isSidecarOf(g, stem) {
+				renames[g] = newStem + g[len(stem):]
+			}
+		}
+	}
+
+	// Rename through a hidden staging dir so one file's new name can never
+	// clobber another file that has not been moved yet.
+	stagingDir := filepath.Join(jobDir, ".layout")
+	for from, to := range renames {
+		dst := filepath.Join(stagingDir, to)
+		if !withinRoot(stagingDir, dst) {
+			return fmt.Errorf("refusing to move %s outside the job directory", from)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(jobDir, from), dst); err != nil {
+			return err
+		}
+	}
+	removeEmptyDirs(jobDir)
+
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mv := &fileMover{policy: CollisionOverwrite}
+	for _, entry := range entries {
+		if err := mv.move(filepath.Join(stagingDir, entry.Name()), filepath.Join(jobDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(stagingDir)
+}
+
+// removeEmptyDirs deletes empty directories beneath root, deepest first.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	meta := nfoMetadata{Title: "Big: News?", Uploader: "AC/DC", UploadDate: "2024-03-01", ID: "abc"}
+	tests := []struct {
+		tmpl string
+		meta nfoMetadata
+		want string
+	}{
+		{"{title}", meta, "Big_ News_"},
+		{"{uploader}/{year}/{upload_date} - {title} [{id}]", meta, "AC_DC/2024/2024-03-01 - Big_ News_ [abc]"},
+		{"{uploader}/{title}", nfoMetadata{Title: "Clip"}, "unknown/Clip"},
+		// Field values never add path segments or climb out
+		{"{title}", nfoMetadata{Title: "../../etc/passwd"}, "_.._etc_passwd"},
+		{"{uploader}/{title}", nfoMetadata{Uploader: "..", Title: "."}, "_/_"},
+	}
+	for _, tt := range tests {
+		got, err := renderTemplate(tt.tmpl, tt.meta)
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("renderTemplate(%q, %+v) = %q, %v, want %q", tt.tmpl, tt.meta, got, err, tt.want)
+		}
+		if err == nil && !filepath.IsLocal(got) {
+			t.Errorf("renderTemplate(%q) = %q leaves the destination", tt.tmpl, got)
+		}
+	}
+}
+
+func TestValidateTemplateRejectsTraversal(t *testing.T) {
+	for _, tmpl := range []string{"../{title}", "{uploader}/../../{title}", "/abs/{title}", `a\{title}`, "a//{title}", "./{title}", "{bogus}"} {
+		if err := validateTemplate(tmpl); err == nil {
+			t.Errorf("validateTemplate(%q) accepted", tmpl)
+		}
+		if _, err := renderTemplate(tmpl, nfoMetadata{Title: "x"}); err == nil {
+			t.Errorf("renderTemplate(%q) accepted", tmpl)
+		}
+	}
+	if err := validateTemplate("{uploader}/{year}/{title}"); err != nil {
+		t.Errorf("valid template rejected: %v", err)
+	}
+}
+
+func TestApplyTemplateMovesOnlySidecars(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"Foo.mkv", "Foo-thumb.jpg", "Foo.en.vtt", "Foo.info.json",
+		"Foo - Part 2.mkv", "Foo.1080p.mkv", "Foo.1080p.nfo", "notes.txt",
+	} {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644)
+	}
+	if err := writeMinimalNFO(filepath.Join(dir, "Foo.nfo"), "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyTemplate(dir, "{uploader}/{title}"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := collectFiles(dir)
+	sort.Strings(got)
+	want := []string{
+		"notes.txt",
+		"unknown/Foo - Part 2.mkv",
+		"unknown/Foo.1080p.mkv",
+		"unknown/Foo.1080p.nfo",
+		"unknown/Renamed-thumb.jpg",
+		"unknown/Renamed.en.vtt",
+		"unknown/Renamed.info.json",
+		"unknown/Renamed.mkv",
+		"unknown/Renamed.nfo",
+	}
+	for i := range want {
+		want[i] = filepath.FromSlash(want[i])
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("files after applying the template:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseDestinations(t *testing.T) {
+	dests, err := parseDestinations(" Kids=/media/kids , Music=/media/music")
+	if err != nil || len(dests) != 2 || dests["Kids"] != filepath.Clean("/media/kids") {
+		t.Fatalf("parseDestinations = %v, %v", dests, err)
+	}
+	for _, s := range []string{"Kids", "=/media", "Kids=/a,Kids=/b", "Downloads=/media/dl", "Output=/media/out"} {
+		if _, err := parseDestinations(s); err == nil {
+			t.Errorf("parseDestinations(%q) accepted", s)
+		}
+	}
+}
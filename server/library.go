@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// libraryEntry is a file or folder in the library index. Path is virtual:
+// the library root name followed by the slash-separated relative path.
+type libraryEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Type    string    `json:"type,omitempty"`
+	Title   string    `json:"title,omitempty"`
+}
+
+type nfoTitleCache struct {
+	modTime time.Time
+	title   string
+}
+
+// libraryIndex is an in-memory listing of every library root, rebuilt on
+// demand after moves and periodically in the background.
+type libraryIndex struct {
+	roots   func() map[string]string
+	skip    func(root, rel string) bool
+	trigger chan struct{}
+
+	mu      sync.RWMutex
+	dirs    map[string][]libraryEntry
+	files   []libraryEntry
+	scanned time.Time
+	titles  map[string]nfoTitleCache
+}
+
+func newLibraryIndex(roots func() map[string]string, skip func(root, rel string) bool) *libraryIndex {
+	return &libraryIndex{
+		roots:   roots,
+		skip:    skip,
+		trigger: make(chan struct{}, 1),
+		dirs:    make(map[string][]libraryEntry),
+		titles:  make(map[string]nfoTitleCache),
+	}
+}
+
+// Refresh requests a rescan. Requests made while a scan is pending coalesce.
+func (idx *libraryIndex) Refresh() {
+	select {
+	case idx.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run rescans on every Refresh and every interval until ctx is done.
+func (idx *libraryIndex) run(ctx context.Context, interval time.Duration) {
+	idx.scan()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-idx.trigger:
+		case <-ticker.C:
+		}
+		idx.scan()
+	}
+}
+
+func (idx *libraryIndex) scan() {
+	dirs := make(map[string][]libraryEntry)
+	var files []libraryEntry
+	seenTitles := make(map[string]nfoTitleCache)
+
+	roots := idx.roots()
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		root := roots[name]
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		dirs[""] = append(dirs[""], libraryEntry{Name: name, Path: name, IsDir: true, ModTime: info.ModTime()})
+		dirs[name] = []libraryEntry{}
+
+		filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil || p == root {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") || idx.skip(root, rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+
+			virt := path.Join(name, filepath.ToSlash(rel))
+			entry := libraryEntry{
+				Name:    d.Name(),
+				Path:    virt,
+				IsDir:   d.IsDir(),
+				ModTime: info.ModTime(),
+			}
+			if d.IsDir() {
+				dirs[virt] = []libraryEntry{}
+			} else {
+				entry.Size = info.Size()
+				entry.Type = mediaType(p)
+				if entry.Type == MediaNFO {
+					entry.Title = idx.nfoTitle(p, info.ModTime(), seenTitles)
+				}
+				files = append(files, entry)
+			}
+			parent := path.Dir(virt)
+			dirs[parent] = append(dirs[parent], entry)
+			return nil
+		})
+	}
+
+	// Give videos the title of their sibling NFO
+	nfoTitles := make(map[string]string)
+	for _, f := range files {
+		if f.Type == MediaNFO && f.Title != "" {
+			nfoTitles[strings.TrimSuffix(f.Path, ".nfo")] = f.Title
+		}
+	}
+	annotate := func(e *libraryEntry) {
+		if e.Type == MediaVideo {
+			e.Title = nfoTitles[strings.TrimSuffix(e.Path, path.Ext(e.Path))]
+		}
+	}
+	for i := range files {
+		annotate(&files[i])
+	}
+	for _, list := range dirs {
+		for i := range list {
+			annotate(&list[i])
+		}
+	}
+
+	idx.mu.Lock()
+	idx.dirs = dirs
+	idx.files = files
+	idx.titles = seenTitles
+	idx.scanned = time.Now()
+	idx.mu.Unlock()
+}
+
+// nfoTitle returns the NFO title at p, reusing the previous scan's result
+// when the file has not changed.
+func (idx *libraryIndex) nfoTitle(p string, modTime time.Time, seen map[string]nfoTitleCache) string {
+	idx.mu.RLock()
+	cached, ok := idx.titles[p]
+	idx.mu.RUnlock()
+	if !ok || !cached.modTime.Equal(modTime) {
+		cached = nfoTitleCache{modTime: modTime}
+		if doc, err := readNFO(p); err == nil {
+			cached.title = strings.TrimSpace(doc.Title)
+		}
+	}
+	seen[p] = cached
+	return cached.title
+}
+
+// List returns the entries of the virtual directory dir, folders first.
+func (idx *libraryIndex) List(dir string) ([]libraryEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entries, ok := idx.dirs[dir]
+	if !ok {
+		return nil, false
+	}
+	list := make([]libraryEntry, len(entries))
+	copy(list, entries)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].IsDir != list[j].IsDir {
+			return list[i].IsDir
+		}
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list, true
+}
+
+// Search returns files whose name or title contains every word of query.
+func (idx *libraryIndex) Search(query string, limit int) []libraryEntry {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return []libraryEntry{}
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	results := []libraryEntry{}
+	for _, f := range idx.files {
+		hay := strings.ToLower(f.Path + " " + f.Title)
+		match := true
+		for _, w := range words {
+			if !strings.Contains(hay, w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			results = append(results, f)
+			if len(results) >= limit {
+				break
+			}
+		}
+	}
+	return results
+}
+
+func (idx *libraryIndex) ScannedAt() time.Time {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.scanned
+}
+
+// libraryRootNames maps the names shown in the library browser to roots.
+func (m *DownloadManager) libraryRootNames() map[string]string {
+	roots := map[string]string{"Downloads": m.downloadDir}
+	if m.outputDir != "" {
+		roots["Output"] = m.outputDir
+	}
+	// parseDestinations rejects the built-in names
+	for name, dir := range m.destinations {
+		roots[name] = dir
+	}
+	return roots
+}
+
+// skipLibraryPath hides in-progress job directories inside downloadDir.
+func (m *DownloadManager) skipLibraryPath(root, rel string) bool {
+	if root != m.downloadDir || strings.ContainsRune(rel, filepath.Separator) {
+		return false
+	}
+	_, err := strconv.Atoi(rel)
+	return err == nil
+}
+
+// startLibraryIndex builds the library index and keeps it fresh, rescanning
+// every ten minutes unless interval says otherwise.
+func (m *DownloadManager) startLibraryIndex(interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	m.library = newLibraryIndex(m.libraryRootNames, m.skipLibraryPath)
+	m.shutdownWg.Add(1)
+	go func() {
+		defer m.shutdownWg.Done()
+		m.library.run(m.shutdownCtx, interval)
+	}()
+	log.Printf("library: indexing %d roots every %s", len(m.libraryRootNames()), interval)
+}
+
+type libraryListing struct {
+	Path      string         `json:"path"`
+	Entries   []libraryEntry `json:"entries"`
+	ScannedAt time.Time      `json:"scannedAt"`
+}
+
+func handleLibrary(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("path")), "/")
+		entries, ok := mgr.library.List(dir)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "path not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, libraryListing{Path: dir, Entries: entries, ScannedAt: mgr.library.ScannedAt()})
+	}
+}
+
+func handleLibrarySearch(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		writeJSON(w, http.StatusOK, mgr.library.Search(q, 200))
+	}
+}
+
+func handleLibraryRescan(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mgr.library.Refresh()
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "scheduled"})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaRetryAfter is suggested to clients over their job quota, since
+// when their jobs finish is unknown.
+const quotaRetryAfter = time.Minute
+
+// quotaError rejects a job that would exceed its owner's quota.
+type quotaError struct {
+	limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("queued job quota of %d reached", e.limit)
+}
+
+// quotaLeft returns how many more jobs owner may have unfinished, or -1
+// without a limit. Must be called with m.mu held.
+func (m *DownloadManager) quotaLeft(owner string) int {
+	if m.maxQueuedPerUser <= 0 || owner == "" || (m.quotaExempt != nil && m.quotaExempt(owner)) {
+		return -1
+	}
+	n := 0
+	for _, j := range m.jobs {
+		if j.Owner != owner {
+			continue
+		}
+		j.mu.Lock()
+		if j.Status != StatusCompleted && j.Status != StatusFailed {
+			n++
+		}
+		j.mu.Unlock()
+	}
+	return max(m.maxQueuedPerUser-n, 0)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client: each holds up to burst
+// requests and refills at perMinute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newRateLimiter returns nil, which allows everything, when perMinute is
+// not positive.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perMinute: float64(perMinute),
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[string]*bucket),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a request from key's bucket. When the bucket is empty it
+// returns how long until the next request is allowed.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	refill := func(b *bucket) {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Minutes()*l.perMinute)
+		b.last = now
+	}
+	// Full buckets carry no state worth keeping
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if refill(b); b.tokens >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	refill(b)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.perMinute * float64(time.Minute))
+	return false, wait
+}
+
+// clientKey identifies the client of a request for rate limiting. A
+// user's logins and API tokens share one bucket, so creating more tokens
+// does not raise their rate.
+func clientKey(r *http.Request) string {
+	if p := principalFrom(r); p.Username != "" {
+		return "user:" + p.Username
+	}
+	return "ip:" + clientIP(r)
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": msg})
+}
+
+// rateLimited applies the submission rate limit to a handler. Admins are
+// exempt.
+func rateLimited(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r).IsAdmin() {
+			if ok, wait := limiter.Allow(clientKey(r)); !ok {
+				writeTooManyRequests(w, wait, "too many submissions, slow down")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("user:alice"); !ok {
+			t.Fatalf("request %d within burst denied", i+1)
+		}
+	}
+	ok, wait := l.Allow("user:alice")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("request over burst: ok=%v wait=%s, want denied for up to 1s", ok, wait)
+	}
+	if ok, _ := l.Allow("user:bob"); !ok {
+		t.Error("another client shares alice's bucket")
+	}
+
+	now := time.Now()
+	l.now = func() time.Time { return now.Add(2 * time.Second) }
+	if ok, _ := l.Allow("user:alice"); !ok {
+		t.Error("bucket did not refill")
+	}
+	if ok, _ := newRateLimiter(0, 0).Allow("x"); !ok {
+		t.Error("disabled limiter denied a request")
+	}
+}
+
+func TestSubmissionLimits(t *testing.T) {
+	hold := make(chan struct{})
+	defer close(hold)
+	fake := newFakeExecutor()
+	for _, u := range []string{"a", "b", "c", "d", "e"} {
+		fake.script("https://example.com/"+u, fakeAttempt{Hold: hold})
+	}
+	m, _ := newTestManager(t, ManagerConfig{
+		MaxQueuedPerUser: 2,
+		QuotaExempt:      func(owner string) bool { return owner == "admin" },
+	}, fake)
+
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	users.Create("alice", "alice-password", RoleMember)
+	tokens, _ := newTokenStore("")
+	secrets := make(map[string]string)
+	for _, u := range []string{"admin", "alice"} {
+		_, secrets[u], _ = tokens.Create(u, "script", ScopeSubmit, nil)
+	}
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	// A stopped clock keeps buckets from refilling however slow the run
+	limiter := newRateLimiter(60, 3)
+	frozen := time.Now()
+	limiter.now = func() time.Time { return frozen }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/download", rateLimited(limiter, handleSubmit(m)))
+	mux.HandleFunc("POST /api/download/bulk", rateLimited(limiter, handleBulkSubmit(m)))
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	defer srv.Close()
+
+	submit := func(user, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secrets[user])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := submit("alice", "/api/download", `{"url":"https://example.com/a"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("first submission got %d", resp.StatusCode)
+	}
+	resp := submit("alice", "/api/download/bulk", `{"urls":["https://example.com/b","https://example.com/c"]}`)
+	var bulk bulkDownloadResponse
+	json.NewDecoder(resp.Body).Decode(&bulk)
+	if resp.StatusCode != http.StatusOK || bulk.Created != 1 || bulk.Errors != 1 || !strings.Contains(bulk.Results[1].Error, "quota") {
+		t.Errorf("bulk over quota: status %d, %+v", resp.StatusCode, bulk)
+	}
+
+	// Third request: within the rate limit but entirely over quota
+	resp = submit("alice", "/api/download", `{"url":"https://example.com/d"}`)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("submission over quota got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// Fourth request: the bucket is empty
+	resp = submit("alice", "/api/download", `{"url":"https://example.com/d"}`)
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body["error"], "slow down") {
+		t.Errorf("submission over rate limit got %d %v", resp.StatusCode, body)
+	}
+
+	// Admins are exempt from both
+	for _, u := range []string{"d", "e"} {
+		if resp := submit("admin", "/api/download", `{"url":"https://example.com/`+u+`"}`); resp.StatusCode != http.StatusCreated {
+			t.Errorf("admin submission got %d", resp.StatusCode)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		submit("admin", "/api/download/bulk", `{"urls":[]}`)
+	}
+	if resp := submit("admin", "/api/download/bulk", `{"urls":[]}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("admin rate limited: %d", resp.StatusCode)
+	}
+}
+
+func TestQuotaCountsUnfinishedJobs(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/fail", fakeAttempt{Exit: 1})
+	m, _ := newTestManager(t, ManagerConfig{MaxQueuedPerUser: 1, MaxRetries: 1}, fake)
+
+	job, err := m.StartDownload("https://example.com/fail", DefaultOptions(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, job, StatusFailed)
+	hold := make(chan struct{})
+	defer close(hold)
+	fake.script("https://example.com/ok", fakeAttempt{Hold: hold})
+	if _, err := m.StartDownload("https://example.com/ok", DefaultOptions(), "alice"); err != nil {
+		t.Fatalf("finished job counted against the quota: %v", err)
+	}
+	var quota *quotaError
+	if _, err := m.RetryJob(job.ID, false); !errors.As(err, &quota) {
+		t.Errorf("retry past the quota: err = %v", err)
+	}
+	if s := jobStatus(job); s != StatusFailed {
+		t.Errorf("job rejected by the quota is %s", s)
+	}
+	_, err = m.StartDownload("https://example.com/more", DefaultOptions(), "bob")
+	if err != nil && errors.As(err, &quota) {
+		t.Errorf("bob limited by alice's jobs: %v", err)
+	}
+}
+
+func TestClientKeySharedByTokens(t *testing.T) {
+	key := func(p *Principal) string {
+		r := httptest.NewRequest("POST", "/api/download", nil)
+		return clientKey(r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+	session := key(&Principal{Username: "alice", via: "session"})
+	token := key(&Principal{Username: "alice", via: "token", tokenID: "t1"})
+	other := key(&Principal{Username: "alice", via: "token", tokenID: "t2"})
+	if session != token || token != other {
+		t.Errorf("alice's clients use separate buckets: %q %q %q", session, token, other)
+	}
+}
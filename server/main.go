@@ -2,16 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/subtle"
+	"crypto/tls"
 	"embed"
-	"encoding/json"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 )
@@ -26,30 +25,26 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func authMiddleware(next http.Handler, password string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if password == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		token := ""
-		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
-			token = strings.TrimPrefix(auth, "Bearer ")
-		}
-		if token == "" {
-			token = r.URL.Query().Get("token")
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
 		}
+		log.Printf("ignoring invalid %s=%q", key, v)
+	}
+	return fallback
+}
 
-		if subtle.ConstantTimeCompare([]byte(token), []byte(password)) != 1 {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
-			return
+// getEnvLimit is getEnvDuration for limits that zero switches off, e.g.
+// "0" or "0s".
+func getEnvLimit(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
 		}
-
-		next.ServeHTTP(w, r)
-	})
+		log.Printf("ignoring invalid %s=%q", key, v)
+	}
+	return fallback
 }
 
 func main() {
@@ -73,23 +68,296 @@ func main() {
 		}
 	}
 
+	destinations, err := parseDestinations(getEnv("DESTINATIONS", ""))
+	if err != nil {
+		log.Fatalf("invalid DESTINATIONS: %v", err)
+	}
+
+	presetsFile := getEnv("PRESETS_FILE", "")
+	if presetsFile == "" && dataDir != "" {
+		presetsFile = filepath.Join(dataDir, "presets.json")
+	}
+	extrasFile := getEnv("EXTRAS_FILE", "")
+	if extrasFile == "" && dataDir != "" {
+		extrasFile = filepath.Join(dataDir, "extras.json")
+	}
+	extras, err := loadExtras(extrasFile)
+	if err != nil {
+		log.Fatalf("invalid extras: %v", err)
+	}
+
+	proxiesFile := getEnv("PROXIES_FILE", "")
+	if proxiesFile == "" && dataDir != "" {
+		proxiesFile = filepath.Join(dataDir, "proxies.json")
+	}
+	proxies, err := loadProxies(proxiesFile)
+	if err != nil {
+		log.Fatalf("invalid proxies: %v", err)
+	}
+
+	presets, err := loadPresets(presetsFile, destinations, extras, proxies)
+	if err != nil {
+		log.Fatalf("invalid presets: %v", err)
+	}
+
+	extractors, err := parseExtractors(getEnv("URL_EXTRACTORS", ""))
+	if err != nil {
+		log.Fatalf("invalid URL_EXTRACTORS: %v", err)
+	}
+	urlPolicy, err := newURLPolicy(URLPolicy{
+		Schemes:      splitList(getEnv("URL_SCHEMES", "http,https")),
+		AllowHosts:   splitList(getEnv("URL_ALLOW_HOSTS", "")),
+		DenyHosts:    splitList(getEnv("URL_DENY_HOSTS", "")),
+		AllowPrivate: getEnv("URL_ALLOW_PRIVATE", "false") == "true",
+		Extractors:   extractors,
+	})
+	if err != nil {
+		log.Fatalf("invalid URL policy: %v", err)
+	}
+
+	collision, err := parseCollisionPolicy(getEnv("COLLISION_POLICY", string(CollisionOverwrite)))
+	if err != nil {
+		log.Fatalf("invalid COLLISION_POLICY: %v", err)
+	}
+
+	nfoValidation, err := parseNFOValidation(getEnv("NFO_VALIDATION", NFOValidationWarn))
+	if err != nil {
+		log.Fatalf("invalid NFO_VALIDATION: %v", err)
+	}
+
+	notifiers, err := notifiersFromEnv()
+	if err != nil {
+		log.Fatalf("invalid media server notifier config: %v", err)
+	}
+	notifyPathMap, err := parsePathMap(getEnv("NOTIFY_PATH_MAP", ""))
+	if err != nil {
+		log.Fatalf("invalid NOTIFY_PATH_MAP: %v", err)
+	}
+
+	minFreeSpace, err := parseSize(getEnv("MIN_FREE_SPACE", "1GB"))
+	if err != nil {
+		log.Fatalf("invalid MIN_FREE_SPACE: %v", err)
+	}
+
+	retentionFile := getEnv("RETENTION_FILE", "")
+	if retentionFile == "" && dataDir != "" {
+		retentionFile = filepath.Join(dataDir, "retention.json")
+	}
+	retention, err := loadRetentionRules(retentionFile, destinations)
+	if err != nil {
+		log.Fatalf("invalid retention rules: %v", err)
+	}
+
+	jobPrune := JobPruneConfig{Interval: getEnvDuration("JOB_PRUNE_INTERVAL", time.Hour)}
+	if v := os.Getenv("JOB_KEEP_COMPLETED"); v != "" {
+		if jobPrune.Completed, err = parseAge(v); err != nil {
+			log.Fatalf("invalid JOB_KEEP_COMPLETED: %v", err)
+		}
+	}
+	if v := os.Getenv("JOB_KEEP_FAILED"); v != "" {
+		if jobPrune.Failed, err = parseAge(v); err != nil {
+			log.Fatalf("invalid JOB_KEEP_FAILED: %v", err)
+		}
+	}
+	if v := os.Getenv("JOB_KEEP_MAX"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			jobPrune.MaxRecords = n
+		}
+	}
+
+	watchdog := WatchdogConfig{
+		StallTimeout: getEnvLimit("STALL_TIMEOUT", 10*time.Minute),
+		MaxRuntime:   getEnvLimit("MAX_RUNTIME", 0),
+	}
+
+	cookies, err := newCookieStore(dataDir, os.Getenv("COOKIE_KEY"))
+	if err != nil {
+		log.Fatalf("failed to open cookie store: %v", err)
+	}
+
+	users, err := newUserStore(dataDir)
+	if err != nil {
+		log.Fatalf("failed to load users: %v", err)
+	}
+	if err := users.bootstrapAdmin(getEnv("ADMIN_USER", "admin"), password); err != nil {
+		log.Fatalf("failed to create admin user: %v", err)
+	}
+	tokens, err := newTokenStore(dataDir)
+	if err != nil {
+		log.Fatalf("failed to load API tokens: %v", err)
+	}
+	authCfg := AuthConfig{
+		SessionTTL: getEnvDuration("SESSION_TTL", 24*time.Hour),
+		Lockout:    getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+	}
+	if v := os.Getenv("LOGIN_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			authCfg.MaxAttempts = n
+		}
+	}
+	if issuer := getEnv("OIDC_ISSUER", ""); issuer != "" {
+		authCfg.OIDC = &OIDCConfig{
+			Issuer:        issuer,
+			ClientID:      getEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:   getEnv("OIDC_REDIRECT_URL", ""),
+			Scopes:        splitList(getEnv("OIDC_SCOPES", "profile,email,groups")),
+			UsernameClaim: getEnv("OIDC_USERNAME_CLAIM", "preferred_username"),
+			GroupsClaim:   getEnv("OIDC_GROUPS_CLAIM", "groups"),
+			AdminGroups:   splitList(getEnv("OIDC_ADMIN_GROUPS", "")),
+			MemberGroups:  splitList(getEnv("OIDC_MEMBER_GROUPS", "")),
+		}
+		if err := validateOIDC(authCfg.OIDC); err != nil {
+			log.Fatalf("invalid OIDC config: %v", err)
+		}
+	}
+	auth := newAuthenticator(users, tokens, authCfg)
+
+	// Zero disables a limit, so these are parsed apart from the positive
+	// counts above
+	limits := map[string]int{"SUBMIT_RATE": 30, "SUBMIT_BURST": 10, "MAX_QUEUED_PER_USER": 0}
+	for key := range limits {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Fatalf("invalid %s: %q", key, v)
+			}
+			limits[key] = n
+		}
+	}
+	submitLimiter := newRateLimiter(limits["SUBMIT_RATE"], limits["SUBMIT_BURST"])
+
+	auditMaxSize, err := parseSize(getEnv("AUDIT_MAX_SIZE", "10MB"))
+	if err != nil {
+		log.Fatalf("invalid AUDIT_MAX_SIZE: %v", err)
+	}
+	auditKeep := 5
+	if v := os.Getenv("AUDIT_KEEP"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			auditKeep = n
+		}
+	}
+	audit, err := newAuditLog(dataDir, int64(auditMaxSize), auditKeep)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
+	}
+
+	tlsCfg := TLSConfig{
+		CertFile:       getEnv("TLS_CERT_FILE", ""),
+		KeyFile:        getEnv("TLS_KEY_FILE", ""),
+		ClientCAFile:   getEnv("TLS_CLIENT_CA_FILE", ""),
+		ClientAuth:     getEnv("TLS_CLIENT_AUTH", ""),
+		ReloadInterval: getEnvDuration("TLS_RELOAD_INTERVAL", time.Minute),
+		RedirectPort:   getEnv("TLS_REDIRECT_PORT", ""),
+	}
+	var certs *certReloader
+	var serverTLS *tls.Config
+	if tlsCfg.CertFile != "" || tlsCfg.KeyFile != "" {
+		if certs, err = newCertReloader(tlsCfg.CertFile, tlsCfg.KeyFile); err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		if serverTLS, err = newTLSConfig(tlsCfg, certs); err != nil {
+			log.Fatalf("invalid TLS config: %v", err)
+		}
+	} else if tlsCfg.ClientCAFile != "" || tlsCfg.RedirectPort != "" {
+		log.Fatalf("invalid TLS config: TLS_CERT_FILE and TLS_KEY_FILE are required")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mgr := NewDownloadManager(ctx, downloadDir, maxConcurrent, maxRetries, dataDir, outputDir)
+	mgr := NewDownloadManager(ctx, ManagerConfig{
+		DownloadDir:   downloadDir,
+		OutputDir:     outputDir,
+		DataDir:       dataDir,
+		MaxConcurrent: maxConcurrent,
+		MaxRetries:    maxRetries,
+		Destinations:  destinations,
+		Presets:       presets,
+		Collision:     collision,
+		LibraryRescan: getEnvDuration("LIBRARY_RESCAN_INTERVAL", 10*time.Minute),
+		NFOValidation: nfoValidation,
+		NFORepair:     getEnv("NFO_REPAIR", "true") == "true",
+		Notify: NotifyConfig{
+			Notifiers: notifiers,
+			Scoped:    getEnv("NOTIFY_SCOPE", "path") == "path",
+			PathMap:   notifyPathMap,
+			Delay:     getEnvDuration("NOTIFY_DELAY", 30*time.Second),
+			MaxWait:   getEnvDuration("NOTIFY_MAX_WAIT", 5*time.Minute),
+		},
+		Hooks: HookConfig{
+			PostDownload: getEnv("HOOK_POST_DOWNLOAD", ""),
+			PostMove:     getEnv("HOOK_POST_MOVE", ""),
+			Timeout:      getEnvDuration("HOOK_TIMEOUT", 10*time.Minute),
+			FailJob:      getEnv("HOOK_FAILURE", "warn") == "fail",
+		},
+		MinFreeSpace: minFreeSpace,
+		DiskCheck:    getEnvDuration("DISK_CHECK_INTERVAL", 30*time.Second),
+		Retention:    retention,
+		RetentionRun: getEnvDuration("RETENTION_INTERVAL", time.Hour),
+		AuditMaxSize: int64(auditMaxSize),
+		AuditKeep:    auditKeep,
+		JobPrune:     jobPrune,
+		Watchdog:     watchdog,
+		Binary:       getEnv("YTDLP_NFO_BIN", "ytdlp-nfo"),
+		Extras:       extras,
+		Cookies:      cookies,
+		Proxies: ProxyConfig{
+			Proxies:  proxies,
+			Interval: getEnvDuration("PROXY_CHECK_INTERVAL", time.Minute),
+		},
+		URLPolicy:        urlPolicy,
+		MaxQueuedPerUser: limits["MAX_QUEUED_PER_USER"],
+		QuotaExempt: func(owner string) bool {
+			u, ok := users.Get(owner)
+			return ok && u.Role == RoleAdmin
+		},
+	})
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("POST /api/download", handleSubmit(mgr))
-	mux.HandleFunc("POST /api/download/bulk", handleBulkSubmit(mgr))
+	mux.HandleFunc("POST /api/download", rateLimited(submitLimiter, handleSubmit(mgr)))
+	mux.HandleFunc("POST /api/download/bulk", rateLimited(submitLimiter, handleBulkSubmit(mgr)))
 	mux.HandleFunc("GET /api/jobs", handleListJobs(mgr))
 	mux.HandleFunc("GET /api/jobs/{id}", handleJobStatus(mgr))
 	mux.HandleFunc("GET /api/jobs/{id}/stream", handleJobStream(mgr))
-	mux.HandleFunc("POST /api/jobs/{id}/retry", handleRetryJob(mgr))
+	mux.HandleFunc("GET /api/jobs/{id}/files", handleJobFiles(mgr))
+	mux.HandleFunc("GET /api/jobs/{id}/files/{n}", handleJobFile(mgr))
+	mux.HandleFunc("GET /api/jobs/{id}/thumbnail", handleJobThumbnail(mgr))
+	mux.HandleFunc("POST /api/jobs/{id}/retry", rateLimited(submitLimiter, handleRetryJob(mgr)))
 	mux.HandleFunc("DELETE /api/jobs/{id}", handleDeleteJob(mgr))
 	mux.HandleFunc("DELETE /api/jobs", handleDeleteAllJobs(mgr))
-	mux.HandleFunc("GET /api/auth", handleAuth())
-	mux.HandleFunc("GET /api/version", handleVersion())
+	mux.HandleFunc("GET /api/auth", handleAuth(auth))
+	mux.HandleFunc("GET /api/login", handleLoginMethods(auth))
+	mux.HandleFunc("POST /api/login", handleLogin(auth))
+	mux.HandleFunc("GET /api/oidc/login", handleOIDCLogin(auth))
+	mux.HandleFunc("GET /api/oidc/callback", handleOIDCCallback(auth))
+	mux.HandleFunc("POST /api/logout", handleLogout(auth))
+	mux.HandleFunc("GET /api/users", requireAdmin(handleListUsers(auth)))
+	mux.HandleFunc("POST /api/users", requireAdmin(handleCreateUser(auth)))
+	mux.HandleFunc("PATCH /api/users/{name}", handleUpdateUser(auth))
+	mux.HandleFunc("DELETE /api/users/{name}", requireAdmin(handleDeleteUser(auth)))
+	mux.HandleFunc("GET /api/tokens", handleListTokens(auth))
+	mux.HandleFunc("POST /api/tokens", handleCreateToken(auth))
+	mux.HandleFunc("DELETE /api/tokens/{id}", handleDeleteToken(auth))
+	mux.HandleFunc("GET /api/version", handleVersion(mgr))
+	mux.HandleFunc("GET /api/options", handleOptions(mgr))
+	mux.HandleFunc("GET /api/library", handleLibrary(mgr))
+	mux.HandleFunc("GET /api/library/search", handleLibrarySearch(mgr))
+	mux.HandleFunc("POST /api/library/rescan", handleLibraryRescan(mgr))
+	mux.HandleFunc("GET /api/disk", handleDisk(mgr))
+	mux.HandleFunc("GET /api/cookies", handleListCookies(mgr))
+	mux.HandleFunc("POST /api/cookies", requireAdmin(handleCookieUpload(mgr)))
+	mux.HandleFunc("DELETE /api/cookies/{name}", requireAdmin(handleDeleteCookies(mgr)))
+	mux.HandleFunc("GET /api/proxies", handleProxies(mgr))
+	mux.HandleFunc("GET /api/archive", handleArchiveList(mgr))
+	mux.HandleFunc("GET /api/archive/export", handleArchiveExport(mgr))
+	mux.HandleFunc("POST /api/archive/import", requireAdmin(handleArchiveImport(mgr)))
+	mux.HandleFunc("DELETE /api/archive/{extractor}/{id}", requireAdmin(handleArchiveDelete(mgr)))
+	mux.HandleFunc("DELETE /api/jobs/{id}/archive", handleJobArchiveDelete(mgr))
+	mux.HandleFunc("GET /api/retention/preview", requireAdmin(handleRetentionPreview(mgr)))
+	mux.HandleFunc("GET /api/retention/audit", requireAdmin(handleRetentionAudit(mgr)))
+	mux.HandleFunc("GET /api/audit", requireAdmin(handleAudit(audit)))
 
 	staticSub, err := fs.Sub(staticFiles, "static")
 	if err != nil {
@@ -98,8 +366,27 @@ func main() {
 	mux.Handle("GET /", http.FileServer(http.FS(staticSub)))
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: authMiddleware(mux, password),
+		Addr:              ":" + port,
+		Handler:           authMiddleware(auditMiddleware(mux, audit), auth),
+		TLSConfig:         serverTLS,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	var redirectSrv *http.Server
+	if certs != nil {
+		go certs.watch(ctx, tlsCfg.ReloadInterval)
+		if tlsCfg.RedirectPort != "" {
+			redirectSrv = &http.Server{
+				Addr:              ":" + tlsCfg.RedirectPort,
+				Handler:           redirectToHTTPS(port),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				log.Printf("Redirecting HTTP on :%s to HTTPS", tlsCfg.RedirectPort)
+				if err := redirectSrv.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatalf("HTTP redirect server error: %v", err)
+				}
+			}()
+		}
 	}
 
 	sigCh := make(chan os.Signal, 1)
@@ -109,8 +396,25 @@ func main() {
 		if outputDir != "" {
 			log.Printf("Move-on-complete enabled -> %s", outputDir)
 		}
-		log.Printf("Starting server on :%s (downloads -> %s, maxConcurrent: %d)", port, downloadDir, maxConcurrent)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		for _, n := range notifiers {
+			log.Printf("Media server refresh enabled -> %s", n.Name())
+		}
+		if authCfg.OIDC != nil {
+			log.Printf("Single sign-on enabled -> %s", authCfg.OIDC.Issuer)
+		}
+		for _, name := range destinationNames(destinations) {
+			log.Printf("Destination %q -> %s", name, destinations[name])
+		}
+		var err error
+		if certs != nil {
+			log.Printf("Starting HTTPS server on :%s (downloads -> %s, maxConcurrent: %d)", port, downloadDir, maxConcurrent)
+			// The certificate comes from srv.TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting server on :%s (downloads -> %s, maxConcurrent: %d)", port, downloadDir, maxConcurrent)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
@@ -121,6 +425,9 @@ func main() {
 	// 1. Stop accepting new HTTP requests, drain in-flight (5s max)
 	httpCtx, httpCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer httpCancel()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(httpCtx)
+	}
 	srv.Shutdown(httpCtx)
 
 	// 2. Cancel all downloads and backoff sleeps
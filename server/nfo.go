@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// nfoDocument covers the Kodi-style fields ytdlp-nfo writes. The root
+// element is not checked so episodedetails, movie and musicvideo all parse.
+type nfoDocument struct {
+	XMLName   xml.Name
+	Title     string        `xml:"title"`
+	Plot      string        `xml:"plot"`
+	Aired     string        `xml:"aired"`
+	Premiered string        `xml:"premiered"`
+	ShowTitle string        `xml:"showtitle"`
+	Studio    []string      `xml:"studio"`
+	Director  []string      `xml:"director"`
+	UniqueIDs []nfoUniqueID `xml:"uniqueid"`
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default string `xml:"default,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// nfoMetadata is the subset of NFO data used for path templates.
+type nfoMetadata struct {
+	Title      string
+	Uploader   string
+	UploadDate string
+	ID         string
+}
+
+// readNFO parses the NFO file at path.
+func readNFO(path string) (*nfoDocument, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc nfoDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// metadata extracts template fields, preferring the most specific tag available.
+func (d *nfoDocument) metadata() nfoMetadata {
+	meta := nfoMetadata{
+		Title:      strings.TrimSpace(d.Title),
+		UploadDate: strings.TrimSpace(d.Aired),
+	}
+	if meta.UploadDate == "" {
+		meta.UploadDate = strings.TrimSpace(d.Premiered)
+	}
+	for _, v := range append(append([]string{d.ShowTitle}, d.Studio...), d.Director...) {
+		if v = strings.TrimSpace(v); v != "" {
+			meta.Uploader = v
+			break
+		}
+	}
+	for _, u := range d.UniqueIDs {
+		v := strings.TrimSpace(u.Value)
+		if v == "" {
+			continue
+		}
+		if meta.ID == "" || u.Default == "true" {
+			meta.ID = v
+		}
+	}
+	return meta
+}
+
+// NFO validation levels.
+const (
+	NFOValidationOff    = "off"
+	NFOValidationWarn   = "warn"
+	NFOValidationStrict = "strict"
+)
+
+func parseNFOValidation(s string) (string, error) {
+	switch s {
+	case NFOValidationOff, NFOValidationWarn, NFOValidationStrict:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown NFO validation level %q", s)
+}
+
+// NFOIssue is a problem found while validating a job's NFO files.
+type NFOIssue struct {
+	File     string `json:"file"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+func (i NFOIssue) String() string {
+	if i.Repaired {
+		return fmt.Sprintf("%s: %s (repaired)", i.File, i.Problem)
+	}
+	return fmt.Sprintf("%s: %s", i.File, i.Problem)
+}
+
+// validateNFOs checks every video in dir for a well-formed NFO with the
+// fields Jellyfin needs and a thumbnail. With repair set, a missing NFO or
+// title is filled in from the file name.
+func validateNFOs(dir string, repair bool) ([]NFOIssue, error) {
+	files, err := collectFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		present[f] = true
+	}
+
+	var issues []NFOIssue
+	checked := make(map[string]bool)
+	for _, f := range files {
+		if !isVideoFile(f) {
+			continue
+		}
+		stem := strings.TrimSuffix(f, filepath.Ext(f))
+		nfo := stem + ".nfo"
+		title := filepath.Base(stem)
+		checked[nfo] = true
+
+		if !hasThumbnail(stem, files) {
+			issues = append(issues, NFOIssue{File: f, Problem: "missing thumbnail"})
+		}
+
+		if !present[nfo] {
+			issue := NFOIssue{File: f, Problem: "missing NFO"}
+			if repair {
+				issue.Repaired = writeMinimalNFO(filepath.Join(dir, nfo), title) == nil
+			}
+			issues = append(issues, issue)
+			continue
+		}
+
+		doc, err := readNFO(filepath.Join(dir, nfo))
+		if err != nil {
+			issues = append(issues, NFOIssue{File: nfo, Problem: fmt.Sprintf("malformed XML: %v", err)})
+			continue
+		}
+		if strings.TrimSpace(doc.Title) == "" {
+			issue := NFOIssue{File: nfo, Problem: "missing title"}
+			if repair {
+				issue.Repaired = insertNFOTitle(filepath.Join(dir, nfo), title) == nil
+			}
+			issues = append(issues, issue)
+		}
+		if strings.TrimSpace(doc.Plot) == "" {
+			issues = append(issues, NFOIssue{File: nfo, Problem: "missing plot"})
+		}
+		if strings.TrimSpace(doc.Aired) == "" && strings.TrimSpace(doc.Premiered) == "" {
+			issues = append(issues, NFOIssue{File: nfo, Problem: "missing aired date"})
+		}
+		if doc.metadata().ID == "" {
+			issues = append(issues, NFOIssue{File: nfo, Problem: "missing uniqueid"})
+		}
+	}
+
+	// Folder-level NFOs (tvshow.nfo, season.nfo) only need to parse
+	for _, f := range files {
+		if mediaType(f) != MediaNFO || checked[f] {
+			continue
+		}
+		if _, err := readNFO(filepath.Join(dir, f)); err != nil {
+			issues = append(issues, NFOIssue{File: f, Problem: fmt.Sprintf("malformed XML: %v", err)})
+		}
+	}
+	return issues, nil
+}
+
+func hasThumbnail(stem string, files []string) bool {
+	for _, f := range files {
+		if mediaType(f) != MediaThumbnail {
+			continue
+		}
+		base := strings.TrimSuffix(f, filepath.Ext(f))
+		if base == stem || base == stem+"-thumb" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMinimalNFO(path, title string) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<episodedetails>\n  <title>")
+	xml.EscapeText(&buf, []byte(title))
+	buf.WriteString("</title>\n</episodedetails>\n")
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+var emptyTitleRegex = regexp.MustCompile(`<title\s*/>|<title>\s*</title>`)
+
+// insertNFOTitle adds a <title> element right after the root start tag,
+// dropping any empty one and leaving the rest of the document untouched.
+func insertNFOTitle(path, title string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = emptyTitleRegex.ReplaceAll(data, nil)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			break
+		}
+	}
+	offset := dec.InputOffset()
+
+	var buf bytes.Buffer
+	buf.Write(data[:offset])
+	buf.WriteString("\n  <title>")
+	xml.EscapeText(&buf, []byte(title))
+	buf.WriteString("</title>")
+	buf.Write(data[offset:])
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
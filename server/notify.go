@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaNotifier asks a media server to pick up new files. An empty paths
+// slice requests a full library scan.
+type mediaNotifier interface {
+	Name() string
+	Refresh(ctx context.Context, paths []string) error
+}
+
+// NotifyResult records one refresh request made on behalf of a job.
+type NotifyResult struct {
+	Server string    `json:"server"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// jellyfinNotifier talks to Jellyfin and Emby, which share the refresh API.
+type jellyfinNotifier struct {
+	name    string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (n *jellyfinNotifier) Name() string { return n.name }
+
+func (n *jellyfinNotifier) Refresh(ctx context.Context, paths []string) error {
+	endpoint, body := "/Library/Refresh", []byte(nil)
+	if len(paths) > 0 {
+		type update struct {
+			Path       string `json:"Path"`
+			UpdateType string `json:"UpdateType"`
+		}
+		updates := make([]update, len(paths))
+		for i, p := range paths {
+			updates[i] = update{Path: p, UpdateType: "Created"}
+		}
+		endpoint = "/Library/Media/Updated"
+		body, _ = json.Marshal(map[string]any{"Updates": updates})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.baseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Emby-Token", n.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return doNotifyRequest(n.client, req)
+}
+
+// plexNotifier refreshes the Plex sections whose locations contain the
+// given paths, or every section for a full scan.
+type plexNotifier struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func (n *plexNotifier) Name() string { return "plex" }
+
+type plexSection struct {
+	Key      string `json:"key"`
+	Location []struct {
+		Path string `json:"path"`
+	} `json:"Location"`
+}
+
+func (n *plexNotifier) sections(ctx context.Context) ([]plexSection, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.baseURL+"/library/sections", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Plex-Token", n.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("list sections: %s", resp.Status)
+	}
+	var body struct {
+		MediaContainer struct {
+			Directory []plexSection `json:"Directory"`
+		} `json:"MediaContainer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("list sections: %v", err)
+	}
+	return body.MediaContainer.Directory, nil
+}
+
+func (n *plexNotifier) Refresh(ctx context.Context, paths []string) error {
+	sections, err := n.sections(ctx)
+	if err != nil {
+		return err
+	}
+
+	refresh := func(key, path string) error {
+		u := n.baseURL + "/library/sections/" + url.PathEscape(key) + "/refresh"
+		if path != "" {
+			u += "?path=" + url.QueryEscape(path)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Plex-Token", n.token)
+		return doNotifyRequest(n.client, req)
+	}
+
+	if len(paths) == 0 {
+		for _, s := range sections {
+			if err := refresh(s.Key, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Paths outside every section are reported together once the others
+	// have been refreshed
+	var unmatched []string
+	for _, p := range paths {
+		matched := false
+		for _, s := range sections {
+			for _, loc := range s.Location {
+				if withinRoot(loc.Path, p) {
+					matched = true
+					if err := refresh(s.Key, p); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if !matched {
+			unmatched = append(unmatched, p)
+		}
+	}
+	if len(unmatched) > 0 {
+		return fmt.Errorf("no Plex section contains %s", strings.Join(unmatched, ", "))
+	}
+	return nil
+}
+
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil
+}
+
+// NotifyConfig configures media server refreshes.
+type NotifyConfig struct {
+	Notifiers []mediaNotifier
+	Scoped    bool              // refresh only the affected folders
+	PathMap   map[string]string // local prefix -> media server prefix
+	Delay     time.Duration     // quiet period before a batch is sent
+	MaxWait   time.Duration     // upper bound on how long a batch is held
+}
+
+// notifiersFromEnv builds the notifiers configured via NOTIFY_* variables.
+func notifiersFromEnv() ([]mediaNotifier, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var notifiers []mediaNotifier
+	for _, kind := range []string{"jellyfin", "emby"} {
+		prefix := "NOTIFY_" + strings.ToUpper(kind)
+		base := strings.TrimRight(getEnv(prefix+"_URL", ""), "/")
+		if base == "" {
+			continue
+		}
+		key := getEnv(prefix+"_API_KEY", "")
+		if key == "" {
+			return nil, fmt.Errorf("%s_URL is set but %s_API_KEY is not", prefix, prefix)
+		}
+		notifiers = append(notifiers, &jellyfinNotifier{name: kind, baseURL: base, apiKey: key, client: client})
+	}
+	if base := strings.TrimRight(getEnv("NOTIFY_PLEX_URL", ""), "/"); base != "" {
+		token := getEnv("NOTIFY_PLEX_TOKEN", "")
+		if token == "" {
+			return nil, fmt.Errorf("NOTIFY_PLEX_URL is set but NOTIFY_PLEX_TOKEN is not")
+		}
+		notifiers = append(notifiers, &plexNotifier{baseURL: base, token: token, client: client})
+	}
+	return notifiers, nil
+}
+
+// parsePathMap parses "local=remote" pairs separated by commas.
+func parsePathMap(s string) (map[string]string, error) {
+	pm := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		local, remote, ok := strings.Cut(entry, "=")
+		if !ok || local == "" || remote == "" {
+			return nil, fmt.Errorf("invalid path mapping %q, expected /local=/remote", entry)
+		}
+		pm[filepath.Clean(local)] = remote
+	}
+	return pm, nil
+}
+
+// notifyBatcher collects completed jobs and refreshes the media servers
+// once a quiet period has passed, so bulk imports cause a single scan.
+type notifyBatcher struct {
+	cfg NotifyConfig
+	ctx context.Context
+	// onDone runs after each batch so results can be persisted.
+	onDone func()
+
+	mu      sync.Mutex
+	paths   map[string]bool
+	jobs    []*Job
+	timer   *time.Timer
+	first   time.Time
+	flushMu sync.Mutex
+}
+
+func newNotifyBatcher(ctx context.Context, cfg NotifyConfig, onDone func()) *notifyBatcher {
+	return &notifyBatcher{cfg: cfg, ctx: ctx, onDone: onDone, paths: make(map[string]bool)}
+}
+
+// Add queues the folders holding the given files for refresh.
+func (b *notifyBatcher) Add(job *Job, files []ProducedFile) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, f := range files {
+		b.paths[b.mapPath(filepath.Dir(f.Path))] = true
+	}
+	b.jobs = append(b.jobs, job)
+
+	now := time.Now()
+	if b.timer == nil {
+		b.first = now
+		b.timer = time.AfterFunc(b.cfg.Delay, b.Flush)
+		return
+	}
+	// Keep extending the quiet period, but never past MaxWait
+	wait := b.cfg.Delay
+	if remaining := b.first.Add(b.cfg.MaxWait).Sub(now); remaining < wait {
+		wait = max(remaining, 0)
+	}
+	b.timer.Reset(wait)
+}
+
+func (b *notifyBatcher) mapPath(p string) string {
+	for local, remote := range b.cfg.PathMap {
+		if withinRoot(local, p) {
+			rel, _ := filepath.Rel(local, p)
+			if rel == "." {
+				return remote
+			}
+			return strings.TrimRight(remote, "/") + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return p
+}
+
+// Flush sends the pending batch immediately.
+func (b *notifyBatcher) Flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	jobs := b.jobs
+	paths := make([]string, 0, len(b.paths))
+	for p := range b.paths {
+		paths = append(paths, p)
+	}
+	b.jobs = nil
+	b.paths = make(map[string]bool)
+	b.mu.Unlock()
+
+	if len(jobs) == 0 {
+		return
+	}
+	sort.Strings(paths)
+	if !b.cfg.Scoped {
+		paths = nil
+	}
+
+	// Flushes during shutdown still get a short grace period
+	ctx := b.ctx
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	for _, n := range b.cfg.Notifiers {
+		res := NotifyResult{Server: n.Name(), Time: time.Now()}
+		line := fmt.Sprintf("Requested %s library refresh", n.Name())
+		if err := n.Refresh(ctx, paths); err != nil {
+			res.Error = err.Error()
+			line = fmt.Sprintf("%s library refresh failed: %v", n.Name(), err)
+			log.Printf("notify: %s", line)
+		} else {
+			log.Printf("notify: %s refreshed %d path(s) for %d job(s)", n.Name(), len(paths), len(jobs))
+		}
+		for _, job := range jobs {
+			job.mu.Lock()
+			job.Notifications = append(job.Notifications, res)
+			job.mu.Unlock()
+			job.appendLine(line)
+		}
+	}
+	if b.onDone != nil {
+		b.onDone()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingServer records the requests a notifier makes.
+type recordingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string // method, path and query
+	bodies   []string
+}
+
+func newRecordingServer(t *testing.T, handler http.HandlerFunc) *recordingServer {
+	t.Helper()
+	rs := &recordingServer{}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rs.mu.Lock()
+		rs.requests = append(rs.requests, r.Method+" "+r.URL.RequestURI())
+		rs.bodies = append(rs.bodies, string(body))
+		rs.mu.Unlock()
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(rs.Close)
+	return rs
+}
+
+func (rs *recordingServer) recorded() ([]string, []string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]string(nil), rs.requests...), append([]string(nil), rs.bodies...)
+}
+
+func TestJellyfinRefresh(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Emby-Token") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	n := &jellyfinNotifier{name: "jellyfin", baseURL: srv.URL, apiKey: "key", client: srv.Client()}
+
+	if err := n.Refresh(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Refresh(context.Background(), []string{"/media/tv"}); err != nil {
+		t.Fatal(err)
+	}
+	requests, bodies := srv.recorded()
+	want := []string{"POST /Library/Refresh", "POST /Library/Media/Updated"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Fatalf("requests = %q, want %q", requests, want)
+	}
+	var update struct {
+		Updates []struct{ Path, UpdateType string }
+	}
+	if err := json.Unmarshal([]byte(bodies[1]), &update); err != nil || len(update.Updates) != 1 || update.Updates[0].Path != "/media/tv" {
+		t.Errorf("scoped refresh sent %s", bodies[1])
+	}
+
+	n.apiKey = "wrong"
+	if err := n.Refresh(context.Background(), nil); err == nil {
+		t.Error("rejected API key reported as success")
+	}
+}
+
+func TestPlexRefresh(t *testing.T) {
+	srv := newRecordingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/library/sections" {
+			w.Write([]byte(`{"MediaContainer":{"Directory":[
+				{"key":"1","Location":[{"path":"/media/tv"}]},
+				{"key":"2","Location":[{"path":"/media/movies"}]}]}}`))
+		}
+	})
+	n := &plexNotifier{baseURL: srv.URL, token: "token", client: srv.Client()}
+
+	if err := n.Refresh(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	requests, _ := srv.recorded()
+	want := []string{"GET /library/sections", "GET /library/sections/1/refresh", "GET /library/sections/2/refresh"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("full scan requests = %q, want %q", requests, want)
+	}
+
+	// Unmatched paths are reported together after the matched ones refresh
+	srv.mu.Lock()
+	srv.requests = nil
+	srv.mu.Unlock()
+	err := n.Refresh(context.Background(), []string{"/elsewhere/a", "/media/tv/Show", "/elsewhere/b", "/media/movies/Film"})
+	if err == nil || !strings.Contains(err.Error(), "/elsewhere/a, /elsewhere/b") {
+		t.Errorf("err = %v, want both unmatched paths", err)
+	}
+	requests, _ = srv.recorded()
+	want = []string{
+		"GET /library/sections",
+		"GET /library/sections/1/refresh?path=%2Fmedia%2Ftv%2FShow",
+		"GET /library/sections/2/refresh?path=%2Fmedia%2Fmovies%2FFilm",
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("scoped requests = %q, want %q", requests, want)
+	}
+}
+
+func TestNotifyBatcher(t *testing.T) {
+	srv := newRecordingServer(t, nil)
+	n := &jellyfinNotifier{name: "jellyfin", baseURL: srv.URL, apiKey: "key", client: srv.Client()}
+	saved := make(chan struct{}, 1)
+	b := newNotifyBatcher(context.Background(), NotifyConfig{
+		Notifiers: []mediaNotifier{n},
+		Scoped:    true,
+		PathMap:   map[string]string{"/downloads": "/media"},
+		Delay:     50 * time.Millisecond,
+		MaxWait:   time.Second,
+	}, func() { saved <- struct{}{} })
+
+	a, c := &Job{ID: "a"}, &Job{ID: "c"}
+	b.Add(a, []ProducedFile{{Path: "/downloads/tv/Show/ep1.mkv"}})
+	b.Add(c, []ProducedFile{{Path: "/downloads/tv/Show/ep2.mkv"}, {Path: "/other/film.mkv"}})
+	select {
+	case <-saved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch never sent")
+	}
+
+	requests, bodies := srv.recorded()
+	if len(requests) != 1 {
+		t.Fatalf("requests = %q, want a single refresh for the batch", requests)
+	}
+	var update struct {
+		Updates []struct{ Path string }
+	}
+	json.Unmarshal([]byte(bodies[0]), &update)
+	var paths []string
+	for _, u := range update.Updates {
+		paths = append(paths, u.Path)
+	}
+	if want := []string{"/media/tv/Show", "/other"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("refreshed %q, want %q", paths, want)
+	}
+	for _, job := range []*Job{a, c} {
+		job.mu.Lock()
+		if len(job.Notifications) != 1 || job.Notifications[0].Error != "" {
+			t.Errorf("job %s notifications = %+v", job.ID, job.Notifications)
+		}
+		job.mu.Unlock()
+	}
+}
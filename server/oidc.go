@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcStateCookie binds a login in progress to the browser that started it.
+const oidcStateCookie = "ytdlp_oidc_state"
+
+// oidcLoginTTL is how long a user has to complete the identity provider's
+// login page.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcMaxPendingLogins caps the logins started but not yet finished.
+const oidcMaxPendingLogins = 1000
+
+// oidcClockSkew is tolerated between this server and the identity provider.
+const oidcClockSkew = time.Minute
+
+// jwksRefreshInterval limits how often an unknown key ID refetches the
+// provider's keys.
+const jwksRefreshInterval = time.Minute
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string   // must point at /api/oidc/callback
+	Scopes        []string // requested in addition to openid
+	UsernameClaim string
+	GroupsClaim   string
+	AdminGroups   []string
+	MemberGroups  []string // empty lets every user in as a member
+}
+
+// splitList parses a comma-separated setting.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// validateOIDC checks the settings that cannot be discovered.
+func validateOIDC(cfg *OIDCConfig) error {
+	if cfg.ClientID == "" {
+		return fmt.Errorf("OIDC_CLIENT_ID is required")
+	}
+	u, err := url.Parse(cfg.RedirectURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OIDC_REDIRECT_URL must be an absolute http(s) URL")
+	}
+	if u, err := url.Parse(cfg.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("OIDC_ISSUER must be an http(s) URL")
+	}
+	return nil
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// oidcProvider performs the authorization code flow with PKCE and
+// validates ID tokens. Discovery and keys are fetched lazily so the server
+// starts while the provider is unreachable.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	// fetchMu serializes requests to the provider; mu guards the fields
+	// below and is never held across network I/O
+	fetchMu   sync.Mutex
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+	logins    map[string]*oidcLogin // by state
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+		logins: make(map[string]*oidcLogin),
+	}
+}
+
+func (o *oidcProvider) getJSON(rawURL string, v any) error {
+	resp, err := o.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover returns the provider metadata, fetching it on first use.
+func (o *oidcProvider) discover() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	d := o.discovery
+	o.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	o.fetchMu.Lock()
+	defer o.fetchMu.Unlock()
+	// Another login may have fetched it while this one waited
+	o.mu.Lock()
+	d = o.discovery
+	o.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = new(oidcDiscovery)
+	if err := o.getJSON(strings.TrimSuffix(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if d.Issuer != o.cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", d.Issuer, o.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+	}
+	o.mu.Lock()
+	o.discovery = d
+	o.mu.Unlock()
+	return d, nil
+}
+
+// Begin starts a login and returns its state and the URL of the provider's
+// login page.
+func (o *oidcProvider) Begin() (state, authURL string, err error) {
+	d, err := o.discover()
+	if err != nil {
+		return "", "", err
+	}
+	var nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomToken(); err != nil {
+			return "", "", err
+		}
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	o.mu.Lock()
+	now := time.Now()
+	for s, l := range o.logins {
+		if now.After(l.expires) {
+			delete(o.logins, s)
+		}
+	}
+	// Anyone can start logins, so past the cap the oldest pending one
+	// makes room
+	if len(o.logins) >= oidcMaxPendingLogins {
+		var oldest string
+		for s, l := range o.logins {
+			if oldest == "" || l.expires.Before(o.logins[oldest].expires) {
+				oldest = s
+			}
+		}
+		delete(o.logins, oldest)
+	}
+	o.logins[state] = &oidcLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTTL)}
+	o.mu.Unlock()
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, o.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return state, d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// oidcIdentity is what a validated ID token says about the user.
+type oidcIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// Finish redeems the authorization code of the login started with state
+// and returns the validated identity.
+func (o *oidcProvider) Finish(state, code string) (oidcIdentity, error) {
+	o.mu.Lock()
+	login, ok := o.logins[state]
+	delete(o.logins, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return oidcIdentity{}, fmt.Errorf("login expired, please try again")
+	}
+	d, err := o.discover()
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"code_verifier": {login.verifier},
+		"client_id":     {o.cfg.ClientID},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("token request: %v", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return oidcIdentity{}, fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return oidcIdentity{}, fmt.Errorf("token request failed: %s %s", resp.Status, tok.Error)
+	}
+
+	claims, err := o.verify(tok.IDToken, d.JWKSURI)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	if err := o.checkClaims(claims, login.nonce); err != nil {
+		return oidcIdentity{}, err
+	}
+	return o.identity(claims)
+}
+
+// verify checks the signature of a JWT against the provider's keys and
+// returns its claims.
+func (o *oidcProvider) verify(token, jwksURI string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %v", err)
+	}
+	key, err := o.key(header.Kid, jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %v", err)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key with kid, refetching the key set when the
+// provider has rotated its keys.
+func (o *oidcProvider) key(kid, jwksURI string) (crypto.PublicKey, error) {
+	lookup := func() (crypto.PublicKey, bool, bool) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		k, ok := o.keys[kid]
+		return k, ok, time.Since(o.keysAt) < jwksRefreshInterval
+	}
+	if k, ok, _ := lookup(); ok {
+		return k, nil
+	}
+
+	o.fetchMu.Lock()
+	defer o.fetchMu.Unlock()
+	// The set may have been refreshed while this login waited
+	k, ok, fresh := lookup()
+	if ok {
+		return k, nil
+	} else if fresh {
+		return nil, fmt.Errorf("unknown ID token key %q", kid)
+	}
+	o.mu.Lock()
+	o.keysAt = time.Now()
+	o.mu.Unlock()
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := o.getJSON(jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, raw := range set.Keys {
+		id, k, err := parseJWK(raw)
+		if err != nil {
+			log.Printf("oidc: skipping signing key: %v", err)
+			continue
+		}
+		keys[id] = k
+	}
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+// parseJWK reads an RSA or P-256 signing key from a JSON Web Key.
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q is not for signing", jwk.Kid)
+	}
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key %q: invalid parameter", jwk.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := num(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := num(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return "", nil, fmt.Errorf("key %q: invalid exponent", jwk.Kid)
+		}
+		return jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return "", nil, fmt.Errorf("key %q: unsupported curve %q", jwk.Kid, jwk.Crv)
+		}
+		x, err := num(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := num(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !k.Curve.IsOnCurve(x, y) {
+			return "", nil, fmt.Errorf("key %q: point not on curve", jwk.Kid)
+		}
+		return jwk.Kid, k, nil
+	}
+	return "", nil, fmt.Errorf("key %q: unsupported key type %q", jwk.Kid, jwk.Kty)
+}
+
+// checkClaims validates issuer, audience, lifetime and nonce of an ID
+// token.
+func (o *oidcProvider) checkClaims(claims map[string]any, nonce string) error {
+	if iss, _ := claims["iss"].(string); iss != o.cfg.Issuer {
+		return fmt.Errorf("ID token issued by %q", iss)
+	}
+	var aud []string
+	switch v := claims["aud"].(type) {
+	case string:
+		aud = []string{v}
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+	if !slices.Contains(aud, o.cfg.ClientID) {
+		return fmt.Errorf("ID token is not for this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != o.cfg.ClientID {
+		return fmt.Errorf("ID token is not for this client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return fmt.Errorf("ID token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(oidcClockSkew)) {
+		return fmt.Errorf("ID token issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return fmt.Errorf("ID token nonce mismatch")
+	}
+	return nil
+}
+
+func (o *oidcProvider) identity(claims map[string]any) (oidcIdentity, error) {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return oidcIdentity{}, fmt.Errorf("ID token has no subject")
+	}
+	name, _ := claims[o.cfg.UsernameClaim].(string)
+	if name == "" {
+		name = sub
+	}
+	if !usernameRegex.MatchString(name) {
+		return oidcIdentity{}, fmt.Errorf("%s claim %q is not a valid username", o.cfg.UsernameClaim, name)
+	}
+	iss, _ := claims["iss"].(string)
+	id := oidcIdentity{Issuer: iss, Subject: sub, Username: name}
+	switch v := claims[o.cfg.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{v}
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+var errNotInGroups = errors.New("your account is not in a group allowed to use this server")
+
+// Role maps the user's groups to a role.
+func (o *oidcProvider) Role(id oidcIdentity) (string, error) {
+	inAny := func(groups []string) bool {
+		return slices.ContainsFunc(id.Groups, func(g string) bool { return slices.Contains(groups, g) })
+	}
+	switch {
+	case inAny(o.cfg.AdminGroups):
+		return RoleAdmin, nil
+	case len(o.cfg.MemberGroups) == 0 || inAny(o.cfg.MemberGroups):
+		return RoleMember, nil
+	}
+	return "", errNotInGroups
+}
+
+type loginMethods struct {
+	Password bool `json:"password"`
+	OIDC     bool `json:"oidc"`
+}
+
+// handleLoginMethods tells the login page whether to offer single sign-on.
+func handleLoginMethods(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, loginMethods{Password: true, OIDC: auth.oidc != nil})
+	}
+}
+
+// handleOIDCLogin redirects the browser to the identity provider.
+func handleOIDCLogin(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.oidc == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "single sign-on is not configured"})
+			return
+		}
+		state, authURL, err := auth.oidc.Begin()
+		if err != nil {
+			log.Printf("oidc: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "identity provider unavailable"})
+			return
+		}
+		// Lax, since the provider redirects back with a cross-site navigation
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/oidc/",
+			MaxAge:   int(oidcLoginTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   secureRequest(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// handleOIDCCallback completes a login, records the user with the role
+// their groups map to and starts a session.
+func handleOIDCCallback(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.oidc == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "single sign-on is not configured"})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1, HttpOnly: true, Secure: secureRequest(r)})
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			http.Error(w, "Login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+			return
+		}
+		state := q.Get("state")
+		c, err := r.Cookie(oidcStateCookie)
+		if err != nil || state == "" || c.Value != state {
+			http.Error(w, "Login failed: state mismatch, please try again", http.StatusBadRequest)
+			return
+		}
+		id, err := auth.oidc.Finish(state, q.Get("code"))
+		if err != nil {
+			log.Printf("oidc: login failed: %v", err)
+			http.Error(w, "Login failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		auditUser(r, id.Username)
+		role, err := auth.oidc.Role(id)
+		if err != nil {
+			log.Printf("oidc: %s denied, groups %v", id.Username, id.Groups)
+			http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := auth.users.UpsertExternal(id.Username, id.Issuer, id.Subject, role); err != nil {
+			log.Printf("oidc: %s: %v", id.Username, err)
+			http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		sid, _, err := auth.sessions.Create(id.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, r, sid)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
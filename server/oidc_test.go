@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID provider: its authorize endpoint logs the
+// configured user in immediately and redirects back with a code.
+type mockIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu       sync.Mutex
+	username string
+	subject  string // defaults to one derived from username
+	groups   []string
+	codes    map[string]url.Values // authorize request by code
+}
+
+func newMockIssuer(t *testing.T, clientID string) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, clientID: clientID, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != clientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		m.mu.Lock()
+		m.codes[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+q.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		auth, ok := m.codes[r.PostForm.Get("code")]
+		delete(m.codes, r.PostForm.Get("code"))
+		username, subject, groups := m.username, m.subject, m.groups
+		m.mu.Unlock()
+		if subject == "" {
+			subject = "sub-" + username
+		}
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge") {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": m.sign(t, map[string]any{
+			"iss":                m.URL,
+			"aud":                clientID,
+			"sub":                subject,
+			"preferred_username": username,
+			"groups":             groups,
+			"nonce":              auth.Get("nonce"),
+			"iat":                time.Now().Unix(),
+			"exp":                time.Now().Add(time.Hour).Unix(),
+		})})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockIssuer) setUser(username string, groups ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.username, m.subject, m.groups = username, "", groups
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t, "ytdlp")
+	users, _ := newUserStore("")
+	users.bootstrapAdmin("local", "local-password")
+	tokens, _ := newTokenStore("")
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	auth := newAuthenticator(users, tokens, AuthConfig{OIDC: &OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "ytdlp",
+		ClientSecret: "secret",
+		RedirectURL:  srv.URL + "/api/oidc/callback",
+		AdminGroups:  []string{"ops"},
+		MemberGroups: []string{"family"},
+	}})
+	mux.HandleFunc("GET /api/oidc/login", handleOIDCLogin(auth))
+	mux.HandleFunc("GET /api/oidc/callback", handleOIDCCallback(auth))
+	mux.HandleFunc("GET /api/auth", handleAuth(auth))
+	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Config.Handler = authMiddleware(mux, auth)
+
+	signIn := func(username string, groups ...string) (*http.Client, int) {
+		issuer.setUser(username, groups...)
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		resp, err := client.Get(srv.URL + "/api/oidc/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return client, resp.StatusCode
+	}
+	whoami := func(client *http.Client) authResponse {
+		resp, err := client.Get(srv.URL + "/api/auth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out authResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+
+	client, status := signIn("carol", "ops")
+	if status != http.StatusOK {
+		t.Fatalf("sign in got %d", status)
+	}
+	if me := whoami(client); me.Username != "carol" || me.Role != RoleAdmin || me.CSRFToken == "" {
+		t.Errorf("signed in as %+v, want admin carol", me)
+	}
+	if u, ok := users.Get("carol"); !ok || u.Source != SourceOIDC {
+		t.Errorf("carol recorded as %+v", u)
+	}
+
+	// Roles follow the provider's groups on every login
+	client, _ = signIn("carol", "family")
+	if me := whoami(client); me.Role != RoleMember {
+		t.Errorf("carol has role %q after leaving ops", me.Role)
+	}
+
+	if u, _ := users.Get("carol"); u.Subject != "sub-carol" || u.Issuer != issuer.URL {
+		t.Errorf("carol bound to %q at %q", u.Subject, u.Issuer)
+	}
+
+	// Another subject reusing carol's name does not get her account
+	issuer.setUser("carol", "ops")
+	issuer.mu.Lock()
+	issuer.subject = "someone-else"
+	issuer.mu.Unlock()
+	jar, _ := cookiejar.New(nil)
+	resp, err := (&http.Client{Jar: jar}).Get(srv.URL + "/api/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("sign in as carol with another subject got %d", resp.StatusCode)
+	}
+
+	if _, status := signIn("mallory", "strangers"); status != http.StatusForbidden {
+		t.Errorf("user outside the allowed groups got %d", status)
+	}
+	if _, status := signIn("local", "ops"); status != http.StatusForbidden {
+		t.Errorf("sign in as a local account's name got %d", status)
+	}
+	if _, ok := users.Authenticate("carol", ""); ok {
+		t.Error("single sign-on account accepted an empty password")
+	}
+
+	// A callback without the browser's state cookie is rejected
+	resp, err = http.Get(srv.URL + "/api/oidc/callback?code=x&state=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged callback got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCCheckClaims(t *testing.T) {
+	o := newOIDCProvider(OIDCConfig{Issuer: "https://idp.example", ClientID: "ytdlp"})
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   "https://idp.example",
+			"aud":   []any{"other", "ytdlp"},
+			"exp":   float64(time.Now().Add(time.Hour).Unix()),
+			"iat":   float64(time.Now().Unix()),
+			"nonce": "n1",
+		}
+	}
+	if err := o.checkClaims(valid(), "n1"); err != nil {
+		t.Fatalf("valid claims rejected: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		claim string
+		value any
+		want  string
+	}{
+		{"issuer", "iss", "https://evil.example", "issued by"},
+		{"audience", "aud", "other", "not for this client"},
+		{"authorized party", "azp", "other", "not for this client"},
+		{"expired", "exp", float64(time.Now().Add(-time.Hour).Unix()), "expired"},
+		{"future", "iat", float64(time.Now().Add(time.Hour).Unix()), "future"},
+		{"nonce", "nonce", "replayed", "nonce"},
+	}
+	for _, tt := range tests {
+		claims := valid()
+		claims[tt.claim] = tt.value
+		if err := o.checkClaims(claims, "n1"); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestOIDCRejectsForgedSignature(t *testing.T) {
+	issuer := newMockIssuer(t, "ytdlp")
+	o := newOIDCProvider(OIDCConfig{Issuer: issuer.URL, ClientID: "ytdlp"})
+	token := issuer.sign(t, map[string]any{"sub": "alice"})
+	if _, err := o.verify(token, issuer.URL+"/jwks"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]any{"sub": "admin"})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := o.verify(strings.Join(parts, "."), issuer.URL+"/jwks"); err == nil {
+		t.Error("token with altered claims accepted")
+	}
+
+	none, _ := json.Marshal(map[string]string{"alg": "none", "kid": "k1"})
+	parts[0] = base64.RawURLEncoding.EncodeToString(none)
+	if _, err := o.verify(strings.Join(parts, "."), issuer.URL+"/jwks"); err == nil {
+		t.Error("unsigned token accepted")
+	}
+}
+
+func TestOIDCPendingLoginsBounded(t *testing.T) {
+	issuer := newMockIssuer(t, "ytdlp")
+	o := newOIDCProvider(OIDCConfig{Issuer: issuer.URL, ClientID: "ytdlp", RedirectURL: "https://ytdlp.example/api/oidc/callback"})
+	first, _, err := o.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < oidcMaxPendingLogins+10; i++ {
+		if _, _, err := o.Begin(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.mu.Lock()
+	n := len(o.logins)
+	_, kept := o.logins[first]
+	o.mu.Unlock()
+	if n > oidcMaxPendingLogins || kept {
+		t.Errorf("%d pending logins, oldest kept: %v", n, kept)
+	}
+}
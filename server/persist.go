@@ -11,17 +11,25 @@ import (
 )
 
 type persistedJob struct {
-	ID         string          `json:"id"`
-	URL        string          `json:"url"`
-	Status     JobStatus       `json:"status"`
-	CreatedAt  time.Time       `json:"createdAt"`
-	DoneAt     *time.Time      `json:"doneAt,omitempty"`
-	Error      string          `json:"error,omitempty"`
-	Progress   float64         `json:"progress"`
-	RetryCount int             `json:"retryCount"`
-	MaxRetries int             `json:"maxRetries"`
-	Output     []string        `json:"output,omitempty"`
-	Options    DownloadOptions `json:"options"`
+	ID             string          `json:"id"`
+	URL            string          `json:"url"`
+	Owner          string          `json:"owner,omitempty"`
+	Status         JobStatus       `json:"status"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DoneAt         *time.Time      `json:"doneAt,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	ErrorKind      string          `json:"errorKind,omitempty"`
+	Progress       float64         `json:"progress"`
+	RetryCount     int             `json:"retryCount"`
+	MaxRetries     int             `json:"maxRetries"`
+	Output         []string        `json:"output,omitempty"`
+	Options        DownloadOptions `json:"options"`
+	Warnings       []string        `json:"warnings,omitempty"`
+	Conflicts      []FileConflict  `json:"conflicts,omitempty"`
+	Files          []ProducedFile  `json:"files,omitempty"`
+	NFOIssues      []NFOIssue      `json:"nfoIssues,omitempty"`
+	Notifications  []NotifyResult  `json:"notifications,omitempty"`
+	ArchiveEntries []string        `json:"archiveEntries,omitempty"`
 }
 
 type persistedState struct {
@@ -38,17 +46,25 @@ func jobToPersisted(j *Job) persistedJob {
 		copy(output, j.Output)
 	}
 	return persistedJob{
-		ID:         j.ID,
-		URL:        j.URL,
-		Status:     j.Status,
-		CreatedAt:  j.CreatedAt,
-		DoneAt:     j.DoneAt,
-		Error:      j.Error,
-		Progress:   j.Progress,
-		RetryCount: j.RetryCount,
-		MaxRetries: j.MaxRetries,
-		Output:     output,
-		Options:    j.Options,
+		ID:             j.ID,
+		URL:            j.URL,
+		Owner:          j.Owner,
+		Status:         j.Status,
+		CreatedAt:      j.CreatedAt,
+		DoneAt:         j.DoneAt,
+		Error:          j.Error,
+		ErrorKind:      j.ErrorKind,
+		Progress:       j.Progress,
+		RetryCount:     j.RetryCount,
+		MaxRetries:     j.MaxRetries,
+		Output:         output,
+		Options:        j.Options,
+		Warnings:       j.Warnings,
+		Conflicts:      j.Conflicts,
+		Files:          j.Files,
+		NFOIssues:      j.NFOIssues,
+		Notifications:  j.Notifications,
+		ArchiveEntries: j.ArchiveEntries,
 	}
 }
 
@@ -58,17 +74,25 @@ func persistedToJob(p persistedJob) *Job {
 		opts = DefaultOptions()
 	}
 	return &Job{
-		ID:         p.ID,
-		URL:        p.URL,
-		Status:     p.Status,
-		CreatedAt:  p.CreatedAt,
-		DoneAt:     p.DoneAt,
-		Error:      p.Error,
-		Progress:   p.Progress,
-		RetryCount: p.RetryCount,
-		MaxRetries: p.MaxRetries,
-		Output:     p.Output,
-		Options:    opts,
+		ID:             p.ID,
+		URL:            p.URL,
+		Owner:          p.Owner,
+		Status:         p.Status,
+		CreatedAt:      p.CreatedAt,
+		DoneAt:         p.DoneAt,
+		Error:          p.Error,
+		ErrorKind:      p.ErrorKind,
+		Progress:       p.Progress,
+		RetryCount:     p.RetryCount,
+		MaxRetries:     p.MaxRetries,
+		Output:         p.Output,
+		Options:        opts,
+		Warnings:       p.Warnings,
+		Conflicts:      p.Conflicts,
+		Files:          p.Files,
+		NFOIssues:      p.NFOIssues,
+		Notifications:  p.Notifications,
+		ArchiveEntries: p.ArchiveEntries,
 	}
 }
 
@@ -186,18 +210,28 @@ func (m *DownloadManager) loadState() {
 	log.Printf("persist: restored %d jobs (%d queued)", len(m.jobs), len(m.queue))
 }
 
-// drainQueue starts queued jobs up to the concurrency limit.
+// drainQueue starts queued jobs up to the concurrency limit, unless the
+// queue is paused for low disk space. Jobs waiting for an unavailable
+// proxy keep their place.
 // Must be called with m.mu held.
 func (m *DownloadManager) drainQueue() {
-	for m.running < m.maxConcurrent && len(m.queue) > 0 {
+	var held []string
+	for len(m.queue) > 0 && m.canStart() {
 		id := m.queue[0]
 		m.queue = m.queue[1:]
 		job, ok := m.jobs[id]
 		if !ok {
 			continue
 		}
+		if m.proxyHeld(job) {
+			held = append(held, id)
+			continue
+		}
 		m.running++
 		m.shutdownWg.Add(1)
 		go m.runDownload(job)
 	}
+	if len(held) > 0 {
+		m.queue = append(held, m.queue...)
+	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPersistedJobRoundTrip(t *testing.T) {
+	done := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	job := &Job{
+		ID:         "7",
+		URL:        "https://example.com/a",
+		Owner:      "alice",
+		Status:     StatusFailed,
+		CreatedAt:  done.Add(-time.Hour),
+		DoneAt:     &done,
+		Error:      "stalled: no output for 10m0s",
+		ErrorKind:  ErrorKindStalled,
+		Progress:   12.5,
+		RetryCount: 3,
+		MaxRetries: 3,
+		Options:    DownloadOptions{Format: "mp4", Subtitles: true, Destination: "Kids", Template: "{title}", BypassArchive: true},
+		Warnings:   []string{"missing plot"},
+		Conflicts:  []FileConflict{{Path: "a.mkv", Action: "renamed", RenamedTo: "a (1).mkv"}},
+		Files:      []ProducedFile{{Path: "/media/a.mkv", Size: 10, Type: MediaVideo}},
+		NFOIssues:  []NFOIssue{{File: "a.nfo", Problem: "missing plot"}},
+		Notifications: []NotifyResult{
+			{Server: "jellyfin", Time: done},
+		},
+		ArchiveEntries: []string{"youtube a"},
+		Output:         []string{"dropped for finished jobs"},
+	}
+
+	got := persistedToJob(jobToPersisted(job))
+	job.Output = nil
+	if !reflect.DeepEqual(exportedJob(got), exportedJob(job)) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", exportedJob(got), exportedJob(job))
+	}
+}
+
+// exportedJob strips the unexported, non-comparable fields of a job.
+func exportedJob(j *Job) Job {
+	return Job{
+		ID: j.ID, URL: j.URL, Owner: j.Owner, Status: j.Status, CreatedAt: j.CreatedAt, DoneAt: j.DoneAt,
+		Error: j.Error, ErrorKind: j.ErrorKind, Progress: j.Progress, RetryCount: j.RetryCount,
+		MaxRetries: j.MaxRetries, Options: j.Options, Warnings: j.Warnings, Conflicts: j.Conflicts,
+		Files: j.Files, NFOIssues: j.NFOIssues, Notifications: j.Notifications,
+		ArchiveEntries: j.ArchiveEntries, Output: j.Output,
+	}
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	dataDir := t.TempDir()
+	done := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	m := &DownloadManager{jobs: make(map[string]*Job), dataDir: dataDir, nextID: 3}
+	m.jobs["1"] = &Job{ID: "1", URL: "https://example.com/1", Status: StatusCompleted, CreatedAt: done, DoneAt: &done, Options: DefaultOptions()}
+	m.jobs["2"] = &Job{ID: "2", URL: "https://example.com/2", Status: StatusRetrying, CreatedAt: done.Add(time.Second), Progress: 50, Options: DefaultOptions()}
+	m.jobs["3"] = &Job{ID: "3", URL: "https://example.com/3", Status: StatusQueued, CreatedAt: done, Options: DefaultOptions()}
+	m.executeSave()
+
+	if _, err := os.Stat(filepath.Join(dataDir, "jobs.json")); err != nil {
+		t.Fatalf("jobs.json not written: %v", err)
+	}
+
+	loaded := &DownloadManager{jobs: make(map[string]*Job), dataDir: dataDir, shutdownCtx: context.Background()}
+	loaded.loadState()
+	if loaded.nextID != 3 || len(loaded.jobs) != 3 {
+		t.Fatalf("restored nextID=%d jobs=%d", loaded.nextID, len(loaded.jobs))
+	}
+	if s := loaded.jobs["1"].Status; s != StatusCompleted {
+		t.Errorf("completed job restored as %s", s)
+	}
+	for _, id := range []string{"2", "3"} {
+		if j := loaded.jobs[id]; j.Status != StatusQueued || j.Progress != 0 {
+			t.Errorf("job %s restored as %s at %v%%, want queued at 0", id, j.Status, j.Progress)
+		}
+	}
+	// Re-queued jobs keep their submission order
+	if want := []string{"3", "2"}; !reflect.DeepEqual(loaded.queue, want) {
+		t.Errorf("queue = %v, want %v", loaded.queue, want)
+	}
+}
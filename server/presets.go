@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Preset is a named bundle of download options defined server-side.
+// Unset fields fall through to the defaults.
+type Preset struct {
+	Name        string   `json:"name"`
+	Format      string   `json:"format,omitempty"`
+	AllAudio    *bool    `json:"allAudio,omitempty"`
+	Subtitles   *bool    `json:"subtitles,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Template    string   `json:"template,omitempty"`
+	Extras      []string `json:"extras,omitempty"`
+	Proxy       string   `json:"proxy,omitempty"`
+}
+
+// loadPresets reads the presets file at path. A missing file is not an error.
+func loadPresets(path string, dests map[string]string, extras []Extra, proxies []Proxy) ([]Preset, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var presets []Preset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range presets {
+		if p.Name == "" {
+			return nil, fmt.Errorf("preset without a name")
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate preset %q", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Format != "" && p.Format != "mkv" && p.Format != "mp4" {
+			return nil, fmt.Errorf("preset %q: unsupported format %q", p.Name, p.Format)
+		}
+		if _, ok := dests[p.Destination]; p.Destination != "" && !ok {
+			return nil, fmt.Errorf("preset %q: unknown destination %q", p.Name, p.Destination)
+		}
+		if err := validateTemplate(p.Template); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", p.Name, err)
+		}
+		if err := validateExtras(p.Extras, extras); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", p.Name, err)
+		}
+		if err := validateProxy(p.Proxy, proxies); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", p.Name, err)
+		}
+	}
+	return presets, nil
+}
+
+// findPreset returns the preset with the given name.
+func (m *DownloadManager) findPreset(name string) (Preset, bool) {
+	for _, p := range m.presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
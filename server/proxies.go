@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyNone routes a job directly, bypassing every proxy rule.
+const ProxyNone = "none"
+
+// proxyCheckTimeout bounds a single health check.
+const proxyCheckTimeout = 10 * time.Second
+
+var errProxyUnavailable = errors.New("proxy unavailable")
+
+// Proxy is a named proxy or VPN endpoint. Jobs use it when they select it
+// by name or when their URL host matches one of its host patterns.
+type Proxy struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Hosts    []string `json:"hosts,omitempty"`    // "example.com" also matches subdomains, "*" patterns use glob syntax
+	Fallback string   `json:"fallback,omitempty"` // used while this proxy is down: another proxy, "none" for direct, empty holds jobs
+	CheckURL string   `json:"checkUrl,omitempty"` // fetched through the proxy by the health check instead of a TCP dial
+}
+
+type ProxyConfig struct {
+	Proxies  []Proxy
+	Interval time.Duration                            // how often proxies are health checked
+	Check    func(ctx context.Context, p Proxy) error // checkProxy when nil
+}
+
+type proxyHealth struct {
+	healthy   bool
+	checkedAt time.Time
+	err       string
+}
+
+// proxyPool holds the configured proxies and their health.
+type proxyPool struct {
+	mu      sync.Mutex
+	proxies []Proxy
+	health  map[string]*proxyHealth
+	check   func(ctx context.Context, p Proxy) error
+}
+
+func newProxyPool(cfg ProxyConfig) *proxyPool {
+	pool := &proxyPool{proxies: cfg.Proxies, health: make(map[string]*proxyHealth), check: cfg.Check}
+	if pool.check == nil {
+		pool.check = checkProxy
+	}
+	// Proxies count as healthy until a check says otherwise
+	for _, p := range cfg.Proxies {
+		pool.health[p.Name] = &proxyHealth{healthy: true}
+	}
+	return pool
+}
+
+// loadProxies reads the proxies file at path. A missing file is not an error.
+func loadProxies(path string) ([]Proxy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var proxies []Proxy
+	if err := json.Unmarshal(data, &proxies); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range proxies {
+		if p.Name == "" || p.Name == ProxyNone {
+			return nil, fmt.Errorf("proxy without a valid name")
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate proxy %q", p.Name)
+		}
+		seen[p.Name] = true
+		u, err := url.Parse(p.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("proxy %q: invalid url", p.Name)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks4", "socks4a", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy %q: unsupported scheme %q", p.Name, u.Scheme)
+		}
+		for _, h := range p.Hosts {
+			if !validHostPattern(h) {
+				return nil, fmt.Errorf("proxy %q: invalid host pattern %q", p.Name, h)
+			}
+		}
+	}
+	for _, p := range proxies {
+		if p.Fallback == p.Name {
+			return nil, fmt.Errorf("proxy %q falls back to itself", p.Name)
+		}
+		if p.Fallback != "" && p.Fallback != ProxyNone && !seen[p.Fallback] {
+			return nil, fmt.Errorf("proxy %q: unknown fallback %q", p.Name, p.Fallback)
+		}
+	}
+	return proxies, nil
+}
+
+// validateProxy checks that name is empty, "none" or a configured proxy.
+func validateProxy(name string, proxies []Proxy) error {
+	if name == "" || name == ProxyNone {
+		return nil
+	}
+	for _, p := range proxies {
+		if p.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown proxy %q", name)
+}
+
+func proxyNames(proxies []Proxy) []string {
+	names := []string{}
+	for _, p := range proxies {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func validHostPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return pattern != "" && err == nil
+}
+
+// hostMatches reports whether host matches pattern and how specific the
+// match is.
+func hostMatches(pattern, host string) (int, bool) {
+	pattern = strings.ToLower(strings.TrimPrefix(pattern, "."))
+	if strings.Contains(pattern, "*") {
+		ok, _ := path.Match(pattern, host)
+		return len(strings.ReplaceAll(pattern, "*", "")), ok
+	}
+	return len(pattern), host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// matchProxy returns the proxy whose host rule matches rawURL most
+// specifically, or "" when no rule applies.
+func matchProxy(proxies []Proxy, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	best, bestLen := "", -1
+	for _, p := range proxies {
+		for _, pattern := range p.Hosts {
+			if n, ok := hostMatches(pattern, host); ok && n > bestLen {
+				best, bestLen = p.Name, n
+			}
+		}
+	}
+	return best
+}
+
+func (pool *proxyPool) find(name string) (Proxy, bool) {
+	for _, p := range pool.proxies {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Proxy{}, false
+}
+
+// route resolves the proxy for a job: the requested one or the best host
+// rule, followed through fallbacks while it is down. It returns nil for a
+// direct connection; wait names the proxy the job has to wait for when no
+// usable route exists.
+func (pool *proxyPool) route(opts DownloadOptions, rawURL string) (route *Proxy, wait string, err error) {
+	name := opts.Proxy
+	if name == "" {
+		name = matchProxy(pool.proxies, rawURL)
+	}
+	first := name
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	seen := make(map[string]bool)
+	for name != "" && name != ProxyNone {
+		p, ok := pool.find(name)
+		if !ok {
+			return nil, "", fmt.Errorf("proxy %q is not configured", name)
+		}
+		if pool.health[name].healthy {
+			return &p, "", nil
+		}
+		if p.Fallback == "" || seen[name] {
+			return nil, first, nil
+		}
+		seen[name] = true
+		name = p.Fallback
+	}
+	return nil, "", nil
+}
+
+// proxyHeld reports whether a queued job has to wait for a proxy, noting
+// it in the job output the first time. Must be called with m.mu held.
+func (m *DownloadManager) proxyHeld(job *Job) bool {
+	_, wait, _ := m.proxies.route(job.Options, job.URL)
+	job.mu.Lock()
+	changed := job.heldFor != wait
+	job.heldFor = wait
+	job.mu.Unlock()
+	if wait != "" && changed {
+		job.appendLine(fmt.Sprintf("--- Held: proxy %q is unavailable, waiting in the queue ---", wait))
+	}
+	return wait != ""
+}
+
+// prepareProxy returns the downloader arguments routing the job through
+// its proxy, or errProxyUnavailable when the job has to wait for one.
+func (m *DownloadManager) prepareProxy(job *Job) ([]string, error) {
+	p, wait, err := m.proxies.route(job.Options, job.URL)
+	if err != nil {
+		return nil, err
+	}
+	if wait != "" {
+		return nil, fmt.Errorf("%w: %s", errProxyUnavailable, wait)
+	}
+	if p == nil {
+		return nil, nil
+	}
+	// The URL may carry credentials, so only the name is shown
+	job.appendLine(fmt.Sprintf("Using proxy %q", p.Name))
+	return []string{"--proxy", p.URL}, nil
+}
+
+// checkProxy dials the proxy, or fetches CheckURL through it when set.
+func checkProxy(ctx context.Context, p Proxy) error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	if p.CheckURL == "" {
+		addr := u.Host
+		if u.Port() == "" {
+			port := "1080"
+			switch u.Scheme {
+			case "http":
+				port = "80"
+			case "https":
+				port = "443"
+			}
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyURL(u)}
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.CheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkProxies runs every health check and resumes held jobs when a proxy
+// comes back.
+func (m *DownloadManager) checkProxies() {
+	pool := m.proxies
+	results := make([]error, len(pool.proxies))
+	var wg sync.WaitGroup
+	for i, p := range pool.proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(m.shutdownCtx, proxyCheckTimeout)
+			defer cancel()
+			results[i] = pool.check(ctx, p)
+		}()
+	}
+	wg.Wait()
+	if m.shutdownCtx.Err() != nil {
+		return
+	}
+
+	recovered := false
+	now := time.Now()
+	pool.mu.Lock()
+	for i, p := range pool.proxies {
+		h := pool.health[p.Name]
+		err := results[i]
+		switch {
+		case err != nil && h.healthy:
+			log.Printf("proxy %s: unhealthy: %v", p.Name, err)
+		case err == nil && !h.healthy:
+			log.Printf("proxy %s: healthy again", p.Name)
+			recovered = true
+		}
+		h.healthy = err == nil
+		h.checkedAt = now
+		h.err = ""
+		if err != nil {
+			h.err = err.Error()
+		}
+	}
+	pool.mu.Unlock()
+
+	if recovered {
+		m.mu.Lock()
+		m.drainQueue()
+		m.mu.Unlock()
+	}
+}
+
+// startProxyMonitor health checks the proxies right away and then on
+// every interval.
+func (m *DownloadManager) startProxyMonitor(interval time.Duration) {
+	if len(m.proxies.proxies) == 0 {
+		return
+	}
+	m.shutdownWg.Add(1)
+	go func() {
+		defer m.shutdownWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			m.checkProxies()
+			select {
+			case <-m.shutdownCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ProxyStatus is the public view of a proxy. Credentials in its URL are
+// masked.
+type ProxyStatus struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url"`
+	Hosts     []string   `json:"hosts,omitempty"`
+	Fallback  string     `json:"fallback,omitempty"`
+	Healthy   bool       `json:"healthy"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Held      int        `json:"held"` // queued jobs waiting for this proxy
+}
+
+func handleProxies(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		held := make(map[string]int)
+		mgr.mu.RLock()
+		for _, id := range mgr.queue {
+			if job, ok := mgr.jobs[id]; ok {
+				job.mu.Lock()
+				if job.heldFor != "" {
+					held[job.heldFor]++
+				}
+				job.mu.Unlock()
+			}
+		}
+		mgr.mu.RUnlock()
+
+		pool := mgr.proxies
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		list := []ProxyStatus{}
+		for _, p := range pool.proxies {
+			h := pool.health[p.Name]
+			st := ProxyStatus{
+				Name:     p.Name,
+				URL:      p.URL,
+				Hosts:    p.Hosts,
+				Fallback: p.Fallback,
+				Healthy:  h.healthy,
+				Error:    h.err,
+				Held:     held[p.Name],
+			}
+			if u, err := url.Parse(p.URL); err == nil {
+				st.URL = u.Redacted()
+			}
+			if !h.checkedAt.IsZero() {
+				checked := h.checkedAt
+				st.CheckedAt = &checked
+			}
+			list = append(list, st)
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
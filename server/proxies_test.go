@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// proxyChecks is a health check whose result per proxy can be flipped.
+type proxyChecks struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (c *proxyChecks) set(name string, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[name] = down
+}
+
+func (c *proxyChecks) check(ctx context.Context, p Proxy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down[p.Name] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestMatchProxyByHost(t *testing.T) {
+	proxies := []Proxy{
+		{Name: "uk", Hosts: []string{"bbc.co.uk"}},
+		{Name: "iplayer", Hosts: []string{"*.iplayer.bbc.co.uk"}},
+		{Name: "us", Hosts: []string{"*.hulu.com"}},
+	}
+	tests := map[string]string{
+		"https://www.bbc.co.uk/news":              "uk",
+		"https://bbc.co.uk/news":                  "uk",
+		"https://live.iplayer.bbc.co.uk/episode/": "iplayer",
+		"https://www.hulu.com/watch/1":            "us",
+		"https://hulu.com/watch/1":                "",
+		"https://notbbc.co.uk/":                   "",
+	}
+	for rawURL, want := range tests {
+		if got := matchProxy(proxies, rawURL); got != want {
+			t.Errorf("matchProxy(%s) = %q, want %q", rawURL, got, want)
+		}
+	}
+}
+
+func TestProxyRoutingAndFallback(t *testing.T) {
+	checks := &proxyChecks{down: map[string]bool{}}
+	fake := newFakeExecutor()
+	m, _ := newTestManager(t, ManagerConfig{Proxies: ProxyConfig{
+		Proxies: []Proxy{
+			{Name: "vpn", URL: "socks5://user:pw@vpn:1080", Hosts: []string{"example.com"}, Fallback: "backup"},
+			{Name: "backup", URL: "http://backup:3128"},
+		},
+		Check: checks.check,
+	}}, fake)
+
+	job, _ := m.StartDownload("https://www.example.com/a", DefaultOptions(), "")
+	waitStatus(t, job, StatusCompleted)
+	direct, _ := m.StartDownload("https://other.org/a", DefaultOptions(), "")
+	waitStatus(t, direct, StatusCompleted)
+	checks.set("vpn", true)
+	m.checkProxies()
+	fallback, _ := m.StartDownload("https://www.example.com/b", DefaultOptions(), "")
+	waitStatus(t, fallback, StatusCompleted)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	want := [][]string{
+		{"--proxy", "socks5://user:pw@vpn:1080"},
+		nil,
+		{"--proxy", "http://backup:3128"},
+	}
+	for i, args := range want {
+		if !reflect.DeepEqual(fake.specs[i].Args, args) {
+			t.Errorf("job %d args = %q, want %q", i+1, fake.specs[i].Args, args)
+		}
+	}
+	if out := strings.Join(job.Output, "\n"); strings.Contains(out, "pw@") {
+		t.Error("proxy credentials written to the job output")
+	}
+}
+
+func TestJobHeldUntilProxyRecovers(t *testing.T) {
+	checks := &proxyChecks{down: map[string]bool{"vpn": true}}
+	fake := newFakeExecutor()
+	m, _ := newTestManager(t, ManagerConfig{Proxies: ProxyConfig{
+		Proxies: []Proxy{{Name: "vpn", URL: "http://vpn:8888"}},
+		Check:   checks.check,
+	}}, fake)
+	m.checkProxies()
+
+	if _, err := parseOptions(m, optionsRequest{Proxy: "nope"}); err == nil {
+		t.Error("unknown proxy accepted")
+	}
+	held, _ := m.StartDownload("https://example.com/held", DownloadOptions{Proxy: "vpn"}, "")
+	other, _ := m.StartDownload("https://example.com/direct", DefaultOptions(), "")
+	waitStatus(t, other, StatusCompleted)
+	if s := jobStatus(held); s != StatusQueued {
+		t.Fatalf("held job is %s, want queued", s)
+	}
+	if fake.Calls(held.URL) != 0 {
+		t.Fatal("held job was started")
+	}
+
+	checks.set("vpn", false)
+	m.checkProxies()
+	waitStatus(t, held, StatusCompleted)
+}
+
+func TestRetryHeldUntilProxyRecovers(t *testing.T) {
+	checks := &proxyChecks{down: map[string]bool{}}
+	fake := newFakeExecutor()
+	fake.script("https://example.com/held", fakeAttempt{Exit: 1}, fakeAttempt{Files: map[string]string{"video.mkv": "video"}})
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1, Proxies: ProxyConfig{
+		Proxies: []Proxy{{Name: "vpn", URL: "http://vpn:8888"}},
+		Check:   checks.check,
+	}}, fake)
+	m.checkProxies()
+
+	job, _ := m.StartDownload("https://example.com/held", DownloadOptions{Proxy: "vpn"}, "")
+	waitStatus(t, job, StatusFailed)
+	checks.set("vpn", true)
+	m.checkProxies()
+	if _, err := m.RetryJob(job.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := jobStatus(job); s != StatusQueued {
+		t.Fatalf("retried job is %s, want queued", s)
+	}
+	if n := fake.Calls(job.URL); n != 1 {
+		t.Fatalf("retry started while its proxy was down: %d runs", n)
+	}
+
+	checks.set("vpn", false)
+	m.checkProxies()
+	waitStatus(t, job, StatusCompleted)
+}
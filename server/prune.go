@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// JobPruneConfig limits how long finished job records are kept. Zero
+// values keep records forever.
+type JobPruneConfig struct {
+	Completed  time.Duration // age after which completed jobs are dropped
+	Failed     time.Duration // age after which failed jobs are dropped
+	MaxRecords int           // finished jobs kept at most, oldest dropped first
+	Interval   time.Duration
+}
+
+func (c JobPruneConfig) enabled() bool {
+	return c.Completed > 0 || c.Failed > 0 || c.MaxRecords > 0
+}
+
+// jobFinished reports whether a job can no longer change state on its own.
+// Must be called with j.mu held.
+func jobFinished(j *Job) bool {
+	return (j.Status == StatusCompleted || j.Status == StatusFailed) && j.DoneAt != nil
+}
+
+// heldForRetention reports whether a job's record must outlive record
+// pruning because a retention rule still needs its file manifest. Must be
+// called with j.mu held.
+func (m *DownloadManager) heldForRetention(j *Job) bool {
+	if j.Status != StatusCompleted || len(j.Files) == 0 {
+		return false
+	}
+	for _, rule := range m.retentionRules {
+		if rule.Destination == j.Options.Destination {
+			return true
+		}
+	}
+	return false
+}
+
+// removeJobRecords drops the given finished jobs from the manager. Their
+// produced files, and anything left in their job directory, stay on disk.
+// Must be called with m.mu held.
+func (m *DownloadManager) removeJobRecords(ids []string) {
+	for _, id := range ids {
+		if job, ok := m.jobs[id]; ok {
+			job.closeSubscribers()
+			delete(m.jobs, id)
+		}
+	}
+	if len(ids) > 0 {
+		m.scheduleSave()
+	}
+}
+
+// PruneJobs removes finished jobs with one of the given statuses whose
+// DoneAt is older than olderThan (zero matches all), limited to owner's
+// jobs when owner is set. Active jobs are never touched, and neither are
+// matching jobs a retention rule still needs. It returns the IDs of the
+// removed records and of those kept for retention.
+func (m *DownloadManager) PruneJobs(statuses []JobStatus, olderThan time.Duration, owner string) (removed, held []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		match := jobFinished(job) && (olderThan == 0 || job.DoneAt.Before(cutoff)) && (owner == "" || job.Owner == owner)
+		if match {
+			match = false
+			for _, s := range statuses {
+				if job.Status == s {
+					match = true
+				}
+			}
+		}
+		keep := match && m.heldForRetention(job)
+		job.mu.Unlock()
+		if keep {
+			held = append(held, id)
+		} else if match {
+			removed = append(removed, id)
+		}
+	}
+	m.removeJobRecords(removed)
+	return removed, held
+}
+
+// applyJobPrune enforces the configured record retention. Completed jobs
+// whose files a retention rule manages are kept until retention has
+// removed their files, since retention only finds files through jobs.
+func (m *DownloadManager) applyJobPrune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type finished struct {
+		id     string
+		doneAt time.Time
+	}
+	now := time.Now()
+	var ids []string
+	var kept []finished
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		if !jobFinished(job) || m.heldForRetention(job) {
+			job.mu.Unlock()
+			continue
+		}
+		age := now.Sub(*job.DoneAt)
+		expired := (job.Status == StatusCompleted && m.jobPrune.Completed > 0 && age > m.jobPrune.Completed) ||
+			(job.Status == StatusFailed && m.jobPrune.Failed > 0 && age > m.jobPrune.Failed)
+		doneAt := *job.DoneAt
+		job.mu.Unlock()
+
+		if expired {
+			ids = append(ids, id)
+		} else {
+			kept = append(kept, finished{id, doneAt})
+		}
+	}
+
+	if limit := m.jobPrune.MaxRecords; limit > 0 && len(kept) > limit {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].doneAt.Before(kept[j].doneAt) })
+		for _, f := range kept[:len(kept)-limit] {
+			ids = append(ids, f.id)
+		}
+	}
+
+	if len(ids) > 0 {
+		log.Printf("prune: removing %d old job record(s)", len(ids))
+	}
+	m.removeJobRecords(ids)
+}
+
+// startJobPruner applies the record retention at startup and every interval.
+func (m *DownloadManager) startJobPruner() {
+	if !m.jobPrune.enabled() {
+		return
+	}
+	m.applyJobPrune()
+	m.shutdownWg.Add(1)
+	go func() {
+		defer m.shutdownWg.Done()
+		ticker := time.NewTicker(m.jobPrune.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				m.applyJobPrune()
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrunedJobsStayUnderRetention(t *testing.T) {
+	outputDir := t.TempDir()
+	fake := newFakeExecutor()
+	fake.script("https://example.com/a", fakeAttempt{Files: map[string]string{"Channel/Old.mkv": "video"}})
+	fake.script("https://example.com/fail", fakeAttempt{Exit: 1})
+	m, _ := newTestManager(t, ManagerConfig{
+		OutputDir:    outputDir,
+		MaxRetries:   1,
+		Retention:    []RetentionRule{{MaxAge: "1h", maxAge: time.Hour}},
+		RetentionRun: time.Hour,
+		JobPrune:     JobPruneConfig{Completed: time.Minute, Failed: time.Minute, Interval: time.Hour},
+	}, fake)
+
+	done, _ := m.StartDownload("https://example.com/a", DefaultOptions(), "")
+	waitStatus(t, done, StatusCompleted)
+	failed, _ := m.StartDownload("https://example.com/fail", DefaultOptions(), "")
+	waitStatus(t, failed, StatusFailed)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, j := range []*Job{done, failed} {
+		j.mu.Lock()
+		j.DoneAt = &old
+		j.mu.Unlock()
+	}
+
+	m.applyJobPrune()
+	if _, ok := m.GetJob(failed.ID); ok {
+		t.Error("failed job record not pruned")
+	}
+	if _, ok := m.GetJob(done.ID); !ok {
+		t.Fatal("completed job pruned while retention still tracks its files")
+	}
+
+	// Pruning on demand keeps it too
+	if removed, held := m.PruneJobs([]JobStatus{StatusCompleted}, 0, ""); len(removed) != 0 || len(held) != 1 {
+		t.Errorf("on-demand prune removed %v, kept %v", removed, held)
+	}
+
+	m.enforceRetention()
+	if _, err := os.Stat(filepath.Join(outputDir, "Channel", "Old.mkv")); !os.IsNotExist(err) {
+		t.Errorf("retention kept the file of an expired job: %v", err)
+	}
+	m.applyJobPrune()
+	if _, ok := m.GetJob(done.ID); ok {
+		t.Error("job record kept after retention removed its files")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionRule limits what is kept in one destination. Destination is a
+// name from DESTINATIONS, or empty for the default output root. Zero
+// limits are not enforced. MaxSize counts only files tracked by completed
+// jobs, not everything else stored in the destination.
+type RetentionRule struct {
+	Destination    string `json:"destination,omitempty"`
+	MaxAge         string `json:"maxAge,omitempty"`         // e.g. "30d" or "720h"
+	MaxSize        string `json:"maxSize,omitempty"`        // e.g. "500GB"
+	MaxPerUploader int    `json:"maxPerUploader,omitempty"` // newest items kept per uploader
+
+	maxAge  time.Duration
+	maxSize uint64
+}
+
+// parseAge parses a duration that may also be given in days ("30d").
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// loadRetentionRules reads the rules file at path. A missing file is not an error.
+func loadRetentionRules(path string, dests map[string]string) ([]RetentionRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rules []RetentionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if _, ok := dests[r.Destination]; r.Destination != "" && !ok {
+			return nil, fmt.Errorf("rule %d: unknown destination %q", i+1, r.Destination)
+		}
+		if r.MaxAge != "" {
+			if r.maxAge, err = parseAge(r.MaxAge); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+		if r.MaxSize != "" {
+			if r.maxSize, err = parseSize(r.MaxSize); err != nil || r.maxSize == 0 {
+				return nil, fmt.Errorf("rule %d: invalid maxSize %q", i+1, r.MaxSize)
+			}
+		}
+		if r.MaxPerUploader < 0 {
+			return nil, fmt.Errorf("rule %d: maxPerUploader must not be negative", i+1)
+		}
+		if r.maxAge == 0 && r.maxSize == 0 && r.MaxPerUploader == 0 {
+			return nil, fmt.Errorf("rule %d: no limits set", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// retentionItem is one video together with the sidecar files (NFO,
+// thumbnail, subtitles) the same job produced for it.
+type retentionItem struct {
+	JobID    string    `json:"jobId"`
+	Path     string    `json:"path"`
+	Uploader string    `json:"uploader,omitempty"`
+	Size     int64     `json:"size"`
+	DoneAt   time.Time `json:"doneAt"`
+	Reason   string    `json:"reason"`
+	Files    []string  `json:"files"`
+}
+
+// retentionItems groups the tracked files of completed jobs in the given
+// destination into items. When several jobs track the same video, the most
+// recent one owns it.
+func (m *DownloadManager) retentionItems(destination string) []retentionItem {
+	m.mu.RLock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	m.mu.RUnlock()
+
+	byPath := make(map[string]retentionItem)
+	for _, j := range jobs {
+		j.mu.Lock()
+		if j.Status != StatusCompleted || j.Options.Destination != destination || j.DoneAt == nil {
+			j.mu.Unlock()
+			continue
+		}
+		id, doneAt := j.ID, *j.DoneAt
+		files := make([]ProducedFile, len(j.Files))
+		copy(files, j.Files)
+		j.mu.Unlock()
+
+		for _, v := range files {
+			if v.Type != MediaVideo {
+				continue
+			}
+			if prev, ok := byPath[v.Path]; ok && prev.DoneAt.After(doneAt) {
+				continue
+			}
+			stem := strings.TrimSuffix(v.Path, filepath.Ext(v.Path))
+			item := retentionItem{JobID: id, Path: v.Path, DoneAt: doneAt}
+			for _, f := range files {
+				if f.Path == v.Path || isSidecarOf(f.Path, stem) {
+					item.Files = append(item.Files, f.Path)
+					item.Size += f.Size
+				}
+			}
+			byPath[v.Path] = item
+		}
+	}
+
+	items := make([]retentionItem, 0, len(byPath))
+	for _, item := range byPath {
+		if doc, err := readNFO(strings.TrimSuffix(item.Path, filepath.Ext(item.Path)) + ".nfo"); err == nil {
+			item.Uploader = doc.metadata().Uploader
+		}
+		items = append(items, item)
+	}
+	// Oldest first
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DoneAt.Equal(items[j].DoneAt) {
+			return items[i].DoneAt.Before(items[j].DoneAt)
+		}
+		return items[i].Path < items[j].Path
+	})
+	return items
+}
+
+// retentionPlan returns the items the configured rules would remove. When
+// several rules cover a destination, an item is planned once, by the first
+// rule that removes it, and later rules treat it as gone already.
+func (m *DownloadManager) retentionPlan() []retentionItem {
+	now := time.Now()
+	plan := []retentionItem{}
+	planned := make(map[string]bool)
+	for _, rule := range m.retentionRules {
+		items := m.retentionItems(rule.Destination)
+		marked := make([]bool, len(items))
+		for i, item := range items {
+			marked[i] = planned[item.Path]
+		}
+		mark := func(i int, reason string) {
+			if !marked[i] {
+				marked[i] = true
+				items[i].Reason = reason
+			}
+		}
+
+		if rule.maxAge > 0 {
+			for i, item := range items {
+				if now.Sub(item.DoneAt) > rule.maxAge {
+					mark(i, "older than "+rule.MaxAge)
+				}
+			}
+		}
+
+		if rule.MaxPerUploader > 0 {
+			kept := make(map[string]int)
+			for i := len(items) - 1; i >= 0; i-- {
+				if marked[i] || items[i].Uploader == "" {
+					continue
+				}
+				kept[items[i].Uploader]++
+				if kept[items[i].Uploader] > rule.MaxPerUploader {
+					mark(i, fmt.Sprintf("more than %d items from %s", rule.MaxPerUploader, items[i].Uploader))
+				}
+			}
+		}
+
+		if rule.maxSize > 0 {
+			var total uint64
+			for i, item := range items {
+				if !marked[i] {
+					total += uint64(item.Size)
+				}
+			}
+			for i := 0; i < len(items) && total > rule.maxSize; i++ {
+				if !marked[i] {
+					total -= uint64(items[i].Size)
+					mark(i, "destination larger than "+rule.MaxSize)
+				}
+			}
+		}
+
+		for i, item := range items {
+			if marked[i] && !planned[item.Path] {
+				planned[item.Path] = true
+				plan = append(plan, item)
+			}
+		}
+	}
+	return plan
+}
+
+// RetentionAuditEntry records one removal made by the janitor.
+type RetentionAuditEntry struct {
+	Time   time.Time `json:"time"`
+	JobID  string    `json:"jobId"`
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+const maxAuditEntries = 1000
+
+// retentionAudit keeps recent removals in memory and appends every entry
+// to retention-audit.jsonl in DATA_DIR, which is rotated like the audit
+// log once it grows past maxSize.
+type retentionAudit struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	size    int64
+	entries []RetentionAuditEntry
+}
+
+func newRetentionAudit(dataDir string, maxSize int64, keep int) *retentionAudit {
+	a := &retentionAudit{maxSize: maxSize, keep: keep}
+	if dataDir == "" {
+		return a
+	}
+	a.path = filepath.Join(dataDir, "retention-audit.jsonl")
+	f, err := os.Open(a.path)
+	if err != nil {
+		return a
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		a.size = info.Size()
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e RetentionAuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			a.entries = append(a.entries, e)
+		}
+	}
+	if len(a.entries) > maxAuditEntries {
+		a.entries = a.entries[len(a.entries)-maxAuditEntries:]
+	}
+	return a
+}
+
+func (a *retentionAudit) add(e RetentionAuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = append(a.entries[:0], a.entries[len(a.entries)-maxAuditEntries:]...)
+	}
+	if a.path == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := rotateLog(a.path, a.keep); err != nil {
+			log.Printf("retention: failed to rotate audit log: %v", err)
+		} else {
+			a.size = 0
+		}
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("retention: failed to write audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	n, _ := f.Write(line)
+	a.size += int64(n)
+}
+
+// list returns the audit entries, newest first.
+func (a *retentionAudit) list() []RetentionAuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]RetentionAuditEntry, len(a.entries))
+	for i, e := range a.entries {
+		list[len(list)-1-i] = e
+	}
+	return list
+}
+
+// enforceRetention removes every item in the retention plan and drops the
+// removed files from the manifests of the jobs tracking them.
+func (m *DownloadManager) enforceRetention() {
+	plan := m.retentionPlan()
+	if len(plan) == 0 {
+		return
+	}
+
+	removed := make(map[string]bool)
+	for _, item := range plan {
+		files := make([]ProducedFile, len(item.Files))
+		for i, p := range item.Files {
+			files[i] = ProducedFile{Path: p}
+		}
+		entry := RetentionAuditEntry{Time: time.Now(), JobID: item.JobID, Path: item.Path, Size: item.Size, Reason: item.Reason}
+		if errs := m.removeProducedFiles(files); len(errs) > 0 {
+			entry.Error = errs[0].Error()
+			log.Printf("retention: failed to remove %s: %v", item.Path, errs[0])
+		} else {
+			for _, p := range item.Files {
+				removed[p] = true
+			}
+			log.Printf("retention: removed %s (%s)", item.Path, item.Reason)
+		}
+		m.retentionLog.add(entry)
+	}
+
+	m.mu.RLock()
+	for _, j := range m.jobs {
+		j.mu.Lock()
+		kept := j.Files[:0]
+		for _, f := range j.Files {
+			if !removed[f.Path] {
+				kept = append(kept, f)
+			}
+		}
+		j.Files = kept
+		j.mu.Unlock()
+	}
+	m.mu.RUnlock()
+
+	if m.library != nil {
+		m.library.Refresh()
+	}
+	m.scheduleSave()
+}
+
+// startRetentionJanitor enforces the retention rules every interval.
+func (m *DownloadManager) startRetentionJanitor(interval time.Duration) {
+	if len(m.retentionRules) == 0 {
+		return
+	}
+	m.shutdownWg.Add(1)
+	go func() {
+		defer m.shutdownWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.shutdownCtx.Done():
+				return
+			case <-ticker.C:
+				m.enforceRetention()
+			}
+		}
+	}()
+	log.Printf("retention: enforcing %d rule(s) every %s", len(m.retentionRules), interval)
+}
+
+type retentionPreview struct {
+	Rules []RetentionRule `json:"rules"`
+	Items []retentionItem `json:"items"`
+	Bytes int64           `json:"bytes"`
+}
+
+func handleRetentionPreview(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := mgr.retentionRules
+		if rules == nil {
+			rules = []RetentionRule{}
+		}
+		preview := retentionPreview{Rules: rules, Items: mgr.retentionPlan()}
+		for _, item := range preview.Items {
+			preview.Bytes += item.Size
+		}
+		writeJSON(w, http.StatusOK, preview)
+	}
+}
+
+func handleRetentionAudit(mgr *DownloadManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, mgr.retentionLog.list())
+	}
+}
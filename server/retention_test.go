@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRetentionRules(t *testing.T) {
+	dir := t.TempDir()
+	dests := map[string]string{"Kids": filepath.Join(dir, "kids")}
+	tests := []struct {
+		name, rules, wantErr string
+	}{
+		{"valid", `[{"maxAge": "30d"}, {"destination": "Kids", "maxSize": "2GB", "maxPerUploader": 5}]`, ""},
+		{"unknown destination", `[{"destination": "Music", "maxAge": "1h"}]`, "unknown destination"},
+		{"bad age", `[{"maxAge": "soon"}]`, "invalid age"},
+		{"bad size", `[{"maxSize": "0"}]`, "invalid maxSize"},
+		{"no limits", `[{"destination": "Kids"}]`, "no limits"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		os.WriteFile(path, []byte(tt.rules), 0o644)
+		rules, err := loadRetentionRules(path, dests)
+		if tt.wantErr == "" {
+			if err != nil || len(rules) != 2 || rules[0].maxAge != 30*24*time.Hour || rules[1].maxSize != 2<<30 {
+				t.Errorf("%s: rules = %+v, err = %v", tt.name, rules, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+	if rules, err := loadRetentionRules(filepath.Join(dir, "missing.json"), dests); rules != nil || err != nil {
+		t.Errorf("missing file: %v %v", rules, err)
+	}
+}
+
+// retentionManager runs one completed download per URL into outputDir,
+// each producing a 100-byte video, and backdates them by the given ages.
+func retentionManager(t *testing.T, outputDir string, rules []RetentionRule, ages map[string]time.Duration) (*DownloadManager, map[string]*Job) {
+	t.Helper()
+	fake := newFakeExecutor()
+	for url := range ages {
+		name := url[strings.LastIndex(url, "/")+1:]
+		fake.script(url, fakeAttempt{Files: map[string]string{name + ".mkv": strings.Repeat("x", 100)}})
+	}
+	m, _ := newTestManager(t, ManagerConfig{OutputDir: outputDir, Retention: rules, RetentionRun: time.Hour}, fake)
+	jobs := make(map[string]*Job)
+	for url, age := range ages {
+		job, _ := m.StartDownload(url, DefaultOptions(), "")
+		waitStatus(t, job, StatusCompleted)
+		doneAt := time.Now().Add(-age)
+		job.mu.Lock()
+		job.DoneAt = &doneAt
+		job.mu.Unlock()
+		jobs[url] = job
+	}
+	return m, jobs
+}
+
+func TestRetentionPlan(t *testing.T) {
+	outputDir := t.TempDir()
+	m, _ := retentionManager(t, outputDir, []RetentionRule{{MaxSize: "250B", maxSize: 250}}, map[string]time.Duration{
+		"https://example.com/old":    3 * time.Hour,
+		"https://example.com/middle": 2 * time.Hour,
+		"https://example.com/new":    time.Hour,
+	})
+
+	// Oldest items go first until the destination fits
+	plan := m.retentionPlan()
+	if len(plan) != 1 || filepath.Base(plan[0].Path) != "old.mkv" || plan[0].Size != 100 {
+		t.Fatalf("plan = %+v, want old.mkv only", plan)
+	}
+	if !strings.Contains(plan[0].Reason, "larger than 250B") {
+		t.Errorf("reason = %q", plan[0].Reason)
+	}
+}
+
+func TestRetentionRulesShareDestination(t *testing.T) {
+	outputDir := t.TempDir()
+	rules := []RetentionRule{
+		{MaxAge: "90m", maxAge: 90 * time.Minute},
+		{MaxSize: "150B", maxSize: 150},
+	}
+	m, _ := retentionManager(t, outputDir, rules, map[string]time.Duration{
+		"https://example.com/old": 2 * time.Hour,
+		"https://example.com/new": time.Hour,
+	})
+
+	// Both rules would remove old.mkv; it is planned once, and the size
+	// rule counts it as gone rather than removing new.mkv too
+	plan := m.retentionPlan()
+	if len(plan) != 1 || filepath.Base(plan[0].Path) != "old.mkv" || !strings.HasPrefix(plan[0].Reason, "older than") {
+		t.Fatalf("plan = %+v, want old.mkv once, removed by age", plan)
+	}
+
+	m.enforceRetention()
+	audit := m.retentionLog.list()
+	if len(audit) != 1 || audit[0].Error != "" {
+		t.Errorf("audit = %+v, want a single successful removal", audit)
+	}
+	if _, err := os.Stat(plan[0].Path); !os.IsNotExist(err) {
+		t.Errorf("old.mkv kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "new.mkv")); err != nil {
+		t.Errorf("new.mkv removed: %v", err)
+	}
+}
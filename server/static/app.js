@@ -1,60 +1,103 @@
 // --- Auth ---
 
-let authToken = sessionStorage.getItem('authToken') || '';
+// The session lives in an HttpOnly cookie; requests that change state
+// prove they come from this page with the session's CSRF token.
+let csrfToken = '';
 
 function authFetch(url, opts = {}) {
-  if (authToken) {
+  const method = (opts.method || 'GET').toUpperCase();
+  if (csrfToken && method !== 'GET' && method !== 'HEAD') {
     opts.headers = opts.headers || {};
-    opts.headers['Authorization'] = 'Bearer ' + authToken;
+    opts.headers['X-CSRF-Token'] = csrfToken;
   }
   return fetch(url, opts).then(resp => {
     if (resp.status === 401) {
-      sessionStorage.removeItem('authToken');
-      authToken = '';
+      csrfToken = '';
       document.getElementById('auth-overlay').classList.add('open');
     }
     return resp;
   });
 }
 
+let principal = { role: 'admin', authEnabled: false };
+
+function applyPrincipal(p) {
+  principal = p;
+  csrfToken = p.csrfToken || '';
+  document.body.classList.toggle('is-admin', p.role === 'admin');
+  document.getElementById('user-info').classList.toggle('open', !!p.authEnabled);
+  document.getElementById('user-name').textContent = p.username || '';
+}
+
 async function checkAuth() {
   try {
     const resp = await authFetch('/api/auth');
-    if (resp.status === 401) return;
+    if (resp.status === 401) {
+      loadLoginMethods();
+      return;
+    }
+    if (resp.ok) applyPrincipal(await resp.json());
   } catch {
     // server unreachable, proceed anyway
   }
   loadJobs();
+  loadOptions();
+  loadDisk();
+}
+
+async function loadLoginMethods() {
+  try {
+    const resp = await fetch('/api/login');
+    if (!resp.ok) return;
+    const methods = await resp.json();
+    document.getElementById('auth-sso').classList.toggle('open', !!methods.oidc);
+  } catch {}
 }
 
 async function tryLogin() {
+  const userInput = document.getElementById('auth-username');
   const input = document.getElementById('auth-password');
   const errorEl = document.getElementById('auth-error');
+  const username = userInput.value.trim();
   const pw = input.value;
-  if (!pw) return;
+  if (!username || !pw) return;
 
   try {
-    const resp = await fetch('/api/auth', {
-      headers: { 'Authorization': 'Bearer ' + pw }
+    const resp = await fetch('/api/login', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ username, password: pw }),
     });
     if (resp.ok) {
-      authToken = pw;
-      sessionStorage.setItem('authToken', pw);
+      const data = await resp.json();
+      input.value = '';
       errorEl.textContent = '';
       document.getElementById('auth-overlay').classList.remove('open');
+      applyPrincipal(data);
       loadJobs();
+      loadOptions();
+      loadDisk();
+    } else if (resp.status === 429) {
+      errorEl.textContent = 'Too many failed attempts. Try again later.';
     } else {
-      errorEl.textContent = 'Wrong password.';
+      errorEl.textContent = 'Wrong username or password.';
     }
   } catch {
     errorEl.textContent = 'Could not reach server.';
   }
 }
 
+async function logout() {
+  try {
+    await authFetch('/api/logout', { method: 'POST' });
+  } catch {}
+  csrfToken = '';
+  location.reload();
+}
+
 document.addEventListener('DOMContentLoaded', () => {
-  const authInput = document.getElementById('auth-password');
-  if (authInput) {
-    authInput.addEventListener('keydown', (e) => {
+  for (const id of ['auth-username', 'auth-password']) {
+    document.getElementById(id).addEventListener('keydown', (e) => {
       if (e.key === 'Enter') tryLogin();
     });
   }
@@ -142,6 +185,39 @@ function showConfirm(message) {
   });
 }
 
+function showDeleteChoice(message) {
+  return new Promise((resolve) => {
+    modalMessage.textContent = message;
+    modalActions.innerHTML = '';
+
+    const buttons = [
+      ['Cancel', 'modal-btn-cancel', null],
+      ['Keep Files', 'modal-btn-primary', 'job'],
+      ['Delete Files', 'modal-btn-danger', 'files'],
+    ];
+
+    function close(result) {
+      modalOverlay.classList.remove('open');
+      modalOverlay.removeEventListener('click', onOverlay);
+      resolve(result);
+    }
+
+    function onOverlay(e) {
+      if (e.target === modalOverlay) close(null);
+    }
+
+    for (const [label, cls, result] of buttons) {
+      const btn = document.createElement('button');
+      btn.className = 'modal-btn ' + cls;
+      btn.textContent = label;
+      btn.onclick = () => close(result);
+      modalActions.appendChild(btn);
+    }
+    modalOverlay.addEventListener('click', onOverlay);
+    modalOverlay.classList.add('open');
+  });
+}
+
 // --- Tabs ---
 
 tabBtns.forEach(btn => {
@@ -150,6 +226,8 @@ tabBtns.forEach(btn => {
     tabPanels.forEach(p => p.classList.remove('active'));
     btn.classList.add('active');
     document.getElementById(btn.dataset.panel).classList.add('active');
+    if (btn.dataset.panel === 'library-panel') loadLibrary(libraryPath);
+    if (btn.dataset.panel === 'users-panel') loadUsers();
   });
 });
 
@@ -174,12 +252,111 @@ function adjustTabCounts(oldStatus, newStatus) {
 
 // --- Options ---
 
+let presets = [];
+
 function getOptions(prefix) {
-  return {
+  const opts = {
     format: document.getElementById(prefix + '-format').value,
     allAudio: document.getElementById(prefix + '-all-audio').checked,
     subtitles: document.getElementById(prefix + '-subtitles').checked,
   };
+  if (document.getElementById(prefix + '-bypass-archive').checked) opts.bypassArchive = true;
+  const preset = document.getElementById(prefix + '-preset').value;
+  const destination = document.getElementById(prefix + '-destination').value;
+  const template = document.getElementById(prefix + '-template').value.trim();
+  const cookies = document.getElementById(prefix + '-cookies').value;
+  const proxy = document.getElementById(prefix + '-proxy').value;
+  if (preset) opts.preset = preset;
+  if (destination) opts.destination = destination;
+  if (template) opts.template = template;
+  if (cookies) opts.cookieProfile = cookies;
+  if (proxy) opts.proxy = proxy;
+  const extras = document.querySelectorAll('#' + prefix + '-extras input');
+  if (extras.length) opts.extras = [...extras].filter(cb => cb.checked).map(cb => cb.value);
+  return opts;
+}
+
+function applyPreset(prefix) {
+  const name = document.getElementById(prefix + '-preset').value;
+  const p = presets.find(p => p.name === name);
+  if (!p) return;
+  if (p.format) document.getElementById(prefix + '-format').value = p.format;
+  if (p.allAudio !== undefined) document.getElementById(prefix + '-all-audio').checked = p.allAudio;
+  if (p.subtitles !== undefined) document.getElementById(prefix + '-subtitles').checked = p.subtitles;
+  document.getElementById(prefix + '-destination').value = p.destination || '';
+  document.getElementById(prefix + '-template').value = p.template || '';
+  document.getElementById(prefix + '-proxy').value = p.proxy || '';
+  document.querySelectorAll('#' + prefix + '-extras input').forEach(cb => {
+    cb.checked = (p.extras || []).includes(cb.value);
+  });
+}
+
+function fillSelect(id, values) {
+  const select = document.getElementById(id);
+  values.forEach(v => {
+    const opt = document.createElement('option');
+    opt.value = v;
+    opt.textContent = v;
+    select.appendChild(opt);
+  });
+  select.parentElement.classList.toggle('available', values.length > 0);
+}
+
+function fillExtras(id, names) {
+  const container = document.getElementById(id);
+  container.innerHTML = '';
+  names.forEach(name => {
+    const label = document.createElement('label');
+    label.className = 'option';
+    const cb = document.createElement('input');
+    cb.type = 'checkbox';
+    cb.value = name;
+    label.appendChild(cb);
+    label.appendChild(document.createTextNode(' ' + name));
+    container.appendChild(label);
+  });
+}
+
+async function loadOptions() {
+  try {
+    const resp = await authFetch('/api/options');
+    if (!resp.ok) return;
+    const data = await resp.json();
+    presets = data.presets || [];
+    for (const prefix of ['opt', 'bulk-opt']) {
+      fillSelect(prefix + '-preset', presets.map(p => p.name));
+      fillSelect(prefix + '-destination', data.destinations || []);
+      fillExtras(prefix + '-extras', data.extras || []);
+      fillSelect(prefix + '-cookies', data.cookies || []);
+      fillSelect(prefix + '-proxy', data.proxies || []);
+    }
+  } catch {}
+}
+
+// --- Disk space ---
+
+let diskTimer = null;
+
+async function loadDisk() {
+  clearTimeout(diskTimer);
+  try {
+    const resp = await authFetch('/api/disk');
+    if (resp.ok) renderDisk(await resp.json());
+  } catch {}
+  diskTimer = setTimeout(loadDisk, 30000);
+}
+
+function renderDisk(data) {
+  const banner = document.getElementById('disk-banner');
+  if (!data.paused) {
+    banner.classList.remove('open');
+    return;
+  }
+  const low = (data.disks || []).filter(d => d.low)
+    .map(d => d.path + ' (' + formatSize(d.free) + ' free)');
+  banner.textContent = 'Queue paused: free space is below ' + formatSize(data.minFreeSpace) +
+    (low.length ? ' on ' + low.join(', ') : '') + '. Downloads resume once space is freed.';
+  banner.classList.add('open');
 }
 
 // --- Submit ---
@@ -259,6 +436,7 @@ function addJobCard(job) {
   const timeSpan = document.createElement('span');
   timeSpan.className = 'job-time';
   timeSpan.textContent = formatTime(job.createdAt);
+  if (job.owner && principal.role === 'admin') timeSpan.textContent += ' \u00b7 ' + job.owner;
 
   const retryBtn = document.createElement('button');
   retryBtn.className = 'retry-btn';
@@ -267,6 +445,13 @@ function addJobCard(job) {
   retryBtn.style.display = job.status === 'failed' ? '' : 'none';
   retryBtn.onclick = (e) => { e.stopPropagation(); retryJob(job.id); };
 
+  const filesBtn = document.createElement('button');
+  filesBtn.className = 'files-btn';
+  filesBtn.id = 'files-' + job.id;
+  filesBtn.textContent = 'Media';
+  filesBtn.style.display = job.status === 'completed' && job.fileCount > 0 ? '' : 'none';
+  filesBtn.onclick = (e) => { e.stopPropagation(); toggleMedia(job.id); };
+
   const deleteBtn = document.createElement('button');
   deleteBtn.className = 'delete-btn';
   deleteBtn.title = 'Delete job';
@@ -277,6 +462,7 @@ function addJobCard(job) {
   header.appendChild(urlSpan);
   header.appendChild(timeSpan);
   header.appendChild(retryBtn);
+  header.appendChild(filesBtn);
   header.appendChild(deleteBtn);
   card.appendChild(header);
 
@@ -299,6 +485,11 @@ function addJobCard(job) {
   output.appendChild(pre);
   card.appendChild(output);
 
+  const media = document.createElement('div');
+  media.className = 'job-media';
+  media.id = 'media-' + job.id;
+  card.appendChild(media);
+
   if (job.error) {
     const errDiv = document.createElement('div');
     errDiv.className = 'job-error';
@@ -307,6 +498,8 @@ function addJobCard(job) {
     card.appendChild(errDiv);
   }
 
+  renderWarnings(job.id, job.warnings, card);
+
   placeCard(job.id, card);
   adjustTabCounts(null, job.status);
 }
@@ -330,6 +523,110 @@ function placeCard(id, card) {
   }
 }
 
+function renderWarnings(id, warnings, card) {
+  card = card || document.getElementById('job-' + id);
+  if (!card) return;
+  let div = document.getElementById('warnings-' + id);
+  if (!warnings || !warnings.length) {
+    if (div) div.remove();
+    return;
+  }
+  if (!div) {
+    div = document.createElement('div');
+    div.className = 'job-warnings';
+    div.id = 'warnings-' + id;
+    card.appendChild(div);
+  }
+  div.innerHTML = '';
+  for (const w of warnings) {
+    const line = document.createElement('div');
+    line.textContent = w;
+    div.appendChild(line);
+  }
+}
+
+function mediaUrl(path, params = {}) {
+  const qs = new URLSearchParams(params).toString();
+  return qs ? path + '?' + qs : path;
+}
+
+function formatSize(bytes) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) { bytes /= 1024; i++; }
+  return bytes.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+async function toggleMedia(id) {
+  const panel = document.getElementById('media-' + id);
+  if (!panel) return;
+  if (panel.classList.contains('open')) {
+    panel.classList.remove('open');
+    const video = panel.querySelector('video');
+    if (video) video.pause();
+    return;
+  }
+
+  panel.classList.add('open');
+  if (panel.dataset.loaded) return;
+
+  try {
+    const resp = await authFetch('/api/jobs/' + id + '/files');
+    if (!resp.ok) return;
+    const files = await resp.json();
+    panel.innerHTML = '';
+    panel.dataset.loaded = '1';
+
+    const video = files.find(f => f.type === 'video');
+    if (video) {
+      const player = document.createElement('video');
+      player.controls = true;
+      player.preload = 'metadata';
+      player.src = mediaUrl('/api/jobs/' + id + '/files/' + video.index);
+      if (files.some(f => f.type === 'thumbnail')) {
+        player.poster = mediaUrl('/api/jobs/' + id + '/thumbnail');
+      }
+      panel.appendChild(player);
+    }
+
+    const list = document.createElement('ul');
+    list.className = 'file-list';
+    for (const f of files) {
+      const li = document.createElement('li');
+      const link = document.createElement('a');
+      link.href = mediaUrl('/api/jobs/' + id + '/files/' + f.index, { download: 'true' });
+      link.textContent = f.name;
+      const meta = document.createElement('span');
+      meta.className = 'file-meta';
+      meta.textContent = f.type + ', ' + formatSize(f.size);
+      li.appendChild(link);
+      li.appendChild(meta);
+      list.appendChild(li);
+    }
+    panel.appendChild(list);
+  } catch (e) {
+    // ignore
+  }
+}
+
+async function refreshJobDetails(id) {
+  try {
+    const resp = await authFetch('/api/jobs/' + id);
+    if (!resp.ok) return;
+    const job = await resp.json();
+    const known = jobs.get(id);
+    if (known) {
+      known.warnings = job.warnings;
+      known.fileCount = job.fileCount;
+    }
+    renderWarnings(id, job.warnings);
+    const filesBtn = document.getElementById('files-' + id);
+    if (filesBtn) filesBtn.style.display = job.status === 'completed' && job.fileCount > 0 ? '' : 'none';
+  } catch (e) {
+    // ignore
+  }
+}
+
 // --- SSE Streaming ---
 
 function streamJob(id) {
@@ -339,9 +636,7 @@ function streamJob(id) {
     eventSources.delete(id);
   }
 
-  let streamUrl = '/api/jobs/' + id + '/stream';
-  if (authToken) streamUrl += '?token=' + encodeURIComponent(authToken);
-  const es = new EventSource(streamUrl);
+  const es = new EventSource('/api/jobs/' + id + '/stream');
   eventSources.set(id, es);
   const pre = document.getElementById('output-' + id);
 
@@ -417,6 +712,7 @@ function streamJob(id) {
       const bar = document.getElementById('progress-' + id);
       if (bar) bar.style.width = '100%';
     }
+    refreshJobDetails(id);
 
     jobLines.delete(id);
     pendingOutputUpdates.delete(id);
@@ -472,6 +768,7 @@ async function retryJob(id) {
     jobLines.delete(id);
     const errDiv = document.getElementById('error-' + id);
     if (errDiv) errDiv.remove();
+    renderWarnings(id, null);
 
     // Reset progress bar
     const bar = document.getElementById('progress-' + id);
@@ -500,8 +797,16 @@ async function retryJob(id) {
 // --- Delete ---
 
 async function deleteJob(id) {
+  let url = '/api/jobs/' + id;
+  const fileCount = (jobs.get(id) || {}).fileCount || 0;
+  if (fileCount > 0) {
+    const choice = await showDeleteChoice('Delete this job? It produced ' + fileCount + ' file' + (fileCount !== 1 ? 's' : '') + ' in the library.');
+    if (!choice) return;
+    if (choice === 'files') url += '?files=true';
+  }
+
   try {
-    const resp = await authFetch('/api/jobs/' + id, { method: 'DELETE' });
+    const resp = await authFetch(url, { method: 'DELETE' });
     if (!resp.ok) return;
 
     // Close SSE if active
@@ -670,8 +975,15 @@ async function submitBulkDownload() {
     let summary = '';
     if (data.created > 0) summary += '<span class="created">' + data.created + ' created</span>';
     if (data.duplicates > 0) summary += (summary ? ', ' : '') + '<span class="skipped">' + data.duplicates + ' skipped (duplicate)</span>';
+    if (data.rejected > 0) summary += (summary ? ', ' : '') + '<span class="errored">' + data.rejected + ' rejected</span>';
     if (data.errors > 0) summary += (summary ? ', ' : '') + '<span class="errored">' + data.errors + ' failed</span>';
     bulkResults.innerHTML = summary;
+    for (const r of data.results.filter(r => r.status === 'rejected')) {
+      const line = document.createElement('div');
+      line.className = 'bulk-rejection';
+      line.textContent = r.url + ': ' + r.reason;
+      bulkResults.appendChild(line);
+    }
     bulkResults.classList.add('visible');
 
     // Add job cards in reverse so newest appear at top
@@ -697,6 +1009,211 @@ async function submitBulkDownload() {
   }
 }
 
+// --- Library ---
+
+const libraryList = document.getElementById('library-list');
+const libraryBreadcrumb = document.getElementById('library-breadcrumb');
+const librarySearch = document.getElementById('library-search');
+let libraryPath = '';
+let librarySearchTimer = null;
+
+function renderLibraryEntries(entries, emptyText) {
+  libraryList.innerHTML = '';
+  if (!entries.length) {
+    const empty = document.createElement('div');
+    empty.className = 'empty-state';
+    empty.textContent = emptyText;
+    libraryList.appendChild(empty);
+    return;
+  }
+  for (const e of entries) {
+    const row = document.createElement('div');
+    row.className = 'library-entry' + (e.isDir ? ' library-dir' : '');
+
+    const name = document.createElement('span');
+    name.className = 'library-name';
+    name.textContent = (e.isDir ? '\u{1F4C1} ' : '') + (e.title || e.name);
+    name.title = e.path;
+    row.appendChild(name);
+
+    const meta = document.createElement('span');
+    meta.className = 'library-meta';
+    const parts = [];
+    if (!e.isDir) parts.push(formatSize(e.size));
+    if (e.modTime) parts.push(new Date(e.modTime).toLocaleDateString());
+    meta.textContent = parts.join(' \u00b7 ');
+    row.appendChild(meta);
+
+    if (e.isDir) row.onclick = () => loadLibrary(e.path);
+    libraryList.appendChild(row);
+  }
+}
+
+function renderBreadcrumb(path) {
+  libraryBreadcrumb.innerHTML = '';
+  const parts = path ? path.split('/') : [];
+  const crumbs = [['Library', '']];
+  parts.forEach((p, i) => crumbs.push([p, parts.slice(0, i + 1).join('/')]));
+  crumbs.forEach(([label, target], i) => {
+    if (i > 0) libraryBreadcrumb.appendChild(document.createTextNode(' / '));
+    const link = document.createElement('a');
+    link.textContent = label;
+    link.onclick = () => loadLibrary(target);
+    libraryBreadcrumb.appendChild(link);
+  });
+}
+
+async function loadLibrary(path) {
+  librarySearch.value = '';
+  try {
+    const resp = await authFetch('/api/library?path=' + encodeURIComponent(path));
+    if (!resp.ok) {
+      if (path) loadLibrary('');
+      return;
+    }
+    const data = await resp.json();
+    libraryPath = data.path;
+    renderBreadcrumb(libraryPath);
+    renderLibraryEntries(data.entries, 'Nothing here yet.');
+  } catch (e) {
+    // ignore
+  }
+}
+
+librarySearch.addEventListener('input', () => {
+  clearTimeout(librarySearchTimer);
+  librarySearchTimer = setTimeout(async () => {
+    const q = librarySearch.value.trim();
+    if (!q) {
+      loadLibrary(libraryPath);
+      return;
+    }
+    try {
+      const resp = await authFetch('/api/library/search?q=' + encodeURIComponent(q));
+      if (!resp.ok) return;
+      renderBreadcrumb('');
+      renderLibraryEntries(await resp.json(), 'No matches.');
+    } catch (e) {
+      // ignore
+    }
+  }, 250);
+});
+
+// --- Users ---
+
+const userList = document.getElementById('user-list');
+const userError = document.getElementById('user-error');
+
+async function userRequest(url, opts) {
+  userError.textContent = '';
+  const resp = await authFetch(url, opts);
+  if (!resp.ok) {
+    const data = await resp.json().catch(() => ({}));
+    userError.textContent = data.error || 'Request failed.';
+    return false;
+  }
+  loadUsers();
+  return true;
+}
+
+async function loadUsers() {
+  try {
+    const resp = await authFetch('/api/users');
+    if (!resp.ok) return;
+    renderUsers(await resp.json());
+  } catch {}
+}
+
+function renderUsers(users) {
+  userList.innerHTML = '';
+  for (const u of users) {
+    const row = document.createElement('div');
+    row.className = 'user-entry';
+
+    const name = document.createElement('span');
+    name.className = 'user-entry-name';
+    name.textContent = u.username;
+    row.appendChild(name);
+
+    // Roles of single sign-on accounts follow the identity provider
+    if (u.source === 'oidc') {
+      const source = document.createElement('span');
+      source.className = 'user-entry-source';
+      source.textContent = 'SSO · ' + u.role;
+      row.appendChild(source);
+    } else {
+      appendUserControls(row, u);
+    }
+
+    const deleteBtn = document.createElement('button');
+    deleteBtn.className = 'delete-btn';
+    deleteBtn.title = 'Delete user';
+    deleteBtn.innerHTML = '&#x2715;';
+    deleteBtn.onclick = async () => {
+      if (!(await showConfirm('Delete user ' + u.username + '? Their jobs are kept.'))) return;
+      userRequest('/api/users/' + encodeURIComponent(u.username), { method: 'DELETE' });
+    };
+    row.appendChild(deleteBtn);
+
+    userList.appendChild(row);
+  }
+}
+
+// appendUserControls adds the role and password controls of a local account.
+function appendUserControls(row, u) {
+  const role = document.createElement('select');
+  for (const r of ['member', 'admin']) {
+    const opt = document.createElement('option');
+    opt.value = r;
+    opt.textContent = r;
+    role.appendChild(opt);
+  }
+  role.value = u.role;
+  role.onchange = () => userRequest('/api/users/' + encodeURIComponent(u.username), {
+    method: 'PATCH',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ role: role.value }),
+  });
+  row.appendChild(role);
+
+  const resetBtn = document.createElement('button');
+  resetBtn.textContent = 'Reset Password';
+  resetBtn.onclick = () => {
+    const body = {};
+    // Changing one's own password needs the current one
+    if (u.username === principal.username) {
+      body.currentPassword = prompt('Current password:');
+      if (!body.currentPassword) return;
+    }
+    body.password = prompt('New password for ' + u.username + ':');
+    if (!body.password) return;
+    userRequest('/api/users/' + encodeURIComponent(u.username), {
+      method: 'PATCH',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(body),
+    });
+  };
+  row.appendChild(resetBtn);
+}
+
+async function createUser() {
+  const nameInput = document.getElementById('new-user-name');
+  const pwInput = document.getElementById('new-user-password');
+  const ok = await userRequest('/api/users', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({
+      username: nameInput.value.trim(),
+      password: pwInput.value,
+      role: document.getElementById('new-user-role').value,
+    }),
+  });
+  if (ok) {
+    nameInput.value = '';
+    pwInput.value = '';
+  }
+}
+
 checkAuth();
 
 // --- Version ---
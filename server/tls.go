@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client certificate modes.
+const (
+	ClientAuthOff      = "off"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// TLSConfig enables HTTPS on the main listener.
+type TLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string // verifies client certificates when set
+	ClientAuth     string // off, optional or require
+	ReloadInterval time.Duration
+	RedirectPort   string // serves a redirect to HTTPS when set
+}
+
+// certReloader serves the certificate in certFile and keyFile, reloading
+// it when either file changes so renewed certificates apply without a
+// restart. The client CA pool, once loaded, is reloaded the same way.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	modified   [2]time.Time
+	clientCAs  *x509.CertPool
+	caModified time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) modTimes() ([2]time.Time, error) {
+	var times [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
+
+// reload loads the files if they changed since the last load. A pair that
+// fails to load, e.g. while only one file has been replaced, leaves the
+// current certificate in place.
+func (c *certReloader) reload() (bool, error) {
+	times, err := c.modTimes()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && times == c.modified
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert, c.modified = &cert, times
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// loadClientCAs starts verifying client certificates against caFile.
+func (c *certReloader) loadClientCAs(caFile string) error {
+	c.caFile = caFile
+	_, err := c.reloadClientCAs()
+	return err
+}
+
+// reloadClientCAs loads the CA file if it changed since the last load. A
+// file without certificates leaves the current pool in place.
+func (c *certReloader) reloadClientCAs() (bool, error) {
+	if c.caFile == "" {
+		return false, nil
+	}
+	info, err := os.Stat(c.caFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.clientCAs != nil && info.ModTime().Equal(c.caModified)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	pem, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return false, fmt.Errorf("no certificates found in %s", c.caFile)
+	}
+	c.mu.Lock()
+	c.clientCAs, c.caModified = pool, info.ModTime()
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) ClientCAs() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientCAs
+}
+
+// watch checks the files for changes every interval until ctx is done.
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ok, err := c.reload(); err != nil {
+				log.Printf("tls: keeping current certificate, reload failed: %v", err)
+			} else if ok {
+				log.Printf("tls: reloaded certificate from %s", c.certFile)
+			}
+			if ok, err := c.reloadClientCAs(); err != nil {
+				log.Printf("tls: keeping current client CAs, reload failed: %v", err)
+			} else if ok {
+				log.Printf("tls: reloaded client CAs from %s", c.caFile)
+			}
+		}
+	}
+}
+
+// newTLSConfig builds the server's TLS settings around a certificate
+// reloader.
+func newTLSConfig(cfg TLSConfig, certs *certReloader) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if cfg.ClientCAFile == "" {
+		if cfg.ClientAuth != "" && cfg.ClientAuth != ClientAuthOff {
+			return nil, fmt.Errorf("client certificates need TLS_CLIENT_CA_FILE")
+		}
+		return tlsCfg, nil
+	}
+
+	switch cfg.ClientAuth {
+	case "", ClientAuthOptional:
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOff:
+		return tlsCfg, nil
+	default:
+		return nil, fmt.Errorf("client auth must be %s, %s or %s", ClientAuthOff, ClientAuthOptional, ClientAuthRequire)
+	}
+	if err := certs.loadClientCAs(cfg.ClientCAFile); err != nil {
+		return nil, err
+	}
+	// Each handshake gets the current CA pool. The returned config
+	// replaces the one http.Server prepares, so it offers HTTP/2 itself.
+	tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := tlsCfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = certs.ClientCAs()
+		return c, nil
+	}
+	return tlsCfg, nil
+}
+
+// clientCertUser returns the username in the verified client certificate
+// of r, if any.
+func clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// crossSiteRequest reports whether a browser sent r from another origin.
+// Clients other than browsers set neither header.
+func crossSiteRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same host and path on
+// the HTTPS port.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
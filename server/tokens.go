@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token scopes. Submit tokens can only queue downloads, read tokens
+// only make GET requests, admin tokens act with the owner's full rights.
+const (
+	ScopeSubmit = "submit"
+	ScopeRead   = "read"
+	ScopeAdmin  = "admin"
+)
+
+// apiTokenPrefix tells API tokens apart from login sessions.
+const apiTokenPrefix = "ytn_"
+
+// lastUsedInterval limits how often last-used times are written to disk.
+const lastUsedInterval = time.Minute
+
+// APIToken is a long-lived credential for integrations. Only the SHA-256
+// of the secret is kept.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Scope     string     `json:"scope"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+// TokenInfo is the public view of a token, without its hash.
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Owner     string     `json:"owner"`
+	Scope     string     `json:"scope"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Expired   bool       `json:"expired,omitempty"`
+}
+
+func (t *APIToken) info(now time.Time) TokenInfo {
+	return TokenInfo{
+		ID:        t.ID,
+		Name:      t.Name,
+		Owner:     t.Owner,
+		Scope:     t.Scope,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+		LastUsed:  t.LastUsed,
+		Expired:   t.ExpiresAt != nil && now.After(*t.ExpiresAt),
+	}
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenStore keeps API tokens in tokens.json under DATA_DIR. Without
+// DATA_DIR tokens live in memory.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken // by hash
+}
+
+func newTokenStore(dataDir string) (*tokenStore, error) {
+	s := &tokenStore{tokens: make(map[string]*APIToken)}
+	if dataDir == "" {
+		return s, nil
+	}
+
+	s.path = filepath.Join(dataDir, "tokens.json")
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tokens []*APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", s.path, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+// save writes all tokens to disk. Must be called with s.mu held.
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	tokens := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Create issues a token and returns its secret, which is not stored.
+func (s *tokenStore) Create(owner, name, scope string, expiresAt *time.Time) (TokenInfo, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return TokenInfo{}, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return TokenInfo{}, "", err
+	}
+
+	t := &APIToken{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Owner:     owner,
+		Scope:     scope,
+		Hash:      hashToken(secret),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.Hash)
+		return TokenInfo{}, "", err
+	}
+	return t.info(time.Now()), secret, nil
+}
+
+// Lookup returns the unexpired token for secret and records its use.
+func (s *tokenStore) Lookup(secret string) (APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[hashToken(secret)]
+	now := time.Now()
+	if !ok || (t.ExpiresAt != nil && now.After(*t.ExpiresAt)) {
+		return APIToken{}, false
+	}
+	if t.LastUsed == nil || now.Sub(*t.LastUsed) >= lastUsedInterval {
+		used := now.UTC()
+		t.LastUsed = &used
+		if err := s.save(); err != nil {
+			log.Printf("tokens: failed to record last use: %v", err)
+		}
+	}
+	return *t, true
+}
+
+// List returns the tokens of owner, or all tokens when owner is empty.
+func (s *tokenStore) List(owner string) []TokenInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	list := []TokenInfo{}
+	for _, t := range s.tokens {
+		if owner == "" || t.Owner == owner {
+			list = append(list, t.info(now))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes the token with id if owner may manage it (empty owner
+// manages all tokens). It reports whether a token was removed.
+func (s *tokenStore) Revoke(id, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, t := range s.tokens {
+		if t.ID == id && (owner == "" || t.Owner == owner) {
+			delete(s.tokens, hash)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+// RevokeUser deletes every token of a user except the one with ID except.
+func (s *tokenStore) RevokeUser(username, except string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.tokens)
+	for hash, t := range s.tokens {
+		if t.Owner == username && t.ID != except {
+			delete(s.tokens, hash)
+		}
+	}
+	if len(s.tokens) == n {
+		return nil
+	}
+	return s.save()
+}
+
+// scopeAllows reports whether a token scope permits r. Requests made with
+// a login session have no scope.
+func scopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case "", ScopeAdmin:
+		return true
+	case ScopeRead:
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	case ScopeSubmit:
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/download", "POST /api/download/bulk", "GET /api/options", "GET /api/auth":
+			return true
+		}
+	}
+	return false
+}
+
+type tokenRequest struct {
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	ExpiresIn string `json:"expiresIn"` // e.g. "90d", empty never expires
+}
+
+type tokenCreatedResponse struct {
+	TokenInfo
+	Token string `json:"token"`
+}
+
+func handleListTokens(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, auth.tokens.List(principalFrom(r).Owner()))
+	}
+}
+
+// handleCreateToken issues a token for the requesting user. The secret is
+// only ever returned in this response.
+func handleCreateToken(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		// Without accounts every request acts as an anonymous admin, so a
+		// token would neither be limited by its scope nor belong to anyone
+		if !auth.enabled() {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "create a user account before creating API tokens"})
+			return
+		}
+		p := principalFrom(r)
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
+			return
+		}
+		switch req.Scope {
+		case ScopeSubmit, ScopeRead:
+		case ScopeAdmin:
+			if !p.IsAdmin() {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "only admins can create admin tokens"})
+				return
+			}
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "scope must be submit, read or admin"})
+			return
+		}
+		var expiresAt *time.Time
+		if req.ExpiresIn != "" {
+			d, err := parseAge(req.ExpiresIn)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid expiresIn: " + err.Error()})
+				return
+			}
+			t := time.Now().Add(d).UTC()
+			expiresAt = &t
+		}
+
+		info, secret, err := auth.tokens.Create(p.Username, req.Name, req.Scope, expiresAt)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, tokenCreatedResponse{TokenInfo: info, Token: secret})
+	}
+}
+
+func handleDeleteToken(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, err := auth.tokens.Revoke(r.PathValue("id"), principalFrom(r).Owner())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "token not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+	}
+}
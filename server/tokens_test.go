@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStoreKeepsOnlyHashes(t *testing.T) {
+	dataDir := t.TempDir()
+	s, _ := newTokenStore(dataDir)
+	info, secret, err := s.Create("alice", "addon", ScopeSubmit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dataDir, "tokens.json"))
+	if strings.Contains(string(data), secret) {
+		t.Error("token secret stored in plain text")
+	}
+
+	reloaded, _ := newTokenStore(dataDir)
+	tok, ok := reloaded.Lookup(secret)
+	if !ok || tok.Owner != "alice" || tok.Scope != ScopeSubmit {
+		t.Fatalf("Lookup = %+v, %v", tok, ok)
+	}
+	if list := reloaded.List("alice"); len(list) != 1 || list[0].LastUsed == nil {
+		t.Errorf("last use not recorded: %+v", list)
+	}
+	if ok, _ := reloaded.Revoke(info.ID, "bob"); ok {
+		t.Error("bob revoked alice's token")
+	}
+	if ok, _ := reloaded.Revoke(info.ID, "alice"); !ok {
+		t.Error("alice could not revoke her token")
+	}
+	if _, ok := reloaded.Lookup(secret); ok {
+		t.Error("revoked token still valid")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	_, expired, _ := s.Create("alice", "old", ScopeRead, &past)
+	if _, ok := s.Lookup(expired); ok {
+		t.Error("expired token accepted")
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	m, _ := newTestManager(t, ManagerConfig{}, newFakeExecutor())
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	_, submit, _ := tokens.Create("admin", "addon", ScopeSubmit, nil)
+	_, read, _ := tokens.Create("admin", "dashboard", ScopeRead, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/download", handleSubmit(m))
+	mux.HandleFunc("GET /api/jobs", handleListJobs(m))
+	mux.HandleFunc("DELETE /api/jobs", handleDeleteAllJobs(m))
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	defer srv.Close()
+
+	do := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{"POST", "/api/download", submit, `{"url":"https://example.com/a"}`, http.StatusCreated},
+		{"GET", "/api/jobs", submit, "", http.StatusForbidden},
+		{"DELETE", "/api/jobs", submit, "", http.StatusForbidden},
+		{"GET", "/api/jobs", read, "", http.StatusOK},
+		{"POST", "/api/download", read, `{"url":"https://example.com/b"}`, http.StatusForbidden},
+		{"GET", "/api/jobs?token=" + read, "", "", http.StatusUnauthorized},
+		{"GET", "/api/jobs", "ytn_unknown", "", http.StatusUnauthorized},
+		{"GET", "/api/jobs", "admin-password", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.token, tt.body); got != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// The shared password sent the old way gets a hint
+	legacy, _ := http.NewRequest("GET", srv.URL+"/api/jobs", nil)
+	legacy.Header.Set("Authorization", "Bearer admin-password")
+	resp, err := http.DefaultClient.Do(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hint map[string]string
+	json.NewDecoder(resp.Body).Decode(&hint)
+	resp.Body.Close()
+	if !strings.Contains(hint["error"], "API token") {
+		t.Errorf("legacy bearer error = %q", hint["error"])
+	}
+
+	var jobs []jobSummary
+	req, _ := http.NewRequest("GET", srv.URL+"/api/jobs", nil)
+	req.Header.Set("Authorization", "Bearer "+read)
+	resp, _ = http.DefaultClient.Do(req)
+	json.NewDecoder(resp.Body).Decode(&jobs)
+	resp.Body.Close()
+	if len(jobs) != 1 || jobs[0].Owner != "admin" {
+		t.Errorf("jobs = %+v, want one owned by admin", jobs)
+	}
+}
+
+func TestTokenCreationNeedsAccounts(t *testing.T) {
+	users, _ := newUserStore("")
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/tokens", handleCreateToken(auth))
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	defer srv.Close()
+
+	create := func() int {
+		resp, err := http.Post(srv.URL+"/api/tokens", "application/json", strings.NewReader(`{"name":"addon","scope":"submit"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := create(); got != http.StatusConflict {
+		t.Errorf("token created while authentication is off: %d", got)
+	}
+	if len(tokens.List("")) != 0 {
+		t.Error("token stored without an owner")
+	}
+}
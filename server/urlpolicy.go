@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// urlResolveTimeout bounds the DNS lookup made for each submitted URL.
+const urlResolveTimeout = 5 * time.Second
+
+// urlCheckWorkers limits concurrent lookups for a bulk submission.
+const urlCheckWorkers = 8
+
+// extractorHosts maps the extractors that can be allowlisted by name to
+// the hosts they handle.
+var extractorHosts = map[string][]string{
+	"archiveorg":  {"archive.org"},
+	"bandcamp":    {"bandcamp.com"},
+	"bilibili":    {"bilibili.com", "b23.tv"},
+	"dailymotion": {"dailymotion.com", "dai.ly"},
+	"instagram":   {"instagram.com"},
+	"odysee":      {"odysee.com"},
+	"reddit":      {"reddit.com", "redd.it"},
+	"rumble":      {"rumble.com"},
+	"soundcloud":  {"soundcloud.com"},
+	"tiktok":      {"tiktok.com"},
+	"twitch":      {"twitch.tv"},
+	"twitter":     {"twitter.com", "x.com"},
+	"vimeo":       {"vimeo.com"},
+	"youtube":     {"youtube.com", "youtu.be", "youtube-nocookie.com"},
+}
+
+// blockedPrefixes are the ranges besides loopback, private, link-local and
+// multicast addresses that downloads may not reach.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 can reach IPv4 ranges
+}
+
+// URLPolicy decides which URLs may be submitted. A nil policy accepts
+// every URL.
+type URLPolicy struct {
+	Schemes      []string
+	AllowHosts   []string // empty allows every host not denied
+	DenyHosts    []string
+	AllowPrivate bool
+	// Extractors maps allowed extractor names to their hosts; empty allows
+	// every extractor.
+	Extractors map[string][]string
+
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// parseExtractors reads a list of extractor names, with custom ones given
+// as name=host|host.
+func parseExtractors(s string) (map[string][]string, error) {
+	extractors := make(map[string][]string)
+	for _, entry := range splitList(s) {
+		name, hosts, custom := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !custom {
+			known, ok := extractorHosts[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown extractor %q, give its hosts as %s=host|host", name, name)
+			}
+			extractors[name] = known
+			continue
+		}
+		for _, h := range strings.Split(hosts, "|") {
+			if h = strings.TrimSpace(h); h != "" {
+				extractors[name] = append(extractors[name], h)
+			}
+		}
+		if name == "" || len(extractors[name]) == 0 {
+			return nil, fmt.Errorf("invalid extractor %q", entry)
+		}
+	}
+	return extractors, nil
+}
+
+// newURLPolicy validates a policy.
+func newURLPolicy(p URLPolicy) (*URLPolicy, error) {
+	if len(p.Schemes) == 0 {
+		return nil, fmt.Errorf("at least one URL scheme must be allowed")
+	}
+	for i, s := range p.Schemes {
+		p.Schemes[i] = strings.ToLower(s)
+	}
+	var patterns []string
+	patterns = append(patterns, p.AllowHosts...)
+	patterns = append(patterns, p.DenyHosts...)
+	for _, hosts := range p.Extractors {
+		patterns = append(patterns, hosts...)
+	}
+	for _, pattern := range patterns {
+		if !validHostPattern(pattern) {
+			return nil, fmt.Errorf("invalid host pattern %q", pattern)
+		}
+	}
+	if p.lookup == nil {
+		p.lookup = net.DefaultResolver.LookupIPAddr
+	}
+	return &p, nil
+}
+
+func matchesAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if _, ok := hostMatches(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedAddr reports whether downloads must not reach addr.
+func blockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns why rawURL may not be downloaded, or nil.
+func (p *URLPolicy) Check(ctx context.Context, rawURL string) error {
+	if p == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("not an absolute URL")
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if !slices.Contains(p.Schemes, scheme) {
+		return fmt.Errorf("scheme %q is not allowed", scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("URL has no host")
+	}
+	if matchesAny(p.DenyHosts, host) {
+		return fmt.Errorf("host %s is denied", host)
+	}
+	if len(p.AllowHosts) > 0 && !matchesAny(p.AllowHosts, host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	if len(p.Extractors) > 0 {
+		allowed := false
+		for _, hosts := range p.Extractors {
+			allowed = allowed || matchesAny(hosts, host)
+		}
+		if !allowed {
+			names := make([]string, 0, len(p.Extractors))
+			for name := range p.Extractors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("no allowed extractor handles %s (allowed: %s)", host, strings.Join(names, ", "))
+		}
+	}
+	if p.AllowPrivate {
+		return nil
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if blockedAddr(addr) {
+			return fmt.Errorf("%s is a private or reserved address", host)
+		}
+		return nil
+	}
+	// The downloader resolves the host again, so a name whose record
+	// changes in between (DNS rebinding) gets past this check. Only
+	// egress filtering can enforce it.
+	ctx, cancel := context.WithTimeout(ctx, urlResolveTimeout)
+	defer cancel()
+	addrs, err := p.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, a := range addrs {
+		if addr, ok := netip.AddrFromSlice(a.IP); ok && blockedAddr(addr) {
+			return fmt.Errorf("%s resolves to private or reserved address %s", host, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// CheckAll checks urls concurrently and returns the reason each one is
+// rejected, nil for accepted URLs.
+func (p *URLPolicy) CheckAll(ctx context.Context, urls []string) []error {
+	errs := make([]error, len(urls))
+	if p == nil {
+		return errs
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, urlCheckWorkers)
+	for i, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = p.Check(ctx, u)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers lookups from a fixed table.
+func fakeResolver(hosts map[string]string) func(context.Context, string) ([]net.IPAddr, error) {
+	return func(_ context.Context, host string) ([]net.IPAddr, error) {
+		ip, ok := hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+}
+
+func testURLPolicy(t *testing.T, p URLPolicy) *URLPolicy {
+	t.Helper()
+	if p.Schemes == nil {
+		p.Schemes = []string{"http", "https"}
+	}
+	p.lookup = fakeResolver(map[string]string{
+		"www.youtube.com":    "142.250.1.1",
+		"vimeo.com":          "162.159.1.1",
+		"example.com":        "93.184.216.34",
+		"intranet.example":   "10.0.0.5",
+		"metadata.example":   "169.254.169.254",
+		"v6.example":         "::ffff:127.0.0.1",
+		"media.example.com":  "93.184.216.35",
+		"tracker.evil.test":  "93.184.216.36",
+		"cgnat.example":      "100.64.1.1",
+		"videos.example.org": "93.184.216.37",
+	})
+	policy, err := newURLPolicy(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestURLPolicyCheck(t *testing.T) {
+	open := testURLPolicy(t, URLPolicy{DenyHosts: []string{"evil.test"}})
+	extractors, err := parseExtractors("youtube, mysite=videos.example.org|*.mysite.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := testURLPolicy(t, URLPolicy{Extractors: extractors})
+	hosts := testURLPolicy(t, URLPolicy{AllowHosts: []string{"example.com"}, AllowPrivate: true})
+
+	tests := []struct {
+		policy *URLPolicy
+		url    string
+		want   string // substring of the rejection, empty when accepted
+	}{
+		{open, "https://www.youtube.com/watch?v=x", ""},
+		{open, "file:///etc/passwd", `scheme "file"`},
+		{open, "ftp://example.com/a", `scheme "ftp"`},
+		{open, "example.com/video", "not an absolute URL"},
+		{open, "http://127.0.0.1:8080/api/jobs", "private or reserved"},
+		{open, "http://[::1]/", "private or reserved"},
+		{open, "http://intranet.example/", "resolves to private or reserved address 10.0.0.5"},
+		{open, "http://metadata.example/latest", "169.254.169.254"},
+		{open, "http://v6.example/", "127.0.0.1"},
+		{open, "http://cgnat.example/", "100.64.1.1"},
+		{open, "http://2130706433/", "cannot resolve"},
+		{open, "https://youtube.com@10.0.0.1/", "private or reserved"},
+		{open, "https://tracker.evil.test/a", "denied"},
+		{open, "https://unknown.example/a", "cannot resolve"},
+		{strict, "https://www.youtube.com/watch?v=x", ""},
+		{strict, "https://videos.example.org/v/1", ""},
+		{strict, "https://vimeo.com/1", "no allowed extractor handles vimeo.com (allowed: mysite, youtube)"},
+		{hosts, "https://media.example.com/a", ""},
+		{hosts, "http://intranet.example/", "not allowed"},
+		{nil, "anything", ""},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Check(context.Background(), tt.url)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s rejected: %v", tt.url, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: err = %v, want %q", tt.url, err, tt.want)
+		}
+	}
+
+	if _, err := parseExtractors("nosuchsite"); err == nil {
+		t.Error("unknown extractor accepted")
+	}
+	if _, err := newURLPolicy(URLPolicy{Schemes: []string{"https"}, DenyHosts: []string{"[bad"}}); err == nil {
+		t.Error("invalid host pattern accepted")
+	}
+}
+
+func TestBulkSubmitReportsRejections(t *testing.T) {
+	policy := testURLPolicy(t, URLPolicy{})
+	m, _ := newTestManager(t, ManagerConfig{URLPolicy: policy}, newFakeExecutor())
+	srv := httptest.NewServer(handleBulkSubmit(m))
+	defer srv.Close()
+
+	body := `{"urls":["https://example.com/a","file:///etc/passwd","","http://intranet.example/x","https://vimeo.com/1"]}`
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out bulkDownloadResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+
+	if out.Created != 2 || out.Rejected != 2 || len(out.Results) != 4 {
+		t.Fatalf("response = %+v", out)
+	}
+	var statuses []string
+	for _, r := range out.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if got := strings.Join(statuses, ","); got != "created,rejected,rejected,created" {
+		t.Errorf("statuses = %s", got)
+	}
+	if r := out.Results[2]; !strings.Contains(r.Reason, "10.0.0.5") {
+		t.Errorf("rejection reason = %q", r.Reason)
+	}
+	if len(m.ListJobs("")) != 2 {
+		t.Errorf("jobs created for rejected URLs")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+const minPasswordLength = 8
+
+var usernameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// User is an account. Members see and manage only their own jobs, admins
+// see everything and manage users.
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role"`
+	Source       string    `json:"source,omitempty"`  // SourceOIDC for single sign-on accounts
+	Issuer       string    `json:"issuer,omitempty"`  // provider of a single sign-on account
+	Subject      string    `json:"subject,omitempty"` // its sub claim; provider usernames need not be unique
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// SourceOIDC marks accounts created by single sign-on. They have no
+// password and their role follows the identity provider's groups.
+const SourceOIDC = "oidc"
+
+// UserInfo is the public view of a user, without the password hash.
+type UserInfo struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Source    string    `json:"source,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (u *User) info() UserInfo {
+	return UserInfo{Username: u.Username, Role: u.Role, Source: u.Source, CreatedAt: u.CreatedAt}
+}
+
+// userStore keeps accounts in users.json under DATA_DIR. Without DATA_DIR
+// accounts live in memory.
+type userStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+	// dummyHash is compared against for unknown users so a login takes
+	// the same time whether or not the account exists.
+	dummyHash []byte
+}
+
+func newUserStore(dataDir string) (*userStore, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	s := &userStore{users: make(map[string]*User), dummyHash: dummy}
+	if dataDir == "" {
+		return s, nil
+	}
+
+	s.path = filepath.Join(dataDir, "users.json")
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", s.path, err)
+	}
+	for _, u := range users {
+		s.users[u.Username] = u
+	}
+	return s, nil
+}
+
+// save writes all users to disk. Must be called with s.mu held.
+func (s *userStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Empty reports whether no accounts exist, in which case authentication
+// is disabled.
+func (s *userStore) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users) == 0
+}
+
+func (s *userStore) Get(username string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// Authenticate checks a username and password.
+func (s *userStore) Authenticate(username, password string) (User, bool) {
+	s.mu.RLock()
+	var user User
+	u, ok := s.users[username]
+	hash := s.dummyHash
+	if ok && u.PasswordHash != "" {
+		user = *u
+		hash = []byte(u.PasswordHash)
+	} else {
+		ok = false // single sign-on accounts have no password
+	}
+	s.mu.RUnlock()
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return User{}, false
+	}
+	return user, true
+}
+
+func validRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// admins counts the admin accounts. Must be called with s.mu held.
+func (s *userStore) admins() int {
+	n := 0
+	for _, u := range s.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// Create adds an account. The first account must be an admin, since
+// creating it turns authentication on.
+func (s *userStore) Create(username, password, role string) (UserInfo, error) {
+	if !usernameRegex.MatchString(username) {
+		return UserInfo{}, fmt.Errorf("username may only contain letters, digits, '.', '_' and '-'")
+	}
+	if !validRole(role) {
+		return UserInfo{}, fmt.Errorf("role must be %s or %s", RoleAdmin, RoleMember)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return UserInfo{}, fmt.Errorf("user %q already exists", username)
+	}
+	if len(s.users) == 0 && role != RoleAdmin {
+		return UserInfo{}, fmt.Errorf("the first user must be an admin")
+	}
+	u := &User{Username: username, PasswordHash: hash, Role: role, CreatedAt: time.Now().UTC()}
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		delete(s.users, username)
+		return UserInfo{}, err
+	}
+	return u.info(), nil
+}
+
+// Update changes a user's password and/or role. The last admin cannot be
+// demoted.
+func (s *userStore) Update(username string, password, role *string) (UserInfo, error) {
+	var hash string
+	if password != nil {
+		var err error
+		if hash, err = hashPassword(*password); err != nil {
+			return UserInfo{}, err
+		}
+	}
+	if role != nil && !validRole(*role) {
+		return UserInfo{}, fmt.Errorf("role must be %s or %s", RoleAdmin, RoleMember)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return UserInfo{}, errUserNotFound
+	}
+	if u.Source != "" {
+		return UserInfo{}, fmt.Errorf("user %q is managed by single sign-on", username)
+	}
+	if role != nil && u.Role == RoleAdmin && *role != RoleAdmin && s.admins() == 1 {
+		return UserInfo{}, fmt.Errorf("cannot demote the last admin")
+	}
+	prev := *u
+	if hash != "" {
+		u.PasswordHash = hash
+	}
+	if role != nil {
+		u.Role = *role
+	}
+	if err := s.save(); err != nil {
+		*u = prev
+		return UserInfo{}, err
+	}
+	return u.info(), nil
+}
+
+var errUserNotFound = fmt.Errorf("user not found")
+
+// Delete removes an account. The last admin cannot be removed, since that
+// would leave nobody able to manage users.
+func (s *userStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Role == RoleAdmin && s.admins() == 1 {
+		return fmt.Errorf("cannot delete the last admin")
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = u
+		return err
+	}
+	return nil
+}
+
+// List returns every user sorted by name.
+func (s *userStore) List() []UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]UserInfo, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// UpsertExternal records a single sign-on login, creating the account or
+// updating its role. A local account of the same name is never taken over,
+// and neither is one created for another subject at the provider. Accounts
+// recorded before subjects were stored are bound on their next login.
+func (s *userStore) UpsertExternal(username, issuer, subject, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if ok && u.Source != SourceOIDC {
+		return fmt.Errorf("username %q belongs to a local account", username)
+	}
+	if ok && u.Subject != "" && (u.Subject != subject || u.Issuer != issuer) {
+		return fmt.Errorf("username %q belongs to another account at the identity provider", username)
+	}
+	if ok && u.Role == role && u.Subject != "" {
+		return nil
+	}
+	if !ok {
+		u = &User{Username: username, Source: SourceOIDC, CreatedAt: time.Now().UTC()}
+		s.users[username] = u
+	}
+	prev := *u
+	u.Role, u.Issuer, u.Subject = role, issuer, subject
+	if err := s.save(); err != nil {
+		if ok {
+			*u = prev
+		} else {
+			delete(s.users, username)
+		}
+		return err
+	}
+	return nil
+}
+
+// bootstrapAdmin creates an admin from the legacy shared PASSWORD when no
+// accounts exist yet. Existing passwords are kept even when shorter than
+// the minimum for new accounts.
+func (s *userStore) bootstrapAdmin(username, password string) error {
+	if password == "" {
+		return nil
+	}
+	if !usernameRegex.MatchString(username) {
+		return fmt.Errorf("invalid admin username %q", username)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.users) > 0 {
+		return nil
+	}
+	s.users[username] = &User{Username: username, PasswordHash: string(hash), Role: RoleAdmin, CreatedAt: time.Now().UTC()}
+	if err := s.save(); err != nil {
+		delete(s.users, username)
+		return err
+	}
+	log.Printf("auth: created admin user %q from PASSWORD", username)
+	return nil
+}
+
+type userRequest struct {
+	Username        string  `json:"username"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"currentPassword"` // required to change one's own password
+	Role            *string `json:"role"`
+}
+
+func handleListUsers(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, auth.users.List())
+	}
+}
+
+func handleCreateUser(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		password, role := "", RoleMember
+		if req.Password != nil {
+			password = *req.Password
+		}
+		if req.Role != nil {
+			role = *req.Role
+		}
+		info, err := auth.users.Create(req.Username, password, role)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, info)
+	}
+}
+
+// handleUpdateUser changes a user's password or role. Members may change
+// their own password, giving the current one; everything else needs an
+// admin. A new password ends the user's other sessions and revokes their
+// API tokens, keeping only the credential the change was made with.
+func handleUpdateUser(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		p := principalFrom(r)
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid json"})
+			return
+		}
+		self := p.Username == name
+		if !p.IsAdmin() && (!self || req.Role != nil) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		if self && req.Password != nil {
+			_, err := auth.checkPassword(r, name, req.CurrentPassword)
+			var locked *lockedOutError
+			if errors.As(err, &locked) {
+				writeLockedOut(w, locked)
+				return
+			} else if err != nil {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "current password is incorrect"})
+				return
+			}
+		}
+		info, err := auth.users.Update(name, req.Password, req.Role)
+		if err == errUserNotFound {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.Password != nil {
+			keepSession, keepToken := "", ""
+			if self {
+				keepSession, keepToken = p.session, p.tokenID
+			}
+			auth.sessions.RevokeUser(name, keepSession)
+			if err := auth.tokens.RevokeUser(name, keepToken); err != nil {
+				log.Printf("auth: revoke tokens of %s: %v", name, err)
+			}
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+func handleDeleteUser(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		err := auth.users.Delete(name)
+		if err == errUserNotFound {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		auth.sessions.RevokeUser(name, "")
+		if err := auth.tokens.RevokeUser(name, ""); err != nil {
+			log.Printf("auth: revoke tokens of %s: %v", name, err)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserStorePersistsHashes(t *testing.T) {
+	dataDir := t.TempDir()
+	s, err := newUserStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("alice", "correct horse", RoleMember); err == nil {
+		t.Error("first user created as a member")
+	}
+	if _, err := s.Create("admin", "short", RoleAdmin); err == nil {
+		t.Error("short password accepted")
+	}
+	if _, err := s.Create("admin", "correct horse", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("alice", "battery staple", RoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dataDir, "users.json"))
+	if strings.Contains(string(data), "correct horse") {
+		t.Error("password stored in plain text")
+	}
+
+	reloaded, err := newUserStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Authenticate("alice", "battery staple"); !ok {
+		t.Error("reloaded user cannot log in")
+	}
+	if _, ok := reloaded.Authenticate("alice", "correct horse"); ok {
+		t.Error("wrong password accepted")
+	}
+	if err := reloaded.Delete("admin"); err == nil {
+		t.Error("last admin deleted")
+	}
+	member := RoleMember
+	if _, err := reloaded.Update("admin", nil, &member); err == nil {
+		t.Error("last admin demoted")
+	}
+}
+
+func TestBootstrapAdminKeepsLegacyPassword(t *testing.T) {
+	s, _ := newUserStore("")
+	if err := s.bootstrapAdmin("admin", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := s.Authenticate("admin", "pw")
+	if !ok || u.Role != RoleAdmin {
+		t.Fatalf("bootstrap admin = %+v, %v", u, ok)
+	}
+	if err := s.bootstrapAdmin("other", "pw2"); err != nil || len(s.List()) != 1 {
+		t.Error("bootstrap ran with existing users")
+	}
+}
+
+// newAuthServer serves the job endpoints behind the auth middleware with
+// an admin and two members.
+func newAuthServer(t *testing.T, m *DownloadManager) *httptest.Server {
+	t.Helper()
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	users.Create("alice", "alice-password", RoleMember)
+	users.Create("bob", "bob-password", RoleMember)
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", handleLogin(auth))
+	mux.HandleFunc("POST /api/logout", handleLogout(auth))
+	mux.HandleFunc("GET /api/jobs", handleListJobs(m))
+	mux.HandleFunc("POST /api/jobs/{id}/retry", handleRetryJob(m))
+	mux.HandleFunc("DELETE /api/jobs/{id}", handleDeleteJob(m))
+	mux.HandleFunc("DELETE /api/jobs", handleDeleteAllJobs(m))
+	mux.HandleFunc("GET /api/users", requireAdmin(handleListUsers(auth)))
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testSession is a browser login: the session cookie and its CSRF token.
+type testSession struct {
+	cookie *http.Cookie
+	csrf   string
+}
+
+func login(t *testing.T, srv *httptest.Server, user, password string) *testSession {
+	t.Helper()
+	body := strings.NewReader(`{"username":"` + user + `","password":"` + password + `"}`)
+	resp, err := http.Post(srv.URL+"/api/login", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out authResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != http.StatusOK || out.CSRFToken == "" {
+		t.Fatalf("login %s: status %d", user, resp.StatusCode)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			return &testSession{cookie: c, csrf: out.CSRFToken}
+		}
+	}
+	t.Fatalf("login %s: no session cookie", user)
+	return nil
+}
+
+func call(t *testing.T, srv *httptest.Server, method, path string, sess *testSession) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	if sess != nil {
+		req.AddCookie(sess.cookie)
+		req.Header.Set(csrfHeader, sess.csrf)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func listedJobs(t *testing.T, srv *httptest.Server, sess *testSession) []string {
+	t.Helper()
+	var jobs []jobSummary
+	json.NewDecoder(call(t, srv, "GET", "/api/jobs", sess).Body).Decode(&jobs)
+	var urls []string
+	for _, j := range jobs {
+		urls = append(urls, j.URL)
+	}
+	return urls
+}
+
+func TestJobOwnership(t *testing.T) {
+	fake := newFakeExecutor()
+	fake.script("https://example.com/bob", fakeAttempt{Exit: 1})
+	m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1}, fake)
+	alices, _ := m.StartDownload("https://example.com/alice", DefaultOptions(), "alice")
+	bobs, _ := m.StartDownload("https://example.com/bob", DefaultOptions(), "bob")
+	waitStatus(t, alices, StatusCompleted)
+	waitStatus(t, bobs, StatusFailed)
+	srv := newAuthServer(t, m)
+
+	if resp := call(t, srv, "GET", "/api/jobs", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous request got %d", resp.StatusCode)
+	}
+	alice := login(t, srv, "alice", "alice-password")
+	admin := login(t, srv, "admin", "admin-password")
+
+	if got := listedJobs(t, srv, alice); len(got) != 1 || got[0] != alices.URL {
+		t.Errorf("alice sees %v", got)
+	}
+	if got := listedJobs(t, srv, admin); len(got) != 2 {
+		t.Errorf("admin sees %v", got)
+	}
+	if resp := call(t, srv, "POST", "/api/jobs/"+bobs.ID+"/retry", alice); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("alice retried bob's job: %d", resp.StatusCode)
+	}
+	if resp := call(t, srv, "DELETE", "/api/jobs/"+bobs.ID, alice); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("alice deleted bob's job: %d", resp.StatusCode)
+	}
+	if resp := call(t, srv, "GET", "/api/users", alice); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member listed users: %d", resp.StatusCode)
+	}
+
+	call(t, srv, "DELETE", "/api/jobs", alice)
+	if _, ok := m.GetJob(bobs.ID); !ok {
+		t.Error("alice's delete all removed bob's job")
+	}
+	if _, ok := m.GetJob(alices.ID); ok {
+		t.Error("alice's job survived delete all")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	users, _ := newUserStore("")
+	users.Create("admin", "admin-password", RoleAdmin)
+	users.Create("alice", "alice-password", RoleMember)
+	users.Create("bob", "bob-password", RoleMember)
+	tokens, _ := newTokenStore("")
+	auth := newAuthenticator(users, tokens, AuthConfig{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", handleLogin(auth))
+	mux.HandleFunc("GET /api/auth", handleAuth(auth))
+	mux.HandleFunc("PATCH /api/users/{name}", handleUpdateUser(auth))
+	srv := httptest.NewServer(authMiddleware(mux, auth))
+	defer srv.Close()
+
+	patch := func(name, body string, sess *testSession) int {
+		t.Helper()
+		req, _ := http.NewRequest("PATCH", srv.URL+"/api/users/"+name, strings.NewReader(body))
+		req.AddCookie(sess.cookie)
+		req.Header.Set(csrfHeader, sess.csrf)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	authStatus := func(sess *testSession, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/api/auth", nil)
+		if sess != nil {
+			req.AddCookie(sess.cookie)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	alice := login(t, srv, "alice", "alice-password")
+	aliceElsewhere := login(t, srv, "alice", "alice-password")
+	_, aliceToken, _ := tokens.Create("alice", "script", ScopeSubmit, nil)
+
+	if got := patch("alice", `{"password":"stolen-session"}`, alice); got != http.StatusForbidden {
+		t.Errorf("change without the current password got %d", got)
+	}
+	if got := patch("alice", `{"password":"stolen-session","currentPassword":"guess"}`, alice); got != http.StatusForbidden {
+		t.Errorf("change with a wrong current password got %d", got)
+	}
+	if got := patch("alice", `{"password":"new-alice-password","currentPassword":"alice-password"}`, alice); got != http.StatusOK {
+		t.Fatalf("change with the current password got %d", got)
+	}
+	if got := authStatus(alice, ""); got != http.StatusOK {
+		t.Errorf("session that changed the password got %d", got)
+	}
+	if got := authStatus(aliceElsewhere, ""); got != http.StatusUnauthorized {
+		t.Errorf("other session after the change got %d", got)
+	}
+	if got := authStatus(nil, aliceToken); got != http.StatusUnauthorized {
+		t.Errorf("API token after the change got %d", got)
+	}
+	login(t, srv, "alice", "new-alice-password")
+
+	// Admins reset other users' passwords without knowing them
+	bob := login(t, srv, "bob", "bob-password")
+	admin := login(t, srv, "admin", "admin-password")
+	if got := patch("bob", `{"password":"reset-bob-password"}`, admin); got != http.StatusOK {
+		t.Errorf("admin reset got %d", got)
+	}
+	if got := authStatus(bob, ""); got != http.StatusUnauthorized {
+		t.Errorf("bob's session after a reset got %d", got)
+	}
+	if got := patch("admin", `{"password":"new-admin-password"}`, admin); got != http.StatusForbidden {
+		t.Errorf("admin changing their own password without the current one got %d", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Error kinds recorded on failed jobs.
+const (
+	ErrorKindDownload = "download" // ytdlp-nfo exited with an error or produced nothing
+	ErrorKindStalled  = "stalled"  // no output for longer than the stall timeout
+	ErrorKindTimeout  = "timeout"  // the attempt ran longer than the max runtime
+)
+
+// downloadError is a failed download attempt with its classification.
+type downloadError struct {
+	Kind string
+	Msg  string
+}
+
+func (e *downloadError) Error() string { return e.Msg }
+
+// errorKind classifies a failed download attempt.
+func errorKind(err error) string {
+	var de *downloadError
+	if errors.As(err, &de) {
+		return de.Kind
+	}
+	return ErrorKindDownload
+}
+
+// WatchdogConfig bounds how long a download attempt may run.
+type WatchdogConfig struct {
+	StallTimeout time.Duration // kill after this long without output, 0 disables
+	MaxRuntime   time.Duration // kill after this long in total, 0 disables
+}
+
+// activityClock records when a download last produced output.
+type activityClock struct {
+	last atomic.Int64
+}
+
+func (c *activityClock) touch() { c.last.Store(time.Now().UnixNano()) }
+
+func (c *activityClock) idle() time.Duration {
+	return time.Since(time.Unix(0, c.last.Load()))
+}
+
+// watchDownload cancels the attempt when it stalls or exceeds the max
+// runtime, and returns the reason through the result channel once the
+// attempt is over (nil if the watchdog did not fire).
+func (m *DownloadManager) watchDownload(ctx context.Context, cancel context.CancelFunc, clock *activityClock) <-chan *downloadError {
+	result := make(chan *downloadError, 1)
+	cfg := m.watchdog
+	if cfg.StallTimeout <= 0 && cfg.MaxRuntime <= 0 {
+		go func() {
+			<-ctx.Done()
+			result <- nil
+		}()
+		return result
+	}
+
+	interval := 5 * time.Second
+	for _, limit := range []time.Duration{cfg.StallTimeout, cfg.MaxRuntime} {
+		if limit > 0 && limit/4 < interval {
+			interval = limit / 4
+		}
+	}
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				result <- nil
+				return
+			case <-ticker.C:
+			}
+			var reason *downloadError
+			if idle := clock.idle(); cfg.StallTimeout > 0 && idle > cfg.StallTimeout {
+				reason = &downloadError{Kind: ErrorKindStalled, Msg: fmt.Sprintf("stalled: no output for %s", idle.Round(time.Second))}
+			} else if cfg.MaxRuntime > 0 && time.Since(start) > cfg.MaxRuntime {
+				reason = &downloadError{Kind: ErrorKindTimeout, Msg: fmt.Sprintf("timed out after %s", cfg.MaxRuntime)}
+			}
+			if reason != nil {
+				cancel()
+				result <- reason
+				return
+			}
+		}
+	}()
+	return result
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogKillsAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		watchdog WatchdogConfig
+		want     JobStatus
+		kind     string
+		killed   string
+	}{
+		{"stall timeout", WatchdogConfig{StallTimeout: 40 * time.Millisecond}, StatusFailed, ErrorKindStalled, "--- Killed: stalled: no output for"},
+		{"max runtime", WatchdogConfig{MaxRuntime: 60 * time.Millisecond}, StatusFailed, ErrorKindTimeout, "--- Killed: timed out after 60ms ---"},
+		{"disabled", WatchdogConfig{}, StatusCompleted, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hold := make(chan struct{})
+			// Outlasts both limits; only the watchdog ends the attempt early
+			release := time.AfterFunc(300*time.Millisecond, func() { close(hold) })
+			defer release.Stop()
+			fake := newFakeExecutor()
+			fake.script("https://example.com/slow", fakeAttempt{
+				Lines: []string{"[download] starting"},
+				Files: map[string]string{"video.mkv": "video"},
+				Hold:  hold,
+			})
+			m, _ := newTestManager(t, ManagerConfig{MaxRetries: 1, Watchdog: tt.watchdog}, fake)
+
+			job, _ := m.StartDownload("https://example.com/slow", DefaultOptions(), "")
+			waitStatus(t, job, tt.want)
+			job.mu.Lock()
+			kind := job.ErrorKind
+			job.mu.Unlock()
+			if kind != tt.kind {
+				t.Errorf("error kind = %q, want %q", kind, tt.kind)
+			}
+			out := jobOutput(job)
+			if tt.killed != "" && !strings.Contains(out, tt.killed) {
+				t.Errorf("output missing %q:\n%s", tt.killed, out)
+			}
+			if tt.killed == "" && strings.Contains(out, "--- Killed") {
+				t.Errorf("attempt killed with the watchdog disabled:\n%s", out)
+			}
+		})
+	}
+}